@@ -18,12 +18,16 @@ class GoVideoService
     protected string $serverUrl;
     protected string $secretKey;
     protected int $urlExpiry;
+    protected string $tokenFormat;
+    protected string $keyId;
 
     public function __construct()
     {
         $this->serverUrl = config('playtube.go_video_server_url', 'http://localhost:8090');
         $this->secretKey = config('playtube.go_video_secret_key', 'playtube-video-secret-key-change-in-production');
         $this->urlExpiry = config('playtube.signed_url_expiry', 3600); // 1 hour default
+        $this->tokenFormat = config('playtube.go_video_token_format', 'legacy');
+        $this->keyId = config('playtube.go_video_key_id', 'default');
     }
 
     /**
@@ -153,17 +157,72 @@ public function getStats(): ?array
 
     /**
      * Generate signed URL for production
+     *
+     * Options (v2 tokens only):
+     *   - prefix:  path prefix the token unlocks (defaults to /{type}/{uuid})
+     *   - ip:      client IP or CIDR the token is bound to
+     *   - session: viewer session id the token is bound to
+     *   - pace:    progressive pacing as a multiple of the video bitrate
+     *   - bandwidth: progressive bandwidth cap in bytes per second
      */
-    protected function signUrl(string $path): string
+    protected function signUrl(string $path, array $options = []): string
     {
         $expires = time() + $this->urlExpiry;
+        $separator = str_contains($path, '?') ? '&' : '?';
+
+        if ($this->tokenFormat === 'v2') {
+            $token = $this->generateToken($path, $expires, $options);
+            return "{$this->serverUrl}{$path}{$separator}token={$token}";
+        }
+
         $uuid = $this->extractUuidFromPath($path);
         $signature = $this->generateSignature($uuid, $expires);
 
-        $separator = str_contains($path, '?') ? '&' : '?';
         return "{$this->serverUrl}{$path}{$separator}expires={$expires}&sig={$signature}";
     }
 
+    /**
+     * Generate a v2 path-scoped token: v2.<base64url claims>.<base64url hmac>
+     */
+    protected function generateToken(string $path, int $expires, array $options = []): string
+    {
+        $claims = [
+            'kid' => $this->keyId,
+            'exp' => $expires,
+            'path' => $options['prefix'] ?? $this->extractScopeFromPath($path),
+        ];
+
+        $ip = $options['ip'] ?? (config('playtube.go_video_bind_ip', false) ? request()->ip() : null);
+        if ($ip) {
+            $claims['ip'] = $ip;
+        }
+
+        if (!empty($options['session'])) {
+            $claims['sid'] = $options['session'];
+        }
+
+        if (!empty($options['pace'])) {
+            $claims['pace'] = (float) $options['pace'];
+        }
+
+        if (!empty($options['bandwidth'])) {
+            $claims['bw'] = (int) $options['bandwidth'];
+        }
+
+        $signed = 'v2.' . $this->base64UrlEncode(json_encode($claims, JSON_UNESCAPED_SLASHES));
+        $signature = hash_hmac('sha256', $signed, $this->secretKey, true);
+
+        return $signed . '.' . $this->base64UrlEncode($signature);
+    }
+
+    /**
+     * Base64url encoding without padding
+     */
+    protected function base64UrlEncode(string $data): string
+    {
+        return rtrim(strtr(base64_encode($data), '+/', '-_'), '=');
+    }
+
     /**
      * Generate HMAC signature
      */
@@ -182,6 +241,15 @@ protected function extractUuidFromPath(string $path): string
         return $matches[1] ?? '';
     }
 
+    /**
+     * Extract the /{type}/{uuid} scope from path, e.g. /hls/{uuid} for any HLS file
+     */
+    protected function extractScopeFromPath(string $path): string
+    {
+        preg_match('/^\/(?:stream|hls|dash|thumb)\/[a-f0-9\-]+/i', $path, $matches);
+        return $matches[0] ?? parse_url($path, PHP_URL_PATH);
+    }
+
     /**
      * Check if a quality version exists for video
      */
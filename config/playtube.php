@@ -77,6 +77,15 @@
     
     'signed_url_expiry' => env('SIGNED_URL_EXPIRY', 3600), // 1 hour
 
+    // Signed URL format: 'legacy' (uuid:expires) or 'v2' (path-scoped token)
+    'go_video_token_format' => env('GO_VIDEO_TOKEN_FORMAT', 'legacy'),
+
+    // Key id of go_video_secret_key in the Go server keyring (VIDEO_SECRET_KEYS)
+    'go_video_key_id' => env('GO_VIDEO_KEY_ID', 'default'),
+
+    // Bind v2 tokens to the viewer's IP address
+    'go_video_bind_ip' => env('GO_VIDEO_BIND_IP', false),
+
     /*
     |--------------------------------------------------------------------------
     | Adaptive Streaming Settings
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// Admin endpoints live under /admin/ and are called by the Laravel app, not
+// by players. Callers send a v2 token scoped to /admin/ (or to the endpoint)
+// as a bearer token, minted from the same keyring as playback tokens, or the
+// static admin token when one is configured.
+
+// Static admin tokens shorter than this are rejected by the config
+const minAdminTokenLength = 32
+
+// Admin Auth - wraps an admin handler with bearer token checks
+func requireAdmin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if static := currentConfig().AdminToken; static != "" && subtle.ConstantTimeCompare([]byte(token), []byte(static)) == 1 {
+			next(w, r)
+			return
+		}
+		if _, err := verifyToken(token, r); err != nil {
+			logger.Warn("admin request rejected", "request_id", requestID(r.Context()), "path", r.URL.Path, "error", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Metrics Auth - accepts the metrics token, so a scraper needs no admin
+// credentials, and otherwise whatever the admin endpoints accept
+func requireMetrics(next http.HandlerFunc) http.HandlerFunc {
+	admin := requireAdmin(next)
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if static := currentConfig().MetricsToken; static != "" && subtle.ConstantTimeCompare([]byte(token), []byte(static)) == 1 {
+			next(w, r)
+			return
+		}
+		admin(w, r)
+	}
+}
+
+// Cache listings return at most this many files per tier by default
+const (
+	defaultCacheListLimit = 1000
+	maxCacheListLimit     = 100000
+)
+
+// cacheSelector picks the cached files an admin request applies to. Cache
+// names are backend-specific (an absolute path, an s3:// URL or an origin
+// URL), so a uuid matches any name with a path element starting with it,
+// and a prefix is matched against the names as listed.
+type cacheSelector struct {
+	uuid   string
+	prefix string
+}
+
+// Parse the uuid, prefix and all query parameters. At most one selector may
+// be given; required demands exactly one.
+func parseCacheSelector(r *http.Request, required bool) (cacheSelector, error) {
+	q := r.URL.Query()
+	sel := cacheSelector{uuid: q.Get("uuid"), prefix: q.Get("prefix")}
+	all, _ := strconv.ParseBool(q.Get("all"))
+
+	given := 0
+	for _, set := range []bool{sel.uuid != "", sel.prefix != "", all} {
+		if set {
+			given++
+		}
+	}
+	switch {
+	case given > 1:
+		return sel, errors.New("give only one of uuid, prefix and all")
+	case given == 0 && required:
+		return sel, errors.New("one of uuid, prefix or all=true is required")
+	case sel.uuid != "" && !validUUID(sel.uuid):
+		return sel, errors.New("invalid uuid")
+	}
+	return sel, nil
+}
+
+func (s cacheSelector) match(name string) bool {
+	switch {
+	case s.uuid != "":
+		for _, elem := range strings.Split(name, "/") {
+			if strings.HasPrefix(elem, s.uuid) {
+				return true
+			}
+		}
+		return false
+	case s.prefix != "":
+		return strings.HasPrefix(name, s.prefix)
+	}
+	return true
+}
+
+// cacheListing is the body of GET /admin/cache
+type cacheListing struct {
+	Memory    []cacheFileInfo `json:"memory"`
+	Disk      []cacheFileInfo `json:"disk,omitempty"`
+	Shield    []cacheFileInfo `json:"shield,omitempty"`
+	Truncated bool            `json:"truncated"`
+}
+
+// Cache List Handler - cached files per tier, largest first
+func cacheListHandler(w http.ResponseWriter, r *http.Request) {
+	sel, err := parseCacheSelector(r, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	limit := defaultCacheListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 || limit > maxCacheListLimit {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var listing cacheListing
+	truncate := func(files []cacheFileInfo) []cacheFileInfo {
+		if len(files) > limit {
+			listing.Truncated = true
+			return files[:limit]
+		}
+		return files
+	}
+	listing.Memory = truncate(videoCache.Files(sel.match))
+	if diskCache != nil {
+		listing.Disk = truncate(diskCache.Files(sel.match))
+	}
+	if shieldCache != nil {
+		listing.Shield = truncate(shieldCache.Files(sel.match))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+// cachePurgeResult is the body of DELETE /admin/cache
+type cachePurgeResult struct {
+	MemoryBlocks  int   `json:"memory_blocks"`
+	MemoryBytes   int64 `json:"memory_bytes"`
+	DiskBlocks    int   `json:"disk_blocks"`
+	DiskBytes     int64 `json:"disk_bytes"`
+	ShieldObjects int   `json:"shield_objects"`
+	ShieldBytes   int64 `json:"shield_bytes"`
+	Playlists     int   `json:"playlists"` // rewritten playlists
+	Probes        int   `json:"probes"`    // HLS variant and DASH rendition probes
+	Lookups       int   `json:"lookups"`   // remembered video file lookups
+}
+
+// Cache Purge Handler - drop cached data by uuid, by name prefix or entirely
+func cachePurgeHandler(w http.ResponseWriter, r *http.Request) {
+	sel, err := parseCacheSelector(r, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var res cachePurgeResult
+	res.MemoryBlocks, res.MemoryBytes = videoCache.Purge(sel.match)
+	if diskCache != nil {
+		res.DiskBlocks, res.DiskBytes = diskCache.Purge(sel.match)
+	}
+	if shieldCache != nil {
+		res.ShieldObjects, res.ShieldBytes = shieldCache.Purge(sel.match)
+	}
+	res.Playlists = rewrittenPlaylists.Purge(sel.match)
+	// Probes and lookups are keyed by video, not by file name
+	if sel.prefix == "" {
+		res.Probes = purgeProbes(sel.uuid)
+		res.Lookups = videoLookups.Purge(sel.uuid)
+	} else {
+		for _, uuid := range prefixVideos(sel.prefix) {
+			res.Probes += purgeProbes(uuid)
+		}
+		res.Lookups = videoLookups.PurgeNames(sel.match)
+	}
+
+	logger.Info("cache purged", "request_id", requestID(r.Context()), "uuid", sel.uuid, "prefix", sel.prefix,
+		"memory_bytes", res.MemoryBytes, "disk_bytes", res.DiskBytes, "shield_bytes", res.ShieldBytes)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// The videos whose files a name prefix covers: those named by a complete
+// path element, or every video ("") when the prefix stops above them
+func prefixVideos(prefix string) []string {
+	var uuids []string
+	for _, elem := range strings.Split(prefix, "/") {
+		if len(elem) >= 36 && validUUID(elem[:36]) {
+			uuids = append(uuids, elem[:36])
+		}
+	}
+	if len(uuids) == 0 {
+		return []string{""}
+	}
+	return uuids
+}
+
+// Drop the HLS variant and DASH rendition probes of one video, or of every
+// video when uuid is empty
+func purgeProbes(uuid string) int {
+	n := variantProbes.Purge(func(key string) bool { return uuid == "" || strings.HasPrefix(key, uuid+"/") })
+	n += dashProbes.Purge(func(key string) bool { return uuid == "" || key == uuid })
+	return n
+}
+
+// residencyFile is how much of one stored file is cached
+type residencyFile struct {
+	Store        string `json:"store"`
+	Key          string `json:"key"`
+	Name         string `json:"name"` // as in cache listings
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag"`
+	Blocks       int    `json:"blocks"`
+	MemoryBlocks int    `json:"memory_blocks"`
+	DiskBlocks   int    `json:"disk_blocks"`
+	Shield       bool   `json:"shield"` // the current version is stored on the edge
+}
+
+// residencyReport is the body of GET /admin/cache/{uuid}
+type residencyReport struct {
+	UUID         string          `json:"uuid"`
+	Files        []residencyFile `json:"files"`
+	Blocks       int             `json:"blocks"`
+	MemoryBlocks int             `json:"memory_blocks"`
+	DiskBlocks   int             `json:"disk_blocks"`
+}
+
+// Cache Residency Handler - how much of each file of a video is cached
+func cacheResidencyHandler(w http.ResponseWriter, r *http.Request) {
+	uuid := mux.Vars(r)["uuid"]
+	files, err := videoFiles(r.Context(), uuid)
+	if err != nil {
+		logger.Error("cannot list video files", "request_id", requestID(r.Context()), "uuid", uuid, "error", err)
+		http.Error(w, "Cannot list video files", http.StatusBadGateway)
+		return
+	}
+	if len(files) == 0 {
+		http.Error(w, "Video not found", http.StatusNotFound)
+		return
+	}
+
+	report := residencyReport{UUID: uuid, Files: files}
+	for i := range report.Files {
+		f := &report.Files[i]
+		for off := int64(0); off < f.Size; off += cacheBlockSize {
+			f.Blocks++
+			key := cacheKey{path: f.Name, etag: f.ETag, offset: off}
+			if videoCache.Contains(key) {
+				f.MemoryBlocks++
+			}
+			if diskCache != nil && diskCache.Contains(key) {
+				f.DiskBlocks++
+			}
+		}
+		report.Blocks += f.Blocks
+		report.MemoryBlocks += f.MemoryBlocks
+		report.DiskBlocks += f.DiskBlocks
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// List the stored files of a video: everything under its directory in each
+// store, plus the flat progressive names next to it
+func videoFiles(ctx context.Context, uuid string) ([]residencyFile, error) {
+	stores := []struct {
+		name  string
+		store Storage
+	}{
+		{"public", config.PublicStore},
+		{"videos", config.VideoStore},
+		{"hls", config.HLSStore},
+	}
+
+	var files []residencyFile
+	seen := make(map[string]bool)
+	add := func(store string, info ObjectInfo) {
+		if seen[info.Name] {
+			return
+		}
+		seen[info.Name] = true
+		f := residencyFile{Store: store, Key: info.Key, Name: info.Name, Size: info.Size, ETag: info.ETag}
+		if shieldCache != nil {
+			stored, ok := shieldCache.stored(info.Name)
+			f.Shield = ok && stored.ETag == info.ETag
+		}
+		files = append(files, f)
+	}
+
+	flat := []string{uuid + ".mp4", uuid + "-stream.mp4"}
+	for _, q := range qualityLadder {
+		flat = append(flat, uuid+"-"+q+".mp4")
+	}
+	for _, s := range stores {
+		infos, err := s.store.List(ctx, uuid)
+		if err != nil && !isNotExist(err) {
+			return nil, err
+		}
+		for _, info := range infos {
+			add(s.name, info)
+		}
+		for _, key := range flat {
+			if info, err := s.store.Stat(ctx, key); err == nil {
+				add(s.name, info)
+			}
+		}
+	}
+	return files, nil
+}
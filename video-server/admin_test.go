@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRequireAdmin(t *testing.T) {
+	setupStorage(t)
+	token := adminToken(t, "/admin/")
+	config.AdminToken = strings.Repeat("s", minAdminTokenLength)
+	t.Cleanup(func() { config.AdminToken = "" })
+
+	tests := []struct {
+		name       string
+		token      string
+		wantStatus int
+	}{
+		{"no token", "", 401},
+		{"static token", config.AdminToken, 200},
+		{"wrong static token", strings.Repeat("x", minAdminTokenLength), 401},
+		{"v2 token", token, 200},
+		{"token for another path", adminToken(t, "/admin/prewarm"), 401},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := adminRequest(t, "GET", "/admin/stats", tt.token, ""); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+
+	// The public part of the stats carries no cache details
+	var public map[string]interface{}
+	json.Unmarshal(adminRequest(t, "GET", "/stats", "", "").Body.Bytes(), &public)
+	if _, ok := public["cache"]; ok || public["uptime"] == nil {
+		t.Errorf("public /stats = %v", public)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	setupStorage(t)
+	config.CacheEnabled = true
+	var err error
+	if diskCache, err = openDiskCache(t.TempDir(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { diskCache = nil })
+	token := adminToken(t, "/admin/")
+
+	const otherUUID = "99999999-2222-3333-4444-555555555555"
+	other := filepath.Join(config.PublicBasePath, otherUUID+".mp4")
+	if err := os.WriteFile(other, []byte("other video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	warm := func() {
+		t.Helper()
+		for _, f := range []storedFile{
+			{config.PublicStore, testUUID + "/stream.mp4"},
+			{config.HLSStore, testUUID + "/720p/seg_00001.ts"},
+			{config.PublicStore, otherUUID + ".mp4"},
+		} {
+			if _, err := warmStoredFile(context.Background(), f.store, f.key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	residency := func() residencyReport {
+		t.Helper()
+		var report residencyReport
+		rec := adminRequest(t, "GET", "/admin/cache/"+testUUID, token, "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+			t.Fatalf("residency %d %q: %v", rec.Code, rec.Body.String(), err)
+		}
+		return report
+	}
+	warm()
+
+	// stream.mp4, the playlist and the segment, each one block
+	if r := residency(); len(r.Files) != 3 || r.Blocks != 3 || r.MemoryBlocks != 2 || r.DiskBlocks != 2 {
+		t.Errorf("residency = %+v", r)
+	}
+	var listing cacheListing
+	json.Unmarshal(adminRequest(t, "GET", "/admin/cache?uuid="+testUUID, token, "").Body.Bytes(), &listing)
+	if len(listing.Memory) != 2 || len(listing.Disk) != 2 || listing.Truncated {
+		t.Errorf("listing = %+v", listing)
+	}
+
+	var res cachePurgeResult
+	json.Unmarshal(adminRequest(t, "DELETE", "/admin/cache?uuid="+testUUID, token, "").Body.Bytes(), &res)
+	if res.MemoryBlocks != 2 || res.DiskBlocks != 2 {
+		t.Errorf("purge by uuid = %+v", res)
+	}
+	if r := residency(); r.MemoryBlocks != 0 || r.DiskBlocks != 0 {
+		t.Errorf("residency after purge = %+v", r)
+	}
+	if stats := videoCache.Stats(); stats.Items != 1 {
+		t.Errorf("other video purged too: %+v", stats)
+	}
+
+	warm()
+	json.Unmarshal(adminRequest(t, "DELETE", "/admin/cache?prefix="+config.HLSBasePath+"/", token, "").Body.Bytes(), &res)
+	if res.MemoryBlocks != 1 || res.DiskBlocks != 1 {
+		t.Errorf("purge by prefix = %+v", res)
+	}
+
+	// A prefix inside one video drops that video's probes; one above the
+	// videos drops them all
+	seedProbes := func() {
+		for _, uuid := range []string{testUUID, otherUUID} {
+			variantProbes.Get(context.Background(), uuid+"/720p", "v1", func(context.Context) (hlsVariant, error) { return hlsVariant{}, nil })
+		}
+	}
+	variantProbes.Purge(func(string) bool { return true })
+	seedProbes()
+	json.Unmarshal(adminRequest(t, "DELETE", "/admin/cache?prefix="+config.HLSBasePath+"/"+testUUID+"/", token, "").Body.Bytes(), &res)
+	if res.Probes != 1 || variantProbes.Len() != 1 {
+		t.Errorf("purge by video prefix dropped %d probes, %d left", res.Probes, variantProbes.Len())
+	}
+	seedProbes()
+	json.Unmarshal(adminRequest(t, "DELETE", "/admin/cache?prefix="+config.HLSBasePath+"/", token, "").Body.Bytes(), &res)
+	if res.Probes != 2 || variantProbes.Len() != 0 {
+		t.Errorf("purge by root prefix dropped %d probes, %d left", res.Probes, variantProbes.Len())
+	}
+	json.Unmarshal(adminRequest(t, "DELETE", "/admin/cache?all=true", token, "").Body.Bytes(), &res)
+	if res.MemoryBlocks != 2 || res.DiskBlocks != 2 || videoCache.Stats().Items != 0 || diskCache.Stats().Items != 0 {
+		t.Errorf("purge all = %+v", res)
+	}
+
+	for _, query := range []string{"", "?uuid=../etc", "?uuid=" + testUUID + "&all=true", "?all=false"} {
+		if rec := adminRequest(t, "DELETE", "/admin/cache"+query, token, ""); rec.Code != 400 {
+			t.Errorf("DELETE /admin/cache%s: status %d, want 400", query, rec.Code)
+		}
+	}
+	if rec := adminRequest(t, "GET", "/admin/cache/"+otherUUID[:8]+"-0000-0000-0000-000000000000", token, ""); rec.Code != 404 {
+		t.Errorf("residency of an unknown video: status %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cacheBlockSize is the fixed size of every cached block. Range requests are
+// assembled from these blocks, so it should be large enough to keep the
+// number of map lookups per chunk low.
+const cacheBlockSize int64 = 256 * 1024
+
+// cacheKey identifies one block of one version of a file
+type cacheKey struct {
+	path   string
+	etag   string // version validator, so a re-encoded file never hits stale blocks
+	offset int64  // block-aligned byte offset
+}
+
+// VideoCache is an in-memory LRU cache of fixed-size file blocks
+type VideoCache struct {
+	mu        sync.Mutex
+	items     map[cacheKey]*CacheItem
+	lru       *list.List // front = most recently used
+	fills     map[cacheKey]*blockFill
+	size      int64
+	maxSize   int64
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+	coalesced atomic.Int64
+}
+
+// blockFill is one in-flight read of a missing block. Concurrent misses for
+// the same block wait on done and share its result.
+type blockFill struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+type CacheItem struct {
+	key        cacheKey
+	data       []byte
+	size       int64
+	accessTime time.Time
+	hitCount   int64
+	element    *list.Element
+}
+
+// CacheStats is a point-in-time snapshot of cache counters
+type CacheStats struct {
+	Items     int
+	Size      int64
+	MaxSize   int64
+	Hits      int64
+	Misses    int64
+	Evictions int64
+	Coalesced int64 // misses that waited for another request's read
+}
+
+func newVideoCache(maxSize int64) *VideoCache {
+	return &VideoCache{
+		items:   make(map[cacheKey]*CacheItem),
+		lru:     list.New(),
+		fills:   make(map[cacheKey]*blockFill),
+		maxSize: maxSize,
+	}
+}
+
+// Get returns a cached block and marks it as most recently used
+func (c *VideoCache) Get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	item, ok := c.items[key]
+	if ok {
+		item.accessTime = time.Now()
+		item.hitCount++
+		c.lru.MoveToFront(item.element)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return item.data, true
+}
+
+// Put stores a block, evicting least recently used blocks to stay within maxSize
+func (c *VideoCache) Put(key cacheKey, data []byte) {
+	size := int64(len(data))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if size == 0 || size > c.maxSize {
+		return
+	}
+
+	if existing, ok := c.items[key]; ok {
+		c.removeItem(existing)
+	}
+
+	for c.size+size > c.maxSize {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeItem(oldest.Value.(*CacheItem))
+		c.evictions.Add(1)
+	}
+
+	item := &CacheItem{
+		key:        key,
+		data:       data,
+		size:       size,
+		accessTime: time.Now(),
+	}
+	item.element = c.lru.PushFront(item)
+	c.items[key] = item
+	c.size += size
+}
+
+// removeItem must be called with c.mu held
+func (c *VideoCache) removeItem(item *CacheItem) {
+	c.lru.Remove(item.element)
+	delete(c.items, item.key)
+	c.size -= item.size
+}
+
+// Fill returns the block for key, calling read to load it unless another
+// caller is already loading it, in which case it waits for that result.
+// Loaded blocks are stored before waiters are released. shared reports
+// whether the result came from another caller's read.
+func (c *VideoCache) Fill(key cacheKey, read func() ([]byte, error)) (data []byte, shared bool, err error) {
+	c.mu.Lock()
+	if item, ok := c.items[key]; ok {
+		// Filled between the caller's Get and now
+		c.lru.MoveToFront(item.element)
+		c.mu.Unlock()
+		return item.data, true, nil
+	}
+	if f, ok := c.fills[key]; ok {
+		c.mu.Unlock()
+		c.coalesced.Add(1)
+		<-f.done
+		return f.data, true, f.err
+	}
+	f := &blockFill{done: make(chan struct{})}
+	c.fills[key] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.fills, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+	f.data, f.err = read()
+	if f.err == nil {
+		c.Put(key, f.data)
+	}
+	return f.data, false, f.err
+}
+
+// SetMaxSize changes the capacity, evicting blocks until the cache fits
+func (c *VideoCache) SetMaxSize(maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.maxSize = maxSize
+	for c.size > c.maxSize {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			break
+		}
+		c.removeItem(oldest.Value.(*CacheItem))
+		c.evictions.Add(1)
+	}
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *VideoCache) Stats() CacheStats {
+	c.mu.Lock()
+	items, size, maxSize := len(c.items), c.size, c.maxSize
+	c.mu.Unlock()
+
+	return CacheStats{
+		Items:     items,
+		Size:      size,
+		MaxSize:   maxSize,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+		Coalesced: c.coalesced.Load(),
+	}
+}
+
+// cachedFile is an io.ReaderAt over an open object that serves reads from
+// VideoCache blocks, then from DiskCache blocks when configured, filling both
+// from storage on a miss.
+type cachedFile struct {
+	file io.ReaderAt
+	path string
+	etag string
+	size int64
+}
+
+func newCachedFile(obj Object) *cachedFile {
+	info := obj.Info()
+	return &cachedFile{
+		file: obj,
+		path: info.Name,
+		etag: info.ETag,
+		size: info.Size,
+	}
+}
+
+func (f *cachedFile) ReadAt(p []byte, off int64) (int, error) {
+	if !currentConfig().CacheEnabled || videoCache == nil {
+		return f.file.ReadAt(p, off)
+	}
+	if off >= f.size {
+		return 0, io.EOF
+	}
+
+	n := 0
+	for n < len(p) && off < f.size {
+		blockOffset := off - off%cacheBlockSize
+		block, err := f.block(blockOffset)
+		if err != nil {
+			return n, err
+		}
+
+		copied := copy(p[n:], block[off-blockOffset:])
+		n += copied
+		off += int64(copied)
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns the block starting at offset. On a miss it is read from the
+// disk tier or storage once, however many requests want it at the same time.
+func (f *cachedFile) block(offset int64) ([]byte, error) {
+	key := cacheKey{path: f.path, etag: f.etag, offset: offset}
+	if data, ok := videoCache.Get(key); ok {
+		return data, nil
+	}
+
+	data, shared, err := videoCache.Fill(key, func() ([]byte, error) { return f.load(key) })
+	if err != nil && shared && (errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		// The request that did the read went away; read for ourselves
+		data, _, err = videoCache.Fill(key, func() ([]byte, error) { return f.load(key) })
+	}
+	return data, err
+}
+
+// load reads one block from the disk tier or storage
+func (f *cachedFile) load(key cacheKey) ([]byte, error) {
+	if diskCache != nil {
+		if data, ok := diskCache.Get(key); ok {
+			return data, nil
+		}
+	}
+
+	length := cacheBlockSize
+	if key.offset+length > f.size {
+		length = f.size - key.offset
+	}
+
+	data := make([]byte, length)
+	n, err := f.file.ReadAt(data, key.offset)
+	if err != nil && !(err == io.EOF && int64(n) == length) {
+		return nil, err
+	}
+
+	if diskCache != nil {
+		diskCache.Put(key, data)
+	}
+	return data, nil
+}
+
+// cacheFileInfo summarizes the cached part of one file version in one tier
+type cacheFileInfo struct {
+	Name       string     `json:"name"`
+	ETag       string     `json:"etag"`
+	Blocks     int        `json:"blocks,omitempty"`
+	Bytes      int64      `json:"bytes"`
+	Hits       int64      `json:"hits,omitempty"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+}
+
+// fileKey identifies one version of a file across its blocks
+type fileKey struct {
+	path string
+	etag string
+}
+
+// sortCacheFiles orders a listing largest first
+func sortCacheFiles(files []cacheFileInfo) {
+	sort.Slice(files, func(i, j int) bool {
+		if files[i].Bytes != files[j].Bytes {
+			return files[i].Bytes > files[j].Bytes
+		}
+		return files[i].Name < files[j].Name
+	})
+}
+
+// Contains reports whether a block is cached without counting a hit or
+// touching its LRU position
+func (c *VideoCache) Contains(key cacheKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+// Files lists the cached blocks grouped by file version, for files whose
+// name satisfies match
+func (c *VideoCache) Files(match func(name string) bool) []cacheFileInfo {
+	c.mu.Lock()
+	byFile := make(map[fileKey]*cacheFileInfo)
+	for key, item := range c.items {
+		if !match(key.path) {
+			continue
+		}
+		fk := fileKey{key.path, key.etag}
+		f, ok := byFile[fk]
+		if !ok {
+			f = &cacheFileInfo{Name: key.path, ETag: key.etag}
+			byFile[fk] = f
+		}
+		f.Blocks++
+		f.Bytes += item.size
+		f.Hits += item.hitCount
+		if f.LastAccess == nil || item.accessTime.After(*f.LastAccess) {
+			at := item.accessTime.UTC()
+			f.LastAccess = &at
+		}
+	}
+	c.mu.Unlock()
+
+	files := make([]cacheFileInfo, 0, len(byFile))
+	for _, f := range byFile {
+		files = append(files, *f)
+	}
+	sortCacheFiles(files)
+	return files
+}
+
+// Purge drops every block of files whose name satisfies match. Reads in
+// flight may still store their block afterwards.
+func (c *VideoCache) Purge(match func(name string) bool) (blocks int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, item := range c.items {
+		if match(key.path) {
+			blocks++
+			bytes += item.size
+			c.removeItem(item)
+		}
+	}
+	return blocks, bytes
+}
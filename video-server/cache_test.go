@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestVideoCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newVideoCache(300)
+	block := func(name string) cacheKey { return cacheKey{path: name, etag: `"v1"`} }
+	for _, name := range []string{"a", "b", "c"} {
+		c.Put(block(name), make([]byte, 100))
+	}
+	c.Get(block("a")) // b is now the least recently used
+	c.Put(block("d"), make([]byte, 100))
+
+	for name, want := range map[string]bool{"a": true, "b": false, "c": true, "d": true} {
+		if got := c.Contains(block(name)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", name, got, want)
+		}
+	}
+	// Replacing a block and storing one larger than the cache evict nothing
+	c.Put(block("d"), make([]byte, 100))
+	c.Put(block("e"), make([]byte, 301))
+	if stats := c.Stats(); stats.Items != 3 || stats.Size != 300 || stats.Evictions != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// Shrinking keeps the most recently used blocks that still fit
+	c.Get(block("c"))
+	c.SetMaxSize(150)
+	if !c.Contains(block("c")) || c.Contains(block("a")) || c.Contains(block("d")) {
+		t.Error("shrink did not keep only the most recently used block")
+	}
+	if stats := c.Stats(); stats.Items != 1 || stats.Size != 100 || stats.MaxSize != 150 || stats.Evictions != 3 {
+		t.Errorf("stats after shrink = %+v", stats)
+	}
+}
+
+func TestCachedFileReadAt(t *testing.T) {
+	setupStorage(t)
+	config.CacheEnabled = true
+	diskCache = nil
+
+	data := make([]byte, 2*cacheBlockSize+1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	obj := &countingObject{Reader: bytes.NewReader(data)}
+	obj.info = ObjectInfo{Name: "/public/stream.mp4", Size: int64(len(data)), ETag: `"v1"`}
+	f := newCachedFile(obj)
+
+	// A read across a block boundary is assembled from both blocks
+	buf := make([]byte, 20)
+	off := cacheBlockSize - 10
+	if n, err := f.ReadAt(buf, off); n != len(buf) || err != nil || !bytes.Equal(buf, data[off:off+20]) {
+		t.Fatalf("ReadAt across blocks = %d, %v", n, err)
+	}
+	if stats := videoCache.Stats(); stats.Misses != 2 || stats.Hits != 0 || stats.Items != 2 {
+		t.Errorf("stats after the first read = %+v", stats)
+	}
+	if n, err := f.ReadAt(buf, off); n != len(buf) || err != nil || !bytes.Equal(buf, data[off:off+20]) {
+		t.Fatalf("cached ReadAt = %d, %v", n, err)
+	}
+	if stats := videoCache.Stats(); stats.Misses != 2 || stats.Hits != 2 || obj.reads.Load() != 2 {
+		t.Errorf("stats after the second read = %+v, %d storage reads", stats, obj.reads.Load())
+	}
+
+	// The short last block ends the file
+	tail := make([]byte, 2000)
+	off = int64(len(data)) - 1000
+	if n, err := f.ReadAt(tail, off); n != 1000 || err != io.EOF || !bytes.Equal(tail[:n], data[off:]) {
+		t.Errorf("ReadAt past the end = %d, %v", n, err)
+	}
+	if n, err := f.ReadAt(tail, int64(len(data))); n != 0 || err != io.EOF {
+		t.Errorf("ReadAt at the end = %d, %v", n, err)
+	}
+	if stats := videoCache.Stats(); stats.Size != cacheBlockSize*2+1000 {
+		t.Errorf("cached %d bytes, want every block", stats.Size)
+	}
+}
+
+// gatedObject holds every storage read until gate is closed
+type gatedObject struct {
+	countingObject
+	gate chan struct{}
+}
+
+func (o *gatedObject) ReadAt(p []byte, off int64) (int, error) {
+	<-o.gate
+	return o.countingObject.ReadAt(p, off)
+}
+
+// waitCoalesced waits until n cache misses are waiting on another read
+func waitCoalesced(t *testing.T, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for videoCache.Stats().Coalesced < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("coalesced = %d, want %d", videoCache.Stats().Coalesced, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestVideoCacheCoalescesFills(t *testing.T) {
+	setupStorage(t)
+	config.CacheEnabled = true
+
+	data := bytes.Repeat([]byte("segment "), 1000)
+	obj := &gatedObject{gate: make(chan struct{})}
+	obj.Reader = bytes.NewReader(data)
+	obj.info = ObjectInfo{Name: "/hls/seg_00001.ts", Size: int64(len(data)), ETag: `"v1"`}
+
+	const clients = 20
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, len(data))
+			if n, err := newCachedFile(obj).ReadAt(buf, 0); err != nil || !bytes.Equal(buf[:n], data) {
+				t.Errorf("ReadAt = %d, %v", n, err)
+			}
+		}()
+	}
+	waitCoalesced(t, clients-1)
+	close(obj.gate)
+	wg.Wait()
+
+	if n := obj.reads.Load(); n != 1 {
+		t.Errorf("storage reads = %d, want 1", n)
+	}
+	if stats := videoCache.Stats(); stats.Items != 1 || stats.Coalesced != clients-1 {
+		t.Errorf("cache stats = %+v", stats)
+	}
+}
+
+func TestVideoCacheFillRetriesAfterCanceledRead(t *testing.T) {
+	setupStorage(t)
+	config.CacheEnabled = true
+
+	data := []byte("segment")
+	obj := &countingObject{Reader: bytes.NewReader(data)}
+	obj.info = ObjectInfo{Name: "/hls/seg_00002.ts", Size: int64(len(data)), ETag: `"v1"`}
+	key := cacheKey{path: obj.info.Name, etag: obj.info.ETag}
+
+	// The first reader's client disconnects while others wait on its read
+	gate := make(chan struct{})
+	go videoCache.Fill(key, func() ([]byte, error) {
+		<-gate
+		return nil, context.Canceled
+	})
+	for started := false; !started; {
+		videoCache.mu.Lock()
+		_, started = videoCache.fills[key]
+		videoCache.mu.Unlock()
+	}
+	done := make(chan []byte)
+	go func() {
+		buf := make([]byte, len(data))
+		n, _ := newCachedFile(obj).ReadAt(buf, 0)
+		done <- buf[:n]
+	}()
+	waitCoalesced(t, 1)
+	close(gate)
+
+	if got := <-done; !bytes.Equal(got, data) {
+		t.Errorf("waiter read %q after the shared read was canceled, want %q", got, data)
+	}
+	if n := obj.reads.Load(); n != 1 {
+		t.Errorf("storage reads = %d, want the waiter's own read", n)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Build a strong ETag from size, mtime and inode. Re-encoding a file in place
+// or replacing it via rename changes at least one of these.
+func fileETag(stat os.FileInfo) string {
+	return fmt.Sprintf(`"%x-%x-%x"`, stat.Size(), stat.ModTime().UnixNano(), fileInode(stat))
+}
+
+// Set validator headers for a file and answer 304 if the client's cached copy
+// is still current. Returns true when the response has been written.
+func checkNotModified(w http.ResponseWriter, r *http.Request, etag string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+
+	if r.Method != "GET" && r.Method != "HEAD" {
+		return false
+	}
+
+	notModified := false
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		// If-Modified-Since is ignored when If-None-Match is present
+		notModified = etagListMatches(inm, etag, false)
+	} else if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		if t, err := http.ParseTime(ims); err == nil {
+			notModified = !modTime.Truncate(time.Second).After(t)
+		}
+	}
+
+	if !notModified {
+		return false
+	}
+
+	h := w.Header()
+	h.Del("Content-Type")
+	h.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// Report whether a Range header should be honoured given If-Range. A
+// mismatched validator means the client holds a different version of the
+// file, so the full representation must be sent instead of a partial one.
+func ifRangeMatches(r *http.Request, etag string, modTime time.Time) bool {
+	ir := strings.TrimSpace(r.Header.Get("If-Range"))
+	if ir == "" {
+		return true
+	}
+
+	if strings.HasPrefix(ir, `"`) || strings.HasPrefix(ir, "W/") {
+		// If-Range requires a strong comparison, so weak tags never match
+		return etagListMatches(ir, etag, true)
+	}
+
+	t, err := http.ParseTime(ir)
+	if err != nil {
+		return false
+	}
+	return modTime.Truncate(time.Second).Equal(t)
+}
+
+// Compare etag against a comma-separated list of entity tags. Weak comparison
+// ignores the W/ prefix; strong comparison rejects weak tags outright.
+func etagListMatches(list, etag string, strong bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" && !strong {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
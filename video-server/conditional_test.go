@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestConditionalRequests(t *testing.T) {
+	setupStorage(t)
+	router := newRouter()
+	get := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/stream/"+testUUID, nil)
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// stream.mp4 holds the 5 bytes "video"
+	first := get(nil)
+	etag, lastModified := first.Header().Get("ETag"), first.Header().Get("Last-Modified")
+	if first.Code != http.StatusOK || etag == "" || lastModified == "" {
+		t.Fatalf("status %d, ETag %q, Last-Modified %q", first.Code, etag, lastModified)
+	}
+	modTime, _ := http.ParseTime(lastModified)
+	earlier := modTime.Add(-time.Hour).Format(http.TimeFormat)
+
+	tests := []struct {
+		name       string
+		header     http.Header
+		wantStatus int
+		wantBody   string
+	}{
+		{"matching If-None-Match", http.Header{"If-None-Match": {etag}}, 304, ""},
+		{"If-None-Match list", http.Header{"If-None-Match": {`"other", ` + etag}}, 304, ""},
+		{"weak If-None-Match", http.Header{"If-None-Match": {"W/" + etag}}, 304, ""},
+		{"If-None-Match any", http.Header{"If-None-Match": {"*"}}, 304, ""},
+		{"stale If-None-Match", http.Header{"If-None-Match": {`"other"`}}, 200, "video"},
+		{"current If-Modified-Since", http.Header{"If-Modified-Since": {lastModified}}, 304, ""},
+		{"older If-Modified-Since", http.Header{"If-Modified-Since": {earlier}}, 200, "video"},
+		{"If-None-Match overrides If-Modified-Since",
+			http.Header{"If-None-Match": {`"other"`}, "If-Modified-Since": {lastModified}}, 200, "video"},
+
+		{"If-Range with the current ETag", http.Header{"Range": {"bytes=1-2"}, "If-Range": {etag}}, 206, "id"},
+		{"If-Range with the current date", http.Header{"Range": {"bytes=1-2"}, "If-Range": {lastModified}}, 206, "id"},
+		{"weak If-Range", http.Header{"Range": {"bytes=1-2"}, "If-Range": {"W/" + etag}}, 200, "video"},
+		{"mismatched If-Range", http.Header{"Range": {"bytes=1-2"}, "If-Range": {`"other"`}}, 200, "video"},
+		{"older If-Range date", http.Header{"Range": {"bytes=1-2"}, "If-Range": {earlier}}, 200, "video"},
+		{"malformed If-Range", http.Header{"Range": {"bytes=1-2"}, "If-Range": {"yesterday"}}, 200, "video"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(tt.header)
+			if rec.Code != tt.wantStatus || rec.Body.String() != tt.wantBody {
+				t.Errorf("status %d, body %q; want %d, %q", rec.Code, rec.Body.String(), tt.wantStatus, tt.wantBody)
+			}
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("ETag = %q, want %q", got, etag)
+			}
+			if rec.Code == http.StatusNotModified && rec.Header().Get("Content-Length") != "" {
+				t.Error("304 carries a Content-Length")
+			}
+		})
+	}
+}
@@ -0,0 +1,491 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Configuration is layered: built-in defaults, then the optional JSON config
+// file, then environment variables, then command line flags. SIGHUP reloads
+// the layers and applies the fields that are safe to change on a running
+// server; streams in flight keep going.
+
+const insecureDefaultSecret = "playtube-video-secret-key-change-in-production"
+
+// setting is one option, named by its flag and config file key
+type setting struct {
+	name  string
+	env   string
+	def   string
+	usage string
+	apply func(c *Config, value string) error
+}
+
+var settings = []setting{
+	{"port", "VIDEO_SERVER_PORT", "8090", "Server port", intSetting(func(c *Config) *int { return &c.Port })},
+	{"tls-cert", "VIDEO_TLS_CERT", "", "PEM certificate chain to serve HTTPS with (empty serves plain HTTP)", stringSetting(func(c *Config) *string { return &c.TLSCert })},
+	{"tls-key", "VIDEO_TLS_KEY", "", "PEM private key of tls-cert", stringSetting(func(c *Config) *string { return &c.TLSKey })},
+	{"http2", "VIDEO_HTTP2", "true", "Offer HTTP/2 over TLS", boolSetting(func(c *Config) *bool { return &c.HTTP2 })},
+	{"http2-max-streams", "VIDEO_HTTP2_MAX_STREAMS", "250", "Concurrent requests per HTTP/2 connection", intSetting(func(c *Config) *int { return &c.HTTP2MaxStreams })},
+	{"video-path", "VIDEO_BASE_PATH", "/workspaces/playtube/storage/app/private/videos", "Base path for videos", stringSetting(func(c *Config) *string { return &c.VideoBasePath })},
+	{"public-path", "PUBLIC_BASE_PATH", "/workspaces/playtube/storage/app/public/videos", "Base path for public files (thumbnails)", stringSetting(func(c *Config) *string { return &c.PublicBasePath })},
+	{"hls-path", "HLS_BASE_PATH", "/workspaces/playtube/storage/app/private/hls", "Base path for HLS files", stringSetting(func(c *Config) *string { return &c.HLSBasePath })},
+	{"storage", "VIDEO_STORAGE_DRIVER", "local", "Storage driver: local, s3 (paths are key prefixes) or origin (pull-through from origin-url)", stringSetting(func(c *Config) *string { return &c.StorageDriver })},
+	{"s3-endpoint", "AWS_ENDPOINT", "", "S3-compatible endpoint URL (default AWS for the region)", stringSetting(func(c *Config) *string { return &c.S3Endpoint })},
+	{"s3-region", "AWS_DEFAULT_REGION", "us-east-1", "S3 region", stringSetting(func(c *Config) *string { return &c.S3Region })},
+	{"s3-bucket", "AWS_BUCKET", "", "S3 bucket", stringSetting(func(c *Config) *string { return &c.S3Bucket })},
+	{"s3-access-key", "AWS_ACCESS_KEY_ID", "", "S3 access key id (empty for anonymous access)", stringSetting(func(c *Config) *string { return &c.S3AccessKey })},
+	{"s3-secret-key", "AWS_SECRET_ACCESS_KEY", "", "S3 secret access key", stringSetting(func(c *Config) *string { return &c.S3SecretKey })},
+	{"s3-session-token", "AWS_SESSION_TOKEN", "", "S3 session token for temporary credentials", stringSetting(func(c *Config) *string { return &c.S3SessionToken })},
+	{"s3-path-style", "AWS_USE_PATH_STYLE_ENDPOINT", "false", "Address buckets as endpoint/bucket instead of bucket.endpoint", boolSetting(func(c *Config) *bool { return &c.S3PathStyle })},
+	{"origin-url", "VIDEO_ORIGIN_URL", "", "Upstream video server for the origin storage driver", stringSetting(func(c *Config) *string { return &c.OriginURL })},
+	{"origin-revalidate", "VIDEO_ORIGIN_REVALIDATE", "60s", "How long upstream metadata, including misses, is trusted", durationSetting(func(c *Config) *time.Duration { return &c.OriginRevalidate })},
+	{"shield-cache-path", "VIDEO_SHIELD_CACHE_PATH", "/var/cache/playtube/shield", "Directory for objects pulled from the origin", stringSetting(func(c *Config) *string { return &c.ShieldCachePath })},
+	{"shield-cache-size", "VIDEO_SHIELD_CACHE_SIZE", "10737418240", "Max bytes of origin objects kept on disk (default 10GB)", int64Setting(func(c *Config) *int64 { return &c.ShieldCacheSize })},
+	{"secret", "VIDEO_SECRET_KEY", insecureDefaultSecret, "Secret key for signed URLs", stringSetting(func(c *Config) *string { return &c.SignedURLKey })},
+	{"secret-keys", "VIDEO_SECRET_KEYS", "", "Signing keyring as kid:secret pairs, current key first", stringSetting(func(c *Config) *string { return &c.SecretKeys })},
+	{"admin-token", "VIDEO_ADMIN_TOKEN", "", "Static bearer token for the admin endpoints, accepted besides v2 tokens (empty disables it)", stringSetting(func(c *Config) *string { return &c.AdminToken })},
+	{"metrics-token", "VIDEO_METRICS_TOKEN", "", "Static bearer token for /metrics, accepted besides admin credentials (empty disables it)", stringSetting(func(c *Config) *string { return &c.MetricsToken })},
+	{"legacy-signatures", "VIDEO_ACCEPT_LEGACY_SIGNATURES", "true", "Accept legacy uuid:expires signatures", boolSetting(func(c *Config) *bool { return &c.AcceptLegacySignatures })},
+	{"session-cookie", "VIDEO_SESSION_COOKIE", "playtube_vsid", "Cookie holding the viewer session id for session-bound tokens", stringSetting(func(c *Config) *string { return &c.SessionCookie })},
+	{"trusted-proxies", "TRUSTED_PROXIES", "", "Comma-separated proxy IPs/CIDRs whose X-Forwarded-For is trusted", stringSetting(func(c *Config) *string { return &c.TrustedProxySpec })},
+	{"hls-token-ttl", "VIDEO_HLS_TOKEN_TTL", "10m", "Lifetime of tokens derived for HLS child playlists and segments", durationSetting(func(c *Config) *time.Duration { return &c.HLSTokenTTL })},
+	{"allowed-origins", "ALLOWED_ORIGINS", "", "Comma-separated CORS origins, wildcards or regex: patterns (default depends on APP_ENV)", listSetting(func(c *Config) *[]string { return &c.AllowedOrigins })},
+	{"cache-size", "VIDEO_CACHE_SIZE", "1073741824", "Max cache size in bytes (default 1GB)", int64Setting(func(c *Config) *int64 { return &c.MaxCacheSize })},
+	{"disk-cache-path", "VIDEO_DISK_CACHE_PATH", "", "Directory for the on-disk block cache below the memory cache (empty disables it)", stringSetting(func(c *Config) *string { return &c.DiskCachePath })},
+	{"disk-cache-size", "VIDEO_DISK_CACHE_SIZE", "10737418240", "Max disk cache size in bytes (default 10GB)", int64Setting(func(c *Config) *int64 { return &c.DiskCacheSize })},
+	{"lookup-cache-size", "VIDEO_LOOKUP_CACHE_SIZE", "10000", "Max remembered video file lookups", intSetting(func(c *Config) *int { return &c.LookupCacheSize })},
+	{"lookup-ttl", "VIDEO_LOOKUP_TTL", "30s", "How long a found video file is remembered (0 disables the lookup cache)", durationSetting(func(c *Config) *time.Duration { return &c.LookupTTL })},
+	{"lookup-negative-ttl", "VIDEO_LOOKUP_NEGATIVE_TTL", "5s", "How long a missing video file is remembered", durationSetting(func(c *Config) *time.Duration { return &c.LookupNegativeTTL })},
+	{"watch", "VIDEO_WATCH", "auto", "Drop cached data of files changed under local storage roots: auto (inotify, polling when watches run out), poll or off", stringSetting(func(c *Config) *string { return &c.WatchMode })},
+	{"watch-poll-interval", "VIDEO_WATCH_POLL_INTERVAL", "10s", "How often storage roots are scanned when polling for changes", durationSetting(func(c *Config) *time.Duration { return &c.WatchPollInterval })},
+	{"prewarm-concurrency", "VIDEO_PREWARM_CONCURRENCY", "4", "Files read in parallel by each cache prewarm job", intSetting(func(c *Config) *int { return &c.PrewarmConcurrency })},
+	{"rate-limits", "VIDEO_RATE_LIMITS", "", "Request limits per client IP or token subject as group=rate:burst, rate per second; groups: progressive, hls, thumb, admin", listSetting(func(c *Config) *[]string { return &c.RateLimitSpec })},
+	{"stream-limits", "VIDEO_STREAM_LIMITS", "", "Requests in flight per client as group=N", listSetting(func(c *Config) *[]string { return &c.StreamLimitSpec })},
+	{"max-streams", "VIDEO_MAX_STREAMS", "10000", "Global cap on media requests in flight (0 = unlimited)", intSetting(func(c *Config) *int { return &c.MaxStreams })},
+	{"pace", "VIDEO_PACE", "", "Pace progressive streams at a multiple of their bitrate, as a multiple for every quality and/or quality=multiple entries (empty disables pacing)", listSetting(func(c *Config) *[]string { return &c.PaceSpec })},
+	{"pace-burst", "VIDEO_PACE_BURST", "10s", "Media duration sent at full speed before a paced stream is throttled", durationSetting(func(c *Config) *time.Duration { return &c.PaceBurst })},
+	{"max-bandwidth", "VIDEO_MAX_BANDWIDTH", "0", "Cap in bytes per second on each progressive response (0 = unlimited)", int64Setting(func(c *Config) *int64 { return &c.MaxBandwidth })},
+	{"write-idle-timeout", "VIDEO_WRITE_IDLE_TIMEOUT", "60s", "Abort a media response when the client accepts no data for this long (0 disables)", durationSetting(func(c *Config) *time.Duration { return &c.WriteIdleTimeout })},
+	{"sendfile", "VIDEO_SENDFILE", "false", "Send ranges of local files with sendfile unless the memory cache holds them; such ranges skip the cache", boolSetting(func(c *Config) *bool { return &c.Sendfile })},
+	{"chunk-size", "VIDEO_CHUNK_SIZE", "2097152", "Chunk size for streaming (default 2MB)", int64Setting(func(c *Config) *int64 { return &c.ChunkSize })},
+	{"max-ranges", "VIDEO_MAX_RANGES", "16", "Max ranges per multi-range request", intSetting(func(c *Config) *int { return &c.MaxRanges })},
+	{"cache", "VIDEO_CACHE_ENABLED", "true", "Enable caching", boolSetting(func(c *Config) *bool { return &c.CacheEnabled })},
+	{"log-level", "LOG_LEVEL", "info", "Log level: debug, info, warn or error", stringSetting(func(c *Config) *string { return &c.LogLevel })},
+	{"log-format", "LOG_FORMAT", "json", "Log format: json or text", stringSetting(func(c *Config) *string { return &c.LogFormat })},
+}
+
+func stringSetting(field func(*Config) *string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		*field(c) = v
+		return nil
+	}
+}
+
+func intSetting(field func(*Config) *int) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		i, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		*field(c) = i
+		return nil
+	}
+}
+
+func int64Setting(field func(*Config) *int64) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		i, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", v)
+		}
+		*field(c) = i
+		return nil
+	}
+}
+
+func boolSetting(field func(*Config) *bool) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", v)
+		}
+		*field(c) = b
+		return nil
+	}
+}
+
+// Durations accept Go syntax ("90s", "10m") or plain seconds
+func durationSetting(field func(*Config) *time.Duration) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		if secs, err := strconv.ParseFloat(v, 64); err == nil {
+			*field(c) = time.Duration(secs * float64(time.Second))
+			return nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", v)
+		}
+		*field(c) = d
+		return nil
+	}
+}
+
+// Lists are comma-separated; entries are trimmed and empty entries dropped
+func listSetting(field func(*Config) *[]string) func(*Config, string) error {
+	return func(c *Config, v string) error {
+		var list []string
+		for _, entry := range strings.Split(v, ",") {
+			if entry = strings.TrimSpace(entry); entry != "" {
+				list = append(list, entry)
+			}
+		}
+		*field(c) = list
+		return nil
+	}
+}
+
+// settingFlag holds the raw value of a setting given on the command line
+type settingFlag struct {
+	value  string
+	isBool bool
+}
+
+func (f *settingFlag) String() string     { return f.value }
+func (f *settingFlag) Set(v string) error { f.value = v; return nil }
+func (f *settingFlag) IsBoolFlag() bool   { return f.isBool }
+
+// Load configuration from the config file, environment and command line args
+func loadConfig(args []string) (*Config, error) {
+	fs := flag.NewFlagSet("video-server", flag.ContinueOnError)
+	configFile := fs.String("config", os.Getenv("VIDEO_CONFIG_FILE"), "Path to a JSON config file")
+	flags := make(map[string]*settingFlag)
+	for _, s := range settings {
+		f := &settingFlag{value: s.def, isBool: s.def == "true" || s.def == "false"}
+		flags[s.name] = f
+		fs.Var(f, s.name, s.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, s := range settings {
+		values[s.name] = s.def
+	}
+	values["allowed-origins"] = defaultAllowedOrigins()
+
+	if *configFile != "" {
+		fileValues, err := readConfigFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, v := range fileValues {
+			values[name] = v
+		}
+	}
+	for _, s := range settings {
+		if v := os.Getenv(s.env); v != "" {
+			values[s.name] = v
+		}
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if sf, ok := flags[f.Name]; ok {
+			values[f.Name] = sf.value
+		}
+	})
+
+	c := &Config{ConfigFile: *configFile, CacheDuration: time.Hour}
+	var errs []error
+	for _, s := range settings {
+		if err := s.apply(c, values[s.name]); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	if err := finalizeConfig(c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func findSetting(name string) (setting, bool) {
+	for _, s := range settings {
+		if s.name == name {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// Read a JSON config file into setting values. Keys are flag names, with
+// underscores accepted in place of dashes; unknown keys are an error. YAML and
+// TOML are not read, and other extensions are refused rather than guessed at.
+func readConfigFile(path string) (map[string]string, error) {
+	if ext := strings.ToLower(filepath.Ext(path)); ext != ".json" {
+		return nil, fmt.Errorf("config file %s: only JSON (.json) config files are supported, not YAML or TOML", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("config file: %w", err)
+	}
+	var raw map[string]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+
+	values := make(map[string]string)
+	var errs []error
+	for key, v := range raw {
+		name := strings.ReplaceAll(key, "_", "-")
+		if _, ok := findSetting(name); !ok {
+			errs = append(errs, fmt.Errorf("config file %s: unknown setting %q", path, key))
+			continue
+		}
+		s, err := configValueString(v)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("config file %s: %s: %w", path, key, err))
+			continue
+		}
+		values[name] = s
+	}
+	return values, errors.Join(errs...)
+}
+
+func configValueString(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []interface{}:
+		parts := make([]string, 0, len(v))
+		for _, item := range v {
+			s, ok := item.(string)
+			if !ok {
+				return "", errors.New("list entries must be strings")
+			}
+			parts = append(parts, s)
+		}
+		return strings.Join(parts, ","), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// Build the derived fields and validate the result, reporting every problem
+func finalizeConfig(c *Config) error {
+	var errs []error
+
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port: %d out of range", c.Port))
+	}
+	switch c.StorageDriver {
+	case "local":
+		for _, p := range []struct{ name, path string }{
+			{"video-path", c.VideoBasePath},
+			{"public-path", c.PublicBasePath},
+			{"hls-path", c.HLSBasePath},
+		} {
+			if stat, err := os.Stat(p.path); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", p.name, err))
+			} else if !stat.IsDir() {
+				errs = append(errs, fmt.Errorf("%s: %s is not a directory", p.name, p.path))
+			}
+		}
+	case "s3":
+		if c.S3Bucket == "" {
+			errs = append(errs, errors.New("s3-bucket: required by the s3 storage driver"))
+		}
+		if (c.S3AccessKey == "") != (c.S3SecretKey == "") {
+			errs = append(errs, errors.New("s3-access-key: access key and secret key must be set together"))
+		}
+		if _, err := newS3Client(c); err != nil {
+			errs = append(errs, fmt.Errorf("s3-endpoint: %w", err))
+		}
+	case "origin":
+		if _, err := newOriginClient(c.OriginURL); err != nil {
+			errs = append(errs, fmt.Errorf("origin-url: %w", err))
+		}
+		if c.ShieldCacheSize <= 0 {
+			errs = append(errs, fmt.Errorf("shield-cache-size: must be positive, got %d", c.ShieldCacheSize))
+		}
+		if c.OriginRevalidate < 0 {
+			errs = append(errs, fmt.Errorf("origin-revalidate: must not be negative, got %s", c.OriginRevalidate))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("storage: unknown driver %q", c.StorageDriver))
+	}
+	if c.ChunkSize <= 0 {
+		errs = append(errs, fmt.Errorf("chunk-size: must be positive, got %d", c.ChunkSize))
+	}
+	if c.CacheEnabled && c.MaxCacheSize <= 0 {
+		errs = append(errs, fmt.Errorf("cache-size: must be positive when caching is enabled, got %d", c.MaxCacheSize))
+	}
+	if c.DiskCachePath != "" && c.DiskCacheSize <= 0 {
+		errs = append(errs, fmt.Errorf("disk-cache-size: must be positive when the disk cache is enabled, got %d", c.DiskCacheSize))
+	}
+	if c.LookupCacheSize < 1 {
+		errs = append(errs, fmt.Errorf("lookup-cache-size: must be at least 1, got %d", c.LookupCacheSize))
+	}
+	if c.LookupTTL < 0 {
+		errs = append(errs, fmt.Errorf("lookup-ttl: must not be negative, got %s", c.LookupTTL))
+	}
+	if c.LookupNegativeTTL < 0 {
+		errs = append(errs, fmt.Errorf("lookup-negative-ttl: must not be negative, got %s", c.LookupNegativeTTL))
+	}
+	switch c.WatchMode {
+	case "auto", "poll", "off":
+	default:
+		errs = append(errs, fmt.Errorf("watch: unknown mode %q", c.WatchMode))
+	}
+	if c.WatchPollInterval <= 0 {
+		errs = append(errs, fmt.Errorf("watch-poll-interval: must be positive, got %s", c.WatchPollInterval))
+	}
+	if c.PrewarmConcurrency < 1 {
+		errs = append(errs, fmt.Errorf("prewarm-concurrency: must be at least 1, got %d", c.PrewarmConcurrency))
+	}
+	if c.MaxStreams < 0 {
+		errs = append(errs, fmt.Errorf("max-streams: must not be negative, got %d", c.MaxStreams))
+	}
+	if c.PaceBurst < 0 {
+		errs = append(errs, fmt.Errorf("pace-burst: must not be negative, got %s", c.PaceBurst))
+	}
+	if c.MaxBandwidth < 0 {
+		errs = append(errs, fmt.Errorf("max-bandwidth: must not be negative, got %d", c.MaxBandwidth))
+	}
+	if c.WriteIdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("write-idle-timeout: must not be negative, got %s", c.WriteIdleTimeout))
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, errors.New("tls-cert and tls-key must be set together"))
+	}
+	if c.HTTP2MaxStreams < 1 {
+		errs = append(errs, fmt.Errorf("http2-max-streams: must be at least 1, got %d", c.HTTP2MaxStreams))
+	}
+	if c.MaxRanges < 1 {
+		errs = append(errs, fmt.Errorf("max-ranges: must be at least 1, got %d", c.MaxRanges))
+	}
+	if c.HLSTokenTTL <= 0 {
+		errs = append(errs, fmt.Errorf("hls-token-ttl: must be positive, got %s", c.HLSTokenTTL))
+	}
+	if c.AdminToken != "" && len(c.AdminToken) < minAdminTokenLength {
+		errs = append(errs, fmt.Errorf("admin-token: must be at least %d characters", minAdminTokenLength))
+	}
+	if c.MetricsToken != "" && len(c.MetricsToken) < minAdminTokenLength {
+		errs = append(errs, fmt.Errorf("metrics-token: must be at least %d characters", minAdminTokenLength))
+	}
+	if c.SessionCookie == "" {
+		errs = append(errs, errors.New("session-cookie: must not be empty"))
+	}
+	if _, err := parseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("log-level: %w", err))
+	}
+	if _, err := newLogger(os.Stdout, slog.LevelInfo, c.LogFormat); err != nil {
+		errs = append(errs, fmt.Errorf("log-format: %w", err))
+	}
+
+	if getEnv("APP_ENV", "local") == "production" {
+		if c.SignedURLKey == "" || c.SignedURLKey == insecureDefaultSecret {
+			errs = append(errs, errors.New("secret: the built-in default secret cannot be used in production"))
+		}
+	}
+
+	var err error
+	if c.SigningKeys, err = parseKeyring(c.SecretKeys, c.SignedURLKey); err != nil {
+		errs = append(errs, fmt.Errorf("secret-keys: %w", err))
+	}
+	if c.TrustedProxies, err = parseNetworks(c.TrustedProxySpec); err != nil {
+		errs = append(errs, fmt.Errorf("trusted-proxies: %w", err))
+	}
+	if c.Limits, err = parseRouteLimits(c.RateLimitSpec, c.StreamLimitSpec); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Pacing, err = parsePacePolicy(c.PaceSpec); err != nil {
+		errs = append(errs, err)
+	}
+	if c.CORS, err = newCORSPolicy(c.AllowedOrigins); err != nil {
+		errs = append(errs, fmt.Errorf("allowed-origins: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// liveConfig holds the configuration installed by the last reload. Request
+// paths read reloadable settings through currentConfig; settings that need a
+// restart are read from config directly.
+var liveConfig atomic.Pointer[Config]
+
+func currentConfig() *Config {
+	if c := liveConfig.Load(); c != nil {
+		return c
+	}
+	return &config
+}
+
+// Reload configuration from the same args, applying the fields that are safe
+// to change at runtime. On error the running configuration stays in place.
+func reloadConfig(args []string) error {
+	next, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+	cur := currentConfig()
+
+	// Listener, storage and log format are fixed for the process
+	for _, f := range []struct {
+		name    string
+		changed bool
+	}{
+		{"port", next.Port != cur.Port},
+		{"tls", next.TLSCert != cur.TLSCert || next.TLSKey != cur.TLSKey ||
+			next.HTTP2 != cur.HTTP2 || next.HTTP2MaxStreams != cur.HTTP2MaxStreams},
+		{"video-path", next.VideoBasePath != cur.VideoBasePath},
+		{"public-path", next.PublicBasePath != cur.PublicBasePath},
+		{"hls-path", next.HLSBasePath != cur.HLSBasePath},
+		{"storage", next.StorageDriver != cur.StorageDriver || next.S3Endpoint != cur.S3Endpoint ||
+			next.S3Region != cur.S3Region || next.S3Bucket != cur.S3Bucket || next.S3AccessKey != cur.S3AccessKey ||
+			next.S3SecretKey != cur.S3SecretKey || next.S3SessionToken != cur.S3SessionToken || next.S3PathStyle != cur.S3PathStyle ||
+			next.OriginURL != cur.OriginURL || next.OriginRevalidate != cur.OriginRevalidate ||
+			next.ShieldCachePath != cur.ShieldCachePath || next.ShieldCacheSize != cur.ShieldCacheSize},
+		{"disk-cache-path", next.DiskCachePath != cur.DiskCachePath},
+		{"watch", next.WatchMode != cur.WatchMode},
+		{"log-format", next.LogFormat != cur.LogFormat},
+	} {
+		if f.changed {
+			logger.Warn("setting changed but requires a restart", "setting", f.name)
+		}
+	}
+	next.TLSCert, next.TLSKey, next.HTTP2, next.HTTP2MaxStreams = cur.TLSCert, cur.TLSKey, cur.HTTP2, cur.HTTP2MaxStreams
+	next.Port, next.VideoBasePath, next.PublicBasePath, next.HLSBasePath = cur.Port, cur.VideoBasePath, cur.PublicBasePath, cur.HLSBasePath
+	next.StorageDriver, next.S3Endpoint, next.S3Region, next.S3Bucket = cur.StorageDriver, cur.S3Endpoint, cur.S3Region, cur.S3Bucket
+	next.S3AccessKey, next.S3SecretKey, next.S3SessionToken, next.S3PathStyle = cur.S3AccessKey, cur.S3SecretKey, cur.S3SessionToken, cur.S3PathStyle
+	next.OriginURL, next.OriginRevalidate, next.ShieldCachePath, next.ShieldCacheSize = cur.OriginURL, cur.OriginRevalidate, cur.ShieldCachePath, cur.ShieldCacheSize
+	next.VideoStore, next.PublicStore, next.HLSStore = cur.VideoStore, cur.PublicStore, cur.HLSStore
+	next.DiskCachePath = cur.DiskCachePath
+	next.WatchMode = cur.WatchMode
+	next.LogFormat = cur.LogFormat
+
+	level, _ := parseLogLevel(next.LogLevel)
+	logLevel.Set(level)
+	videoCache.SetMaxSize(next.MaxCacheSize)
+	if diskCache != nil {
+		diskCache.SetMaxSize(next.DiskCacheSize)
+	}
+	videoLookups.SetMaxEntries(next.LookupCacheSize)
+	liveConfig.Store(next)
+	return nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"log/slog"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clearConfigEnv isolates a test from settings in the process environment
+func clearConfigEnv(t *testing.T) {
+	t.Helper()
+	for _, s := range settings {
+		t.Setenv(s.env, "")
+	}
+	t.Setenv("VIDEO_CONFIG_FILE", "")
+	t.Setenv("APP_ENV", "local")
+}
+
+// pathArgs points the three storage roots at existing directories
+func pathArgs(t *testing.T) []string {
+	t.Helper()
+	base := t.TempDir()
+	return []string{"-video-path", base, "-public-path", base, "-hls-path", base}
+}
+
+func writeConfigFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "video-server.json")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfigLayering(t *testing.T) {
+	clearConfigEnv(t)
+	file := writeConfigFile(t, `{
+		"port": 9000,
+		"chunk_size": 4096,
+		"max-ranges": 4,
+		"cache": false,
+		"hls-token-ttl": 120,
+		"allowed-origins": ["https://file.example", " https://*.file.example "]
+	}`)
+	t.Setenv("VIDEO_MAX_RANGES", "8")
+	t.Setenv("VIDEO_CHUNK_SIZE", "8192")
+
+	c, err := loadConfig(append(pathArgs(t), "-config", file, "-chunk-size", "16384"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port != 9000 || c.CacheEnabled || c.HLSTokenTTL != 2*time.Minute {
+		t.Errorf("file values not applied: port=%d cache=%v ttl=%s", c.Port, c.CacheEnabled, c.HLSTokenTTL)
+	}
+	if c.MaxRanges != 8 {
+		t.Errorf("MaxRanges = %d, want env value 8", c.MaxRanges)
+	}
+	if c.ChunkSize != 16384 {
+		t.Errorf("ChunkSize = %d, want flag value 16384", c.ChunkSize)
+	}
+	if strings.Join(c.AllowedOrigins, ",") != "https://file.example,https://*.file.example" {
+		t.Errorf("AllowedOrigins = %q", c.AllowedOrigins)
+	}
+	if allowed, _ := c.CORS.allows("https://eu.file.example"); !allowed {
+		t.Error("CORS policy not built from the file origins")
+	}
+	if c.MaxCacheSize != 1<<30 || c.SessionCookie != "playtube_vsid" || c.Sendfile {
+		t.Errorf("defaults not applied: cache-size=%d cookie=%q sendfile=%v", c.MaxCacheSize, c.SessionCookie, c.Sendfile)
+	}
+}
+
+func TestLoadConfigRejectsInvalidSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		args    []string
+		file    string
+		wantErr string
+	}{
+		{"missing path", nil, []string{"-hls-path", "/nonexistent/playtube/hls"}, "", "hls-path"},
+		{"zero chunk size", nil, []string{"-chunk-size", "0"}, "", "chunk-size"},
+		{"bad integer", map[string]string{"VIDEO_CACHE_SIZE": "1GB"}, nil, "", "cache-size"},
+		{"bad duration", map[string]string{"VIDEO_HLS_TOKEN_TTL": "soon"}, nil, "", "hls-token-ttl"},
+		{"bad origin", nil, []string{"-allowed-origins", "playtube.example"}, "", "allowed-origins"},
+		{"bad rate limit", map[string]string{"VIDEO_RATE_LIMITS": "video=10"}, nil, "", "rate-limits"},
+		{"bad stream limit", map[string]string{"VIDEO_STREAM_LIMITS": "hls=many"}, nil, "", "stream-limits"},
+		{"bad pace", map[string]string{"VIDEO_PACE": "1080p=fast"}, nil, "", "pace"},
+		{"negative write idle timeout", nil, []string{"-write-idle-timeout", "-5s"}, "", "write-idle-timeout"},
+		{"tls cert without key", nil, []string{"-tls-cert", "/etc/playtube/cert.pem"}, "", "tls-key"},
+		{"negative stream cap", nil, []string{"-max-streams", "-1"}, "", "max-streams"},
+		{"bad log level", nil, []string{"-log-level", "verbose"}, "", "log-level"},
+		{"default secret in production", map[string]string{"APP_ENV": "production"}, nil, "", "secret"},
+		{"unknown file key", nil, nil, `{"cache-sise": 1024}`, "unknown setting"},
+		{"malformed file", nil, nil, `{"port": `, "config file"},
+		{"yaml file", nil, []string{"-config", "/etc/playtube/video-server.yaml"}, "", "only JSON"},
+		{"toml file", nil, []string{"-config", "/etc/playtube/video-server.toml"}, "", "only JSON"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clearConfigEnv(t)
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			args := append(pathArgs(t), tt.args...)
+			if tt.file != "" {
+				args = append(args, "-config", writeConfigFile(t, tt.file))
+			}
+
+			_, err := loadConfig(args)
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("loadConfig error = %v, want one mentioning %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadConfigReportsEveryProblem(t *testing.T) {
+	clearConfigEnv(t)
+	_, err := loadConfig(append(pathArgs(t), "-chunk-size", "0", "-max-ranges", "0", "-port", "70000"))
+	if err == nil {
+		t.Fatal("invalid configuration accepted")
+	}
+	for _, want := range []string{"port", "chunk-size", "max-ranges"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not mention %s", err, want)
+		}
+	}
+}
+
+func TestLoadConfigProductionSecret(t *testing.T) {
+	clearConfigEnv(t)
+	t.Setenv("APP_ENV", "production")
+	t.Setenv("VIDEO_SECRET_KEY", "a-real-production-secret")
+
+	c, err := loadConfig(pathArgs(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.SigningKeys) != 1 || string(c.SigningKeys[0].Secret) != "a-real-production-secret" {
+		t.Errorf("SigningKeys = %v", c.SigningKeys)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	setupStorage(t)
+	clearConfigEnv(t)
+	t.Cleanup(func() {
+		liveConfig.Store(nil)
+		logLevel.Set(slog.LevelInfo)
+	})
+
+	file := writeConfigFile(t, `{"allowed-origins": "https://old.example", "secret-keys": "k1:first", "cache-size": 4096}`)
+	args := []string{"-config", file,
+		"-video-path", config.VideoBasePath, "-public-path", config.PublicBasePath, "-hls-path", config.HLSBasePath}
+	cfg, err := loadConfig(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config = *cfg
+	videoCache = newVideoCache(config.MaxCacheSize)
+	for i := 0; i < 4; i++ {
+		videoCache.Put(cacheKey{path: "video", offset: int64(i) * 1024}, make([]byte, 1024))
+	}
+	token, err := signToken(tokenClaims{Path: "/stream/" + testUUID, Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rotate keys, swap origins, shrink the cache and try to move the port
+	if err := os.WriteFile(file, []byte(`{
+		"allowed-origins": "https://new.example",
+		"secret-keys": "k2:second,k1:first",
+		"cache-size": 2048,
+		"port": 9999,
+		"log-level": "debug"
+	}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(args); err != nil {
+		t.Fatal(err)
+	}
+
+	cur := currentConfig()
+	if allowed, _ := cur.CORS.allows("https://new.example"); !allowed {
+		t.Error("new origin not allowed after reload")
+	}
+	if allowed, _ := cur.CORS.allows("https://old.example"); allowed {
+		t.Error("old origin still allowed after reload")
+	}
+	if cur.SigningKeys[0].ID != "k2" {
+		t.Errorf("current key = %s, want k2", cur.SigningKeys[0].ID)
+	}
+	if _, err := verifyToken(token, httptest.NewRequest("GET", "/stream/"+testUUID, nil)); err != nil {
+		t.Errorf("token signed before rotation rejected: %v", err)
+	}
+	if stats := videoCache.Stats(); stats.MaxSize != 2048 || stats.Size > 2048 {
+		t.Errorf("cache stats after reload = %+v", stats)
+	}
+	if cur.Port != config.Port {
+		t.Errorf("port changed on reload to %d", cur.Port)
+	}
+	if logLevel.Level() != slog.LevelDebug {
+		t.Errorf("log level = %s, want DEBUG", logLevel.Level())
+	}
+
+	// An invalid reload keeps the running configuration
+	if err := os.WriteFile(file, []byte(`{"chunk-size": 0}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(args); err == nil {
+		t.Error("invalid reload accepted")
+	}
+	if currentConfig() != cur {
+		t.Error("failed reload replaced the running configuration")
+	}
+}
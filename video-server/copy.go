@@ -0,0 +1,127 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Response bodies are copied one of two ways. With the sendfile setting on,
+// a range of a local file that the memory cache does not hold goes to the
+// connection with sendfile: the file is handed over as an io.LimitedReader,
+// which every writer on the way passes on through ReadFrom until net/http
+// reaches the TCP connection. The kernel page cache serves repeats, but these
+// ranges never enter the block cache, so sendfile is off by default.
+// Everything else, and any writer that has to see the bytes, like pacing or
+// multipart parts, is copied through a pooled buffer.
+
+// copyBuffers holds ChunkSize buffers for copies through user space
+var copyBuffers = sync.Pool{New: func() any { return new([]byte) }}
+
+// getCopyBuffer returns a pooled buffer of size bytes
+func getCopyBuffer(size int64) *[]byte {
+	buf := copyBuffers.Get().(*[]byte)
+	if int64(cap(*buf)) < size {
+		// Also covers a chunk size raised by a reload
+		*buf = make([]byte, size)
+	}
+	*buf = (*buf)[:size]
+	return buf
+}
+
+func putCopyBuffer(buf *[]byte) {
+	copyBuffers.Put(buf)
+}
+
+// Stream length bytes from offset start of src, stopping at the first read or
+// write error
+func copyRange(w io.Writer, src io.ReaderAt, start, length int64) error {
+	var n int64
+	var err error
+	if f := sendfileSource(src, start); f != nil {
+		if _, err := f.Seek(start, io.SeekStart); err != nil {
+			return err
+		}
+		// The file goes to the connection by ReadFrom; no buffer needed
+		n, err = readFrom(w, io.LimitReader(f, length))
+	} else {
+		buf := getCopyBuffer(currentConfig().ChunkSize)
+		n, err = io.CopyBuffer(w, io.NewSectionReader(src, start, length), *buf)
+		putCopyBuffer(buf)
+	}
+	if err == nil && n < length {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// sendfileSource returns the open file behind src when a range starting at
+// off should be sent from it directly
+func sendfileSource(src io.ReaderAt, off int64) *os.File {
+	cf, ok := src.(*cachedFile)
+	if !ok || !currentConfig().Sendfile {
+		return nil
+	}
+	obj, ok := cf.file.(*localObject)
+	if !ok {
+		return nil
+	}
+	if currentConfig().CacheEnabled && videoCache != nil &&
+		videoCache.Contains(cacheKey{path: cf.path, etag: cf.etag, offset: off - off%cacheBlockSize}) {
+		// Hot or prewarmed; serve it from memory
+		return nil
+	}
+	return obj.File
+}
+
+// sourceReader remembers the read error of a response body's source, so a
+// failing storage backend is not taken for a client that went away
+type sourceReader struct {
+	io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.Reader.Read(p)
+	if err != nil && err != io.EOF && s.err == nil {
+		s.err = err
+	}
+	return n, err
+}
+
+// copyFrom is readFrom that also reports whether a failure came from reading
+// src. A file handed over for sendfile is passed on as it is; its rare read
+// errors cannot be told apart.
+func copyFrom(w io.Writer, src io.Reader) (n int64, readFailed bool, err error) {
+	tracked := &sourceReader{Reader: src}
+	if l, ok := src.(*io.LimitedReader); ok {
+		if _, file := l.R.(*os.File); file {
+			n, err = readFrom(w, src)
+			return n, false, err
+		}
+		// Track inside the LimitedReader, so its count still goes down
+		tracked.Reader = l.R
+		l.R = tracked
+		defer func() { l.R = tracked.Reader }()
+	} else {
+		src = tracked
+	}
+	n, err = readFrom(w, src)
+	return n, err != nil && tracked.err != nil, err
+}
+
+// writerOnly hides the ReadFrom of a writer, so copying into it does not
+// come back to the caller's ReadFrom
+type writerOnly struct {
+	io.Writer
+}
+
+// readFrom copies src into w, through the ReadFrom of w when it has one
+func readFrom(w io.Writer, src io.Reader) (int64, error) {
+	if rf, ok := w.(io.ReaderFrom); ok {
+		return rf.ReadFrom(src)
+	}
+	buf := getCopyBuffer(currentConfig().ChunkSize)
+	defer putCopyBuffer(buf)
+	return io.CopyBuffer(writerOnly{w}, src, *buf)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Serve a patterned stream.mp4 of size bytes from a local test server
+func rangeServer(tb testing.TB, size int) (*httptest.Server, []byte) {
+	tb.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	if err := os.WriteFile(filepath.Join(config.PublicBasePath, testUUID, "stream.mp4"), data, 0o644); err != nil {
+		tb.Fatal(err)
+	}
+	server := httptest.NewServer(newRouter())
+	tb.Cleanup(server.Close)
+	return server, data
+}
+
+func getRange(tb testing.TB, url, ranges string) (*http.Response, []byte) {
+	tb.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	if ranges != "" {
+		req.Header.Set("Range", ranges)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return resp, body
+}
+
+func TestRangeResponses(t *testing.T) {
+	setupStorage(t)
+	server, data := rangeServer(t, 3*int(cacheBlockSize)+1000)
+	url := server.URL + "/stream/" + testUUID
+	t.Cleanup(func() { config.Sendfile = false })
+
+	for _, tt := range []struct {
+		name     string
+		sendfile bool
+		cache    bool
+	}{
+		{"buffered", false, false},
+		{"sendfile", true, false},
+		{"sendfile with cached blocks", true, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			config.Sendfile, config.CacheEnabled = tt.sendfile, tt.cache
+			videoCache = newVideoCache(1 << 30)
+			if tt.cache {
+				// The second block is served from memory, the rest from the file
+				info, err := config.PublicStore.Stat(context.Background(), testUUID+"/stream.mp4")
+				if err != nil {
+					t.Fatal(err)
+				}
+				videoCache.Put(cacheKey{info.Name, info.ETag, cacheBlockSize}, data[cacheBlockSize:2*cacheBlockSize])
+			}
+
+			if _, body := getRange(t, url, ""); !bytes.Equal(body, data) {
+				t.Error("full response differs from the file")
+			}
+			start := cacheBlockSize + 10
+			resp, body := getRange(t, url, fmt.Sprintf("bytes=%d-", start))
+			if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[start:]) {
+				t.Errorf("open-ended range: status %d, %d bytes", resp.StatusCode, len(body))
+			}
+			resp, body = getRange(t, url, "bytes=5-9,300000-300009")
+			if !strings.HasPrefix(resp.Header.Get("Content-Type"), "multipart/byteranges") ||
+				!bytes.Contains(body, data[5:10]) || !bytes.Contains(body, data[300000:300010]) {
+				t.Errorf("multipart range: %q", resp.Header.Get("Content-Type"))
+			}
+		})
+	}
+}
+
+// The copy loop before buffers were pooled, for comparison
+func copyRangeUnpooled(w io.Writer, src io.ReaderAt, start, length int64) {
+	chunkSize := currentConfig().ChunkSize
+	reader := io.NewSectionReader(src, start, length)
+	buffer := make([]byte, chunkSize)
+	for remaining := length; remaining > 0; {
+		n, err := reader.Read(buffer[:min(remaining, chunkSize)])
+		if n > 0 {
+			w.Write(buffer[:n])
+			remaining -= int64(n)
+		}
+		if err != nil {
+			break
+		}
+	}
+}
+
+func BenchmarkCopyRange(b *testing.B) {
+	config.ChunkSize = 2 << 20
+	src := bytes.NewReader(make([]byte, 1<<20))
+	b.Run("unpooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(src.Size())
+		for i := 0; i < b.N; i++ {
+			copyRangeUnpooled(writerOnly{io.Discard}, src, 0, src.Size())
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		b.ReportAllocs()
+		b.SetBytes(src.Size())
+		for i := 0; i < b.N; i++ {
+			copyRange(writerOnly{io.Discard}, src, 0, src.Size())
+		}
+	})
+}
+
+func BenchmarkRangeResponse(b *testing.B) {
+	setupStorage(b)
+	config.ChunkSize = 2 << 20
+	// Keep access logs out of the results
+	defer func(l *slog.Logger) { logger = l }(logger)
+	logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	const size = 16 << 20
+	server, _ := rangeServer(b, size)
+
+	for _, sendfile := range []bool{false, true} {
+		name := "buffered"
+		if sendfile {
+			name = "sendfile"
+		}
+		b.Run(name, func(b *testing.B) {
+			config.Sendfile = sendfile
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(server.URL + "/stream/" + testUUID)
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+	config.Sendfile = false
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CORS policy built from ALLOWED_ORIGINS. Entries are matched against the
+// request Origin, lower-cased and without a default port, as:
+//
+//	https://app.example.com           exact origin
+//	https://*.example.com             any subdomain of example.com, same scheme and port
+//	regex:https://pr-[0-9]+\.dev      regular expression, anchored to the whole origin
+//	*                                 any origin, without credentials
+var (
+	corsAllowedMethods = []string{"GET", "HEAD", "OPTIONS"}
+	corsAllowedHeaders = []string{
+		"Range", "Accept", "Accept-Encoding", "Accept-Language", "Content-Type", "Authorization",
+		"X-Requested-With", "X-Request-ID", "X-Playtube-Session",
+		"If-Range", "If-None-Match", "If-Modified-Since",
+	}
+	corsExposedHeaders = []string{
+		"Content-Length", "Content-Range", "Accept-Ranges", "Content-Type", "ETag", "Last-Modified", "X-Request-ID",
+	}
+	corsMaxAge = 86400
+)
+
+// Origins allowed when ALLOWED_ORIGINS is unset. Outside production this
+// adds any local port and GitHub Codespaces forwarded ports.
+func defaultAllowedOrigins() string {
+	origins := "http://localhost:8000,http://localhost:8080,http://127.0.0.1:8000"
+	if getEnv("APP_ENV", "local") != "production" {
+		origins += `,regex:https?://(localhost|127\.0\.0\.1)(:[0-9]+)?,https://*.github.dev`
+	}
+	return origins
+}
+
+// corsWildcard matches subdomains of suffix
+type corsWildcard struct {
+	scheme string
+	suffix string // ".example.com"
+	port   string
+}
+
+type corsPolicy struct {
+	exact     map[string]bool
+	wildcards []corsWildcard
+	patterns  []*regexp.Regexp
+	anyOrigin bool
+	headers   map[string]bool // lower-cased allowed request headers
+}
+
+// Build a policy from origin entries, rejecting malformed ones
+func newCORSPolicy(entries []string) (*corsPolicy, error) {
+	p := &corsPolicy{exact: make(map[string]bool), headers: make(map[string]bool)}
+	for _, h := range corsAllowedHeaders {
+		p.headers[strings.ToLower(h)] = true
+	}
+
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case entry == "*":
+			p.anyOrigin = true
+		case strings.HasPrefix(entry, "regex:"):
+			re, err := regexp.Compile("^(?:" + strings.TrimPrefix(entry, "regex:") + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid origin pattern %q: %v", entry, err)
+			}
+			p.patterns = append(p.patterns, re)
+		case strings.Contains(entry, "*"):
+			u, err := url.Parse(strings.Replace(entry, "*.", "wildcard.", 1))
+			if err != nil || u.Scheme == "" || !strings.HasPrefix(u.Host, "wildcard.") ||
+				strings.Contains(u.Host, "*") || (u.Path != "" && u.Path != "/") {
+				return nil, fmt.Errorf("invalid wildcard origin %q", entry)
+			}
+			p.wildcards = append(p.wildcards, corsWildcard{
+				scheme: strings.ToLower(u.Scheme),
+				suffix: strings.ToLower(strings.TrimPrefix(u.Hostname(), "wildcard")),
+				port:   withoutDefaultPort(u.Scheme, u.Port()),
+			})
+		default:
+			origin, ok := normalizeOrigin(entry)
+			if !ok {
+				return nil, fmt.Errorf("invalid origin %q", entry)
+			}
+			p.exact[origin] = true
+		}
+	}
+	return p, nil
+}
+
+// Lower-case scheme and host and drop a trailing slash and a default port.
+// Origins with a path, query or credentials are not origins.
+func normalizeOrigin(origin string) (string, bool) {
+	u, err := url.Parse(strings.TrimSuffix(origin, "/"))
+	if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" || u.RawQuery != "" || u.User != nil || u.Fragment != "" {
+		return "", false
+	}
+	scheme, host := strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	if port := u.Port(); port != "" && withoutDefaultPort(scheme, port) == "" {
+		host = strings.TrimSuffix(host, ":"+port)
+	}
+	return scheme + "://" + host, true
+}
+
+// Return port, or "" when it is the default port of scheme
+func withoutDefaultPort(scheme, port string) string {
+	switch {
+	case strings.EqualFold(scheme, "http") && port == "80", strings.EqualFold(scheme, "https") && port == "443":
+		return ""
+	}
+	return port
+}
+
+// Report whether origin may read responses, and whether with credentials
+func (p *corsPolicy) allows(origin string) (allowed, credentials bool) {
+	if p == nil || origin == "" || origin == "null" {
+		return false, false
+	}
+	normalized, ok := normalizeOrigin(origin)
+	if !ok {
+		return false, false
+	}
+	if p.exact[normalized] {
+		return true, true
+	}
+
+	u, _ := url.Parse(normalized)
+	host := u.Hostname()
+	for _, w := range p.wildcards {
+		if u.Scheme == w.scheme && u.Port() == w.port &&
+			len(host) > len(w.suffix) && strings.HasSuffix(host, w.suffix) {
+			return true, true
+		}
+	}
+	for _, re := range p.patterns {
+		if re.MatchString(normalized) {
+			return true, true
+		}
+	}
+	if p.anyOrigin {
+		return true, false
+	}
+	return false, false
+}
+
+// Report whether every header in an Access-Control-Request-Headers value is allowed
+func (p *corsPolicy) allowsHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.ToLower(strings.TrimSpace(h))
+		if h != "" && !p.headers[h] {
+			return false
+		}
+	}
+	return true
+}
+
+func allowsMethod(method string) bool {
+	for _, m := range corsAllowedMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// CORS Middleware
+func corsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == "OPTIONS" && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// Responses differ per Origin, so shared caches must key on it
+		w.Header().Add("Vary", "Origin")
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		policy := currentConfig().CORS
+		allowed, credentials := policy.allows(origin)
+		if preflight {
+			requestedHeaders := r.Header.Get("Access-Control-Request-Headers")
+			if !allowed || !allowsMethod(r.Header.Get("Access-Control-Request-Method")) ||
+				!policy.allowsHeaders(requestedHeaders) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			setCORSOrigin(w, origin, credentials)
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(corsAllowedMethods, ", "))
+			if requestedHeaders != "" {
+				w.Header().Set("Access-Control-Allow-Headers", strings.Join(corsAllowedHeaders, ", "))
+			}
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if allowed {
+			setCORSOrigin(w, origin, credentials)
+			w.Header().Set("Access-Control-Expose-Headers", strings.Join(corsExposedHeaders, ", "))
+		}
+
+		if r.Method == "OPTIONS" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func setCORSOrigin(w http.ResponseWriter, origin string, credentials bool) {
+	if !credentials {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		return
+	}
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+}
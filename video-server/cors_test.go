@@ -0,0 +1,174 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCORSPolicy(t *testing.T) {
+	setupStorage(t)
+	policy, err := newCORSPolicy([]string{
+		"https://playtube.example",
+		"https://*.cdn.example",
+		"http://*.localhost:8000",
+		`regex:https://pr-[0-9]+\.preview\.example`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.CORS = policy
+	router := newRouter()
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		reqMethod   string // Access-Control-Request-Method
+		reqHeaders  string // Access-Control-Request-Headers
+		wantStatus  int
+		wantOrigin  string // expected Access-Control-Allow-Origin, "" for none
+		wantAllowed bool
+	}{
+		{"no origin", "GET", "", "", "", 200, "", false},
+		{"exact origin", "GET", "https://playtube.example", "", "", 200, "https://playtube.example", true},
+		{"exact origin trailing slash", "GET", "https://playtube.example/", "", "", 200, "https://playtube.example/", true},
+		{"exact origin upper case", "GET", "HTTPS://PLAYTUBE.EXAMPLE", "", "", 200, "HTTPS://PLAYTUBE.EXAMPLE", true},
+		{"exact origin wrong scheme", "GET", "http://playtube.example", "", "", 200, "", false},
+		{"exact origin wrong port", "GET", "https://playtube.example:8443", "", "", 200, "", false},
+		{"exact origin as suffix", "GET", "https://evil-playtube.example", "", "", 200, "", false},
+		{"exact origin as prefix", "GET", "https://playtube.example.evil.com", "", "", 200, "", false},
+		{"wildcard subdomain", "GET", "https://eu.cdn.example", "", "", 200, "https://eu.cdn.example", true},
+		{"wildcard nested subdomain", "GET", "https://a.b.cdn.example", "", "", 200, "https://a.b.cdn.example", true},
+		{"wildcard bare domain", "GET", "https://cdn.example", "", "", 200, "", false},
+		{"wildcard lookalike", "GET", "https://evilcdn.example", "", "", 200, "", false},
+		{"wildcard wrong scheme", "GET", "http://eu.cdn.example", "", "", 200, "", false},
+		{"wildcard with port", "GET", "http://app.localhost:8000", "", "", 200, "http://app.localhost:8000", true},
+		{"wildcard missing port", "GET", "http://app.localhost", "", "", 200, "", false},
+		{"wildcard default port", "GET", "https://eu.cdn.example:443", "", "", 200, "https://eu.cdn.example:443", true},
+		{"exact origin default port", "GET", "https://playtube.example:443", "", "", 200, "https://playtube.example:443", true},
+		{"substring localhost", "GET", "https://evil-localhost.example", "", "", 200, "", false},
+		{"substring codespaces", "GET", "https://codespaces.evil.com", "", "", 200, "", false},
+		{"substring github.dev", "GET", "https://github.dev.evil.com", "", "", 200, "", false},
+		{"regex match", "GET", "https://pr-42.preview.example", "", "", 200, "https://pr-42.preview.example", true},
+		{"regex upper case", "GET", "HTTPS://PR-42.preview.example", "", "", 200, "HTTPS://PR-42.preview.example", true},
+		{"regex default port", "GET", "https://pr-42.preview.example:443/", "", "", 200, "https://pr-42.preview.example:443/", true},
+		{"regex anchored", "GET", "https://pr-42.preview.example.evil.com", "", "", 200, "", false},
+		{"null origin", "GET", "null", "", "", 200, "", false},
+		{"origin with path", "GET", "https://playtube.example/page", "", "", 200, "", false},
+		{"preflight allowed", "OPTIONS", "https://playtube.example", "GET", "Range, X-Request-ID", 204, "https://playtube.example", true},
+		{"preflight header case", "OPTIONS", "https://playtube.example", "GET", "range,if-range", 204, "https://playtube.example", true},
+		{"preflight without headers", "OPTIONS", "https://eu.cdn.example", "HEAD", "", 204, "https://eu.cdn.example", true},
+		{"preflight bad method", "OPTIONS", "https://playtube.example", "DELETE", "", 403, "", false},
+		{"preflight bad header", "OPTIONS", "https://playtube.example", "GET", "Range, X-Evil", 403, "", false},
+		{"preflight bad origin", "OPTIONS", "https://evil.example", "GET", "Range", 403, "", false},
+		{"plain options", "OPTIONS", "https://playtube.example", "", "", 204, "https://playtube.example", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/stream/"+testUUID, nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			if tt.reqMethod != "" {
+				req.Header.Set("Access-Control-Request-Method", tt.reqMethod)
+			}
+			if tt.reqHeaders != "" {
+				req.Header.Set("Access-Control-Request-Headers", tt.reqHeaders)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			h := rec.Header()
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if got := h.Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantOrigin)
+			}
+			if got := h.Get("Access-Control-Allow-Credentials") == "true"; got != tt.wantAllowed {
+				t.Errorf("Access-Control-Allow-Credentials set = %v, want %v", got, tt.wantAllowed)
+			}
+			if !tt.wantAllowed {
+				for name := range h {
+					if strings.HasPrefix(name, "Access-Control-") {
+						t.Errorf("disallowed request got %s: %q", name, h.Get(name))
+					}
+				}
+			}
+			if !strings.Contains(strings.Join(h.Values("Vary"), ","), "Origin") {
+				t.Errorf("Vary = %q, want Origin", h.Values("Vary"))
+			}
+			if tt.method == "GET" && tt.wantAllowed && !strings.Contains(h.Get("Access-Control-Expose-Headers"), "Last-Modified") {
+				t.Errorf("Access-Control-Expose-Headers = %q, want Last-Modified", h.Get("Access-Control-Expose-Headers"))
+			}
+			if tt.method == "OPTIONS" && tt.reqMethod != "" && tt.wantAllowed {
+				if h.Get("Access-Control-Allow-Methods") == "" || h.Get("Access-Control-Max-Age") == "" {
+					t.Errorf("preflight headers missing: %v", h)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSAnyOriginWithoutCredentials(t *testing.T) {
+	setupStorage(t)
+	policy, err := newCORSPolicy([]string{"*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.CORS = policy
+
+	req := httptest.NewRequest("GET", "/stream/"+testUUID, nil)
+	req.Header.Set("Origin", "https://anywhere.example")
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("Access-Control-Allow-Origin = %q, want *", got)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Credentials"); got != "" {
+		t.Errorf("Access-Control-Allow-Credentials = %q, want none", got)
+	}
+}
+
+func TestNewCORSPolicyRejectsMalformedEntries(t *testing.T) {
+	for _, entry := range []string{
+		"playtube.example",
+		"https://playtube.example/path",
+		"https://*cdn.example",
+		"https://cdn.*.example",
+		"regex:(",
+	} {
+		if _, err := newCORSPolicy([]string{entry}); err == nil {
+			t.Errorf("newCORSPolicy(%q) accepted a malformed entry", entry)
+		}
+	}
+}
+
+func TestDefaultAllowedOrigins(t *testing.T) {
+	t.Setenv("APP_ENV", "local")
+	policy, err := newCORSPolicy(strings.Split(defaultAllowedOrigins(), ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for origin, want := range map[string]bool{
+		"http://localhost:5173":            true,
+		"https://name-8000.app.github.dev": true,
+		"https://evil-localhost.example":   false,
+		"http://localhost.evil.example":    false,
+		"https://github.dev.evil.example":  false,
+		"http://127.0.0.1:8000":            true,
+	} {
+		if allowed, _ := policy.allows(origin); allowed != want {
+			t.Errorf("allows(%q) = %v, want %v", origin, allowed, want)
+		}
+	}
+
+	t.Setenv("APP_ENV", "production")
+	policy, _ = newCORSPolicy(strings.Split(defaultAllowedOrigins(), ","))
+	if allowed, _ := policy.allows("https://name-8000.app.github.dev"); allowed {
+		t.Error("production default allows Codespaces origins")
+	}
+}
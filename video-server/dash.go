@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Build static DASH manifests from the CMAF/fMP4 renditions that the HLS
+// pipeline already writes under {uuid}/{quality} in HLS storage, so DASH
+// clients share the same media files as HLS.
+
+var errNotFragmented = errors.New("rendition is not fragmented MP4")
+
+// dashRendition is one quality ladder rung described from its files
+type dashRendition struct {
+	Quality   string
+	Init      string
+	Segments  []string
+	Timings   []fragmentTiming // in Timescale units
+	Timescale uint32
+	Duration  float64 // seconds
+	Bandwidth int64
+	Codecs    string
+	Width     int
+	Height    int
+	HasVideo  bool
+}
+
+// Probed renditions by video uuid, versioned by the rendition fingerprint
+var dashProbes = newProbeCache[[]*dashRendition](1024)
+
+// hlsMediaPlaylist lists the files referenced by an HLS media playlist
+type hlsMediaPlaylist struct {
+	Init      string
+	Segments  []string
+	Durations []float64 // #EXTINF seconds, parallel to Segments
+}
+
+// Read the init segment, media segment names and durations from an HLS media playlist
+func readHLSMediaPlaylist(ctx context.Context, key string) (*hlsMediaPlaylist, error) {
+	obj, err := config.HLSStore.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+
+	playlist := &hlsMediaPlaylist{}
+	var duration float64
+	scanner := bufio.NewScanner(io.NewSectionReader(obj, 0, obj.Info().Size))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "":
+		case strings.HasPrefix(line, "#EXT-X-MAP:"):
+			if m := uriAttrPattern.FindStringSubmatch(line); m != nil {
+				playlist.Init = m[1]
+			}
+		case strings.HasPrefix(line, "#EXTINF:"):
+			value, _, _ := strings.Cut(strings.TrimPrefix(line, "#EXTINF:"), ",")
+			duration, _ = strconv.ParseFloat(strings.TrimSpace(value), 64)
+		case strings.HasPrefix(line, "#"):
+		default:
+			playlist.Segments = append(playlist.Segments, line)
+			playlist.Durations = append(playlist.Durations, duration)
+			duration = 0
+		}
+	}
+	return playlist, scanner.Err()
+}
+
+// Probe one rendition directory. Only fMP4 renditions with an init segment
+// and .m4s media segments qualify.
+func probeDashRendition(ctx context.Context, uuid, quality string) (*dashRendition, error) {
+	dir := uuid + "/" + quality + "/"
+	playlist, err := readHLSMediaPlaylist(ctx, dir+"playlist.m3u8")
+	if err != nil {
+		return nil, err
+	}
+	init, segments := playlist.Init, playlist.Segments
+	if init == "" || len(segments) == 0 || !validSegment(init) {
+		return nil, errNotFragmented
+	}
+	for _, s := range segments {
+		if !validSegment(s) || !strings.HasSuffix(s, ".m4s") {
+			return nil, errNotFragmented
+		}
+	}
+
+	initFile, err := config.HLSStore.Open(ctx, dir+init)
+	if err != nil {
+		return nil, err
+	}
+	info, err := probeMP4(initFile, initFile.Info().Size)
+	initFile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Segment timing follows the video track, or the first track for audio-only
+	track, hasVideo := info.Track("vide")
+	if !hasVideo && len(info.Tracks) > 0 {
+		track = info.Tracks[0]
+	}
+	if track.Timescale == 0 {
+		return nil, fmt.Errorf("%s/%s: init segment has no track timescale", uuid, quality)
+	}
+
+	rend := &dashRendition{
+		Quality:   quality,
+		Init:      init,
+		Segments:  segments,
+		Timescale: track.Timescale,
+		Codecs:    info.Codecs(),
+		Width:     track.Width,
+		Height:    track.Height,
+		HasVideo:  hasVideo,
+	}
+
+	var totalBytes int64
+	var totalDuration uint64
+	for _, s := range segments {
+		segFile, err := config.HLSStore.Open(ctx, dir+s)
+		if err != nil {
+			return nil, err
+		}
+		segSize := segFile.Info().Size
+		timing, err := probeFragment(segFile, segSize, track)
+		segFile.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s, err)
+		}
+
+		// Normalise sidx timing to the track timescale
+		if timing.Timescale != 0 && timing.Timescale != track.Timescale {
+			timing.Start = timing.Start * uint64(track.Timescale) / uint64(timing.Timescale)
+			timing.Duration = timing.Duration * uint64(track.Timescale) / uint64(timing.Timescale)
+		}
+		timing.Timescale = track.Timescale
+
+		rend.Timings = append(rend.Timings, timing)
+		totalBytes += segSize
+		totalDuration += timing.Duration
+	}
+
+	rend.Duration = float64(totalDuration) / float64(track.Timescale)
+	if rend.Duration > 0 {
+		rend.Bandwidth = int64(float64(totalBytes*8) / rend.Duration)
+	}
+	return rend, nil
+}
+
+// Fingerprint the rendition playlists so the cached probe is rebuilt whenever
+// a rendition is added, removed or regenerated
+func dashFingerprint(ctx context.Context, uuid string) string {
+	var b strings.Builder
+	for _, q := range qualityLadder {
+		if info, err := config.HLSStore.Stat(ctx, uuid+"/"+q+"/playlist.m3u8"); err == nil {
+			fmt.Fprintf(&b, "%s:%d:%s;", q, info.Size, info.ETag)
+		}
+	}
+	return b.String()
+}
+
+// Return the probed fMP4 renditions of a video, probing on first use and
+// whenever a rendition changes
+func dashRenditions(ctx context.Context, uuid string) ([]*dashRendition, error) {
+	fingerprint := dashFingerprint(ctx, uuid)
+	if fingerprint == "" {
+		return nil, nil
+	}
+	return dashProbes.Get(ctx, uuid, fingerprint, func(ctx context.Context) ([]*dashRendition, error) {
+		var renditions []*dashRendition
+		for _, q := range qualityLadder {
+			rend, err := probeDashRendition(ctx, uuid, q)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if err != nil {
+				if !isNotExist(err) && !errors.Is(err, errNotFragmented) {
+					logger.Warn("DASH probe failed", "uuid", uuid, "quality", q, "error", err)
+				}
+				continue
+			}
+			renditions = append(renditions, rend)
+		}
+		return renditions, nil
+	})
+}
+
+// MPD document model, limited to what a static SegmentList manifest needs
+type mpdDocument struct {
+	XMLName                   xml.Name `xml:"MPD"`
+	Xmlns                     string   `xml:"xmlns,attr"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	Period                    mpdPeriod
+}
+
+type mpdPeriod struct {
+	ID             string             `xml:"id,attr"`
+	Start          string             `xml:"start,attr"`
+	AdaptationSets []mpdAdaptationSet `xml:"AdaptationSet"`
+}
+
+type mpdAdaptationSet struct {
+	ID                   int                 `xml:"id,attr"`
+	ContentType          string              `xml:"contentType,attr"`
+	MimeType             string              `xml:"mimeType,attr"`
+	SegmentAlignment     bool                `xml:"segmentAlignment,attr"`
+	StartWithSAP         int                 `xml:"startWithSAP,attr"`
+	SupplementalProperty *mpdDescriptor      `xml:"SupplementalProperty,omitempty"`
+	Representations      []mpdRepresentation `xml:"Representation"`
+}
+
+type mpdDescriptor struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       string `xml:"value,attr"`
+}
+
+type mpdRepresentation struct {
+	ID          string         `xml:"id,attr"`
+	Bandwidth   int64          `xml:"bandwidth,attr"`
+	Codecs      string         `xml:"codecs,attr,omitempty"`
+	Width       int            `xml:"width,attr,omitempty"`
+	Height      int            `xml:"height,attr,omitempty"`
+	BaseURL     string         `xml:"BaseURL"`
+	SegmentList mpdSegmentList `xml:"SegmentList"`
+}
+
+type mpdSegmentList struct {
+	Timescale       uint32          `xml:"timescale,attr"`
+	Initialization  mpdURL          `xml:"Initialization"`
+	SegmentTimeline []mpdTimelineS  `xml:"SegmentTimeline>S"`
+	SegmentURLs     []mpdSegmentURL `xml:"SegmentURL"`
+}
+
+type mpdURL struct {
+	SourceURL string `xml:"sourceURL,attr"`
+}
+
+type mpdSegmentURL struct {
+	Media string `xml:"media,attr"`
+}
+
+type mpdTimelineS struct {
+	T *uint64 `xml:"t,attr,omitempty"`
+	D uint64  `xml:"d,attr"`
+	R int     `xml:"r,attr,omitempty"`
+}
+
+// Collapse segment timings into S elements, using r for runs of equal
+// durations and t whenever a segment does not start where the last ended
+func buildSegmentTimeline(timings []fragmentTiming) []mpdTimelineS {
+	var timeline []mpdTimelineS
+	var next uint64
+	for i, t := range timings {
+		if i > 0 && t.Start == next && t.Duration == timeline[len(timeline)-1].D {
+			timeline[len(timeline)-1].R++
+		} else {
+			s := mpdTimelineS{D: t.Duration}
+			if i == 0 || t.Start != next {
+				start := t.Start
+				s.T = &start
+			}
+			timeline = append(timeline, s)
+		}
+		next = t.Start + t.Duration
+	}
+	return timeline
+}
+
+// Format seconds as an xs:duration
+func mpdDuration(seconds float64) string {
+	return fmt.Sprintf("PT%.3fS", seconds)
+}
+
+// Render the MPD for a set of renditions, appending query to every media URL
+func renderDashManifest(renditions []*dashRendition, query string) ([]byte, error) {
+	doc := mpdDocument{
+		Xmlns:         "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:      "urn:mpeg:dash:profile:isoff-main:2011",
+		Type:          "static",
+		MinBufferTime: "PT2S",
+		Period:        mpdPeriod{ID: "0", Start: "PT0S"},
+	}
+
+	// One AdaptationSet per quality, marked as switchable with each other
+	var ids []string
+	for i := range renditions {
+		ids = append(ids, fmt.Sprint(i))
+	}
+
+	longest := 0.0
+	for i, rend := range renditions {
+		if rend.Duration > longest {
+			longest = rend.Duration
+		}
+
+		contentType, mimeType := "video", "video/mp4"
+		if !rend.HasVideo {
+			contentType, mimeType = "audio", "audio/mp4"
+		}
+
+		list := mpdSegmentList{
+			Timescale:       rend.Timescale,
+			Initialization:  mpdURL{SourceURL: appendQuery(rend.Init, query)},
+			SegmentTimeline: buildSegmentTimeline(rend.Timings),
+		}
+		for _, s := range rend.Segments {
+			list.SegmentURLs = append(list.SegmentURLs, mpdSegmentURL{Media: appendQuery(s, query)})
+		}
+
+		set := mpdAdaptationSet{
+			ID:               i,
+			ContentType:      contentType,
+			MimeType:         mimeType,
+			SegmentAlignment: true,
+			StartWithSAP:     1,
+			Representations: []mpdRepresentation{{
+				ID:          rend.Quality,
+				Bandwidth:   rend.Bandwidth,
+				Codecs:      rend.Codecs,
+				Width:       rend.Width,
+				Height:      rend.Height,
+				BaseURL:     rend.Quality + "/",
+				SegmentList: list,
+			}},
+		}
+		if len(renditions) > 1 {
+			set.SupplementalProperty = &mpdDescriptor{
+				SchemeIDURI: "urn:mpeg:dash:adaptation-set-switching:2016",
+				Value:       strings.Join(ids, ","),
+			}
+		}
+		doc.Period.AdaptationSets = append(doc.Period.AdaptationSets, set)
+	}
+	doc.MediaPresentationDuration = mpdDuration(longest)
+
+	out, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), append(out, '\n')...), nil
+}
+
+// Generate Dynamic DASH Manifest from fMP4 renditions
+func generateDashManifest(w http.ResponseWriter, r *http.Request, uuid string) {
+	renditions, err := dashRenditions(r.Context(), uuid)
+	if err != nil {
+		if r.Context().Err() == nil {
+			logger.Warn("DASH probe failed", "uuid", uuid, "error", err)
+			http.Error(w, "DASH manifest not available", http.StatusServiceUnavailable)
+		}
+		return
+	}
+	if len(renditions) == 0 {
+		http.Error(w, "DASH manifest not available", http.StatusNotFound)
+		return
+	}
+
+	// Segment requests need the same credentials as the manifest
+	query, _ := playlistTokenQuery(r, "/dash/"+uuid)
+
+	manifest, err := renderDashManifest(renditions, query)
+	if err != nil {
+		http.Error(w, "Cannot build DASH manifest", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/dash+xml")
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "manifest.mpd", time.Time{}, strings.NewReader(string(manifest)))
+}
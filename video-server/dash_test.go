@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func box(typ string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	out := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(out, uint32(8+len(body)))
+	copy(out[4:], typ)
+	return append(out, body...)
+}
+
+func u16(v uint16) []byte { return binary.BigEndian.AppendUint16(nil, v) }
+func u32(v uint32) []byte { return binary.BigEndian.AppendUint32(nil, v) }
+func u64(v uint64) []byte { return binary.BigEndian.AppendUint64(nil, v) }
+
+// Build a CMAF init segment with one H.264 and one AAC track
+func testInitSegment() []byte {
+	videoEntry := box("avc1",
+		make([]byte, 6), u16(1), make([]byte, 16), // reserved, data ref index, pre-defined
+		u16(1280), u16(720), make([]byte, 50),
+		box("avcC", []byte{1, 0x64, 0x00, 0x1f, 0xff}),
+	)
+	esds := box("esds", u32(0),
+		[]byte{0x03, 22, 0x00, 0x01, 0x00},             // ES_Descriptor
+		[]byte{0x04, 17, 0x40, 0x15}, make([]byte, 11), // DecoderConfigDescriptor
+		[]byte{0x05, 2, 0x12, 0x10}, // AudioSpecificConfig: AAC-LC
+	)
+	audioEntry := box("mp4a", make([]byte, 6), u16(1), make([]byte, 20), esds)
+
+	trak := func(id uint32, handler string, timescale uint32, entry []byte) []byte {
+		return box("trak",
+			box("tkhd", u32(3), u32(0), u32(0), u32(id), make([]byte, 64)),
+			box("mdia",
+				box("mdhd", u32(0), u32(0), u32(0), u32(timescale), u32(0), make([]byte, 4)),
+				box("hdlr", u32(0), u32(0), []byte(handler), make([]byte, 13)),
+				box("minf", box("stbl", box("stsd", u32(0), u32(1), entry))),
+			),
+		)
+	}
+
+	return bytes.Join([][]byte{
+		box("ftyp", []byte("iso6"), u32(0)),
+		box("moov",
+			box("mvhd", u32(0), u32(0), u32(0), u32(1000), u32(0), make([]byte, 80)),
+			box("mvex", box("trex", u32(0), u32(1), u32(1), u32(3000), u32(0), u32(0))),
+			trak(1, "vide", 90000, videoEntry),
+			trak(2, "soun", 48000, audioEntry),
+		),
+	}, nil)
+}
+
+// Build a media segment with samples samples of the trex default duration
+func testMediaSegment(baseTime uint64, samples uint32) []byte {
+	return bytes.Join([][]byte{
+		box("styp", []byte("msdh"), u32(0)),
+		box("moof",
+			box("mfhd", u32(0), u32(1)),
+			box("traf",
+				box("tfhd", u32(0x020000), u32(1)),
+				box("tfdt", u32(0x01000000), u64(baseTime)),
+				box("trun", u32(0x000200), u32(samples), make([]byte, 4*samples)),
+			),
+		),
+		box("mdat", make([]byte, 1000)),
+	}, nil)
+}
+
+func TestProbeMP4InitSegment(t *testing.T) {
+	init := testInitSegment()
+	info, err := probeMP4(bytes.NewReader(init), int64(len(init)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := info.Codecs(), "avc1.64001f,mp4a.40.2"; got != want {
+		t.Errorf("Codecs() = %q, want %q", got, want)
+	}
+	video, ok := info.Track("vide")
+	if !ok {
+		t.Fatal("no video track")
+	}
+	if video.Width != 1280 || video.Height != 720 || video.Timescale != 90000 || video.DefaultDuration != 3000 {
+		t.Errorf("video track = %+v", video)
+	}
+}
+
+func TestParseESDSTruncated(t *testing.T) {
+	// The URL length runs past the end of the descriptor
+	if oti, aot := parseESDS([]byte{0, 0, 0, 0, 0x03, 0x05, 0, 1, 0x40, 0xff, 0}); oti != 0 || aot != 0 {
+		t.Errorf("parseESDS = %d, %d; want nothing", oti, aot)
+	}
+}
+
+func TestGenerateDashManifest(t *testing.T) {
+	setupStorage(t)
+	dir := filepath.Join(config.HLSBasePath, testUUID, "720p")
+	playlist := "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2.0,\nseg_00001.m4s\n#EXTINF:2.0,\nseg_00002.m4s\n#EXTINF:1.0,\nseg_00003.m4s\n#EXT-X-ENDLIST\n"
+	files := map[string][]byte{
+		"playlist.m3u8": []byte(playlist),
+		"init.mp4":      testInitSegment(),
+		"seg_00001.m4s": testMediaSegment(0, 60),
+		"seg_00002.m4s": testMediaSegment(180000, 60),
+		"seg_00003.m4s": testMediaSegment(360000, 30),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/dash/"+testUUID+"/manifest.mpd", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("manifest status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var mpd mpdDocument
+	if err := xml.Unmarshal(rec.Body.Bytes(), &mpd); err != nil {
+		t.Fatalf("invalid MPD: %v\n%s", err, rec.Body.String())
+	}
+	if len(mpd.Period.AdaptationSets) != 1 {
+		t.Fatalf("got %d adaptation sets, want 1", len(mpd.Period.AdaptationSets))
+	}
+
+	rep := mpd.Period.AdaptationSets[0].Representations[0]
+	if rep.Codecs != "avc1.64001f,mp4a.40.2" || rep.Width != 1280 || rep.Height != 720 {
+		t.Errorf("representation = %+v", rep)
+	}
+	if mpd.MediaPresentationDuration != "PT5.000S" {
+		t.Errorf("duration = %s, want PT5.000S", mpd.MediaPresentationDuration)
+	}
+
+	timeline := rep.SegmentList.SegmentTimeline
+	if len(timeline) != 2 || timeline[0].D != 180000 || timeline[0].R != 1 || timeline[1].D != 90000 {
+		t.Errorf("timeline = %+v", timeline)
+	}
+	if len(rep.SegmentList.SegmentURLs) != 3 || rep.SegmentList.Initialization.SourceURL != "init.mp4" {
+		t.Errorf("segment list = %+v", rep.SegmentList)
+	}
+}
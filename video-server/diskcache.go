@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DiskCache is the second cache tier below VideoCache: an LRU of blocks kept
+// in a directory on local disk, so hot blocks survive restarts and do not
+// have to be read again from an object store or a slow volume. Each block is
+// one file named by the hash of its key, holding a JSON header line with the
+// key followed by the block data. Files are written to a temporary name and
+// renamed into place, so a crash never leaves a torn block behind.
+type DiskCache struct {
+	dir string
+
+	mu        sync.Mutex
+	items     map[cacheKey]*diskItem
+	lru       *list.List // front = most recently used
+	size      int64
+	maxSize   int64
+	hits      atomic.Int64
+	misses    atomic.Int64
+	evictions atomic.Int64
+}
+
+type diskItem struct {
+	key     cacheKey
+	size    int64
+	element *list.Element
+}
+
+// diskBlockHeader is the first line of every block file
+type diskBlockHeader struct {
+	Path   string `json:"path"`
+	ETag   string `json:"etag"`
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+}
+
+// Block headers longer than this are treated as corrupt
+const maxDiskBlockHeader = 64 * 1024
+
+var diskCache *DiskCache
+
+// Open the cache directory and rebuild the index from the block files found
+// there, dropping temporary and unreadable files. Least recently used blocks
+// are evicted until the cache fits maxSize.
+func openDiskCache(dir string, maxSize int64) (*DiskCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("disk cache: %w", err)
+	}
+	c := &DiskCache{
+		dir:     dir,
+		items:   make(map[cacheKey]*diskItem),
+		lru:     list.New(),
+		maxSize: maxSize,
+	}
+
+	type found struct {
+		key     cacheKey
+		size    int64
+		modTime time.Time
+	}
+	var blocks []found
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), "tmp-") {
+			os.Remove(path)
+			return nil
+		}
+		key, size, err := readDiskBlockHeader(path)
+		if err == nil && c.blockPath(key) != path {
+			err = errors.New("file name does not match its key")
+		}
+		if err != nil {
+			logger.Warn("dropping disk cache block", "file", path, "error", err)
+			os.Remove(path)
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		blocks = append(blocks, found{key, size, info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("disk cache: %w", err)
+	}
+
+	sort.Slice(blocks, func(i, j int) bool { return blocks[i].modTime.Before(blocks[j].modTime) })
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, b := range blocks {
+		c.addItem(b.key, b.size)
+	}
+	c.evict(0)
+	return c, nil
+}
+
+// Read the header of a block file and check the data length against it
+func readDiskBlockHeader(path string) (cacheKey, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return cacheKey{}, 0, err
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReader(io.LimitReader(file, maxDiskBlockHeader)).ReadSlice('\n')
+	if err != nil {
+		return cacheKey{}, 0, fmt.Errorf("bad header: %w", err)
+	}
+	var h diskBlockHeader
+	if err := json.Unmarshal(line, &h); err != nil {
+		return cacheKey{}, 0, fmt.Errorf("bad header: %w", err)
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return cacheKey{}, 0, err
+	}
+	if stat.Size() != int64(len(line))+h.Size {
+		return cacheKey{}, 0, fmt.Errorf("file is %d bytes, header says %d of data", stat.Size(), h.Size)
+	}
+	return cacheKey{path: h.Path, etag: h.ETag, offset: h.Offset}, h.Size, nil
+}
+
+// Block files are spread over 256 subdirectories by the first hash byte
+func (c *DiskCache) blockPath(key cacheKey) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%d", key.path, key.etag, key.offset)))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(c.dir, name[:2], name)
+}
+
+// Get returns a cached block and marks it as most recently used
+func (c *DiskCache) Get(key cacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	item, ok := c.items[key]
+	if ok {
+		c.lru.MoveToFront(item.element)
+	}
+	c.mu.Unlock()
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	path := c.blockPath(key)
+	data, err := c.readBlock(path, key, item.size)
+	if err != nil {
+		logger.Warn("dropping disk cache block", "file", path, "error", err)
+		c.mu.Lock()
+		if c.items[key] == item {
+			c.removeItem(item)
+		}
+		c.mu.Unlock()
+		c.misses.Add(1)
+		return nil, false
+	}
+
+	// The modification time orders the LRU when the index is rebuilt
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	c.hits.Add(1)
+	return data, true
+}
+
+func (c *DiskCache) readBlock(path string, key cacheKey, size int64) ([]byte, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	end := bytes.IndexByte(raw[:min(len(raw), maxDiskBlockHeader)], '\n')
+	if end < 0 {
+		return nil, errors.New("bad header")
+	}
+	var h diskBlockHeader
+	if err := json.Unmarshal(raw[:end], &h); err != nil {
+		return nil, fmt.Errorf("bad header: %w", err)
+	}
+	if h.Path != key.path || h.ETag != key.etag || h.Offset != key.offset || h.Size != size {
+		return nil, errors.New("header does not match the key")
+	}
+	block := raw[end+1:]
+	if int64(len(block)) != size {
+		return nil, fmt.Errorf("block is %d bytes, want %d", len(block), size)
+	}
+	return block, nil
+}
+
+// Put stores a block, evicting least recently used blocks to stay within
+// maxSize. Write failures only cost the cache entry.
+func (c *DiskCache) Put(key cacheKey, data []byte) {
+	size := int64(len(data))
+	c.mu.Lock()
+	_, exists := c.items[key]
+	maxSize := c.maxSize
+	c.mu.Unlock()
+	if exists || size == 0 || size > maxSize {
+		return
+	}
+
+	if err := c.writeBlock(key, data); err != nil {
+		logger.Warn("cannot write disk cache block", "path", key.path, "offset", key.offset, "error", err)
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing, ok := c.items[key]; ok {
+		// Stored concurrently; the file now holds the same block
+		c.lru.MoveToFront(existing.element)
+		return
+	}
+	c.evict(size)
+	c.addItem(key, size)
+}
+
+// Write a block file under a temporary name and rename it into place
+func (c *DiskCache) writeBlock(key cacheKey, data []byte) error {
+	header, err := json.Marshal(diskBlockHeader{Path: key.path, ETag: key.etag, Offset: key.offset, Size: int64(len(data))})
+	if err != nil {
+		return err
+	}
+	path := c.blockPath(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "tmp-*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(header, '\n'))
+	if err == nil {
+		_, err = tmp.Write(data)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// addItem must be called with c.mu held
+func (c *DiskCache) addItem(key cacheKey, size int64) {
+	item := &diskItem{key: key, size: size}
+	item.element = c.lru.PushFront(item)
+	c.items[key] = item
+	c.size += size
+}
+
+// removeItem must be called with c.mu held
+func (c *DiskCache) removeItem(item *diskItem) {
+	c.lru.Remove(item.element)
+	delete(c.items, item.key)
+	c.size -= item.size
+	os.Remove(c.blockPath(item.key))
+}
+
+// Evict least recently used blocks until n more bytes fit; callers hold c.mu
+func (c *DiskCache) evict(n int64) {
+	for c.size+n > c.maxSize {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			return
+		}
+		c.removeItem(oldest.Value.(*diskItem))
+		c.evictions.Add(1)
+	}
+}
+
+// SetMaxSize changes the capacity, evicting blocks until the cache fits
+func (c *DiskCache) SetMaxSize(maxSize int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxSize = maxSize
+	c.evict(0)
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *DiskCache) Stats() CacheStats {
+	c.mu.Lock()
+	items, size, maxSize := len(c.items), c.size, c.maxSize
+	c.mu.Unlock()
+
+	return CacheStats{
+		Items:     items,
+		Size:      size,
+		MaxSize:   maxSize,
+		Hits:      c.hits.Load(),
+		Misses:    c.misses.Load(),
+		Evictions: c.evictions.Load(),
+	}
+}
+
+// Contains reports whether a block is cached without reading it
+func (c *DiskCache) Contains(key cacheKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[key]
+	return ok
+}
+
+// Files lists the cached blocks grouped by file version, for files whose
+// name satisfies match
+func (c *DiskCache) Files(match func(name string) bool) []cacheFileInfo {
+	c.mu.Lock()
+	byFile := make(map[fileKey]*cacheFileInfo)
+	for key, item := range c.items {
+		if !match(key.path) {
+			continue
+		}
+		fk := fileKey{key.path, key.etag}
+		f, ok := byFile[fk]
+		if !ok {
+			f = &cacheFileInfo{Name: key.path, ETag: key.etag}
+			byFile[fk] = f
+		}
+		f.Blocks++
+		f.Bytes += item.size
+	}
+	c.mu.Unlock()
+
+	files := make([]cacheFileInfo, 0, len(byFile))
+	for _, f := range byFile {
+		files = append(files, *f)
+	}
+	sortCacheFiles(files)
+	return files
+}
+
+// Purge deletes every block of files whose name satisfies match
+func (c *DiskCache) Purge(match func(name string) bool) (blocks int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key, item := range c.items {
+		if match(key.path) {
+			blocks++
+			bytes += item.size
+			c.removeItem(item)
+		}
+	}
+	return blocks, bytes
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// countingObject is an in-memory Object that counts reads reaching storage
+type countingObject struct {
+	*bytes.Reader
+	info  ObjectInfo
+	reads atomic.Int64
+}
+
+func (o *countingObject) ReadAt(p []byte, off int64) (int, error) {
+	o.reads.Add(1)
+	return o.Reader.ReadAt(p, off)
+}
+
+func (o *countingObject) Close() error     { return nil }
+func (o *countingObject) Info() ObjectInfo { return o.info }
+
+func TestDiskCacheEvictionAndRebuild(t *testing.T) {
+	dir := t.TempDir()
+	c, err := openDiskCache(dir, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	block := func(i int) []byte { return bytes.Repeat([]byte{byte('a' + i)}, 100) }
+	key := func(i int) cacheKey {
+		return cacheKey{path: "/videos/a.mp4", etag: `"v1"`, offset: int64(i) * cacheBlockSize}
+	}
+	for i := 0; i < 4; i++ {
+		c.Put(key(i), block(i))
+	}
+
+	if _, ok := c.Get(key(0)); ok {
+		t.Error("least recently used block not evicted")
+	}
+	for i := 1; i < 4; i++ {
+		if data, ok := c.Get(key(i)); !ok || !bytes.Equal(data, block(i)) {
+			t.Errorf("block %d: ok=%v data=%q", i, ok, data)
+		}
+	}
+	if _, ok := c.Get(cacheKey{path: "/videos/a.mp4", etag: `"v2"`, offset: cacheBlockSize}); ok {
+		t.Error("block served for another version of the file")
+	}
+	if stats := c.Stats(); stats.Items != 3 || stats.Size != 300 || stats.Evictions != 1 {
+		t.Errorf("stats = %+v", stats)
+	}
+
+	// Leftovers of interrupted writes and damaged blocks are dropped on reopen
+	tmp := filepath.Join(dir, "tmp-123")
+	os.WriteFile(tmp, []byte("partial"), 0o644)
+	garbage := filepath.Join(dir, "ff", "not-a-block")
+	os.MkdirAll(filepath.Dir(garbage), 0o755)
+	os.WriteFile(garbage, []byte("junk"), 0o644)
+	truncated := c.blockPath(key(1))
+	if err := os.Truncate(truncated, 50); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := openDiskCache(dir, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := reopened.Stats(); stats.Items != 2 || stats.Size != 200 {
+		t.Errorf("rebuilt stats = %+v, want the 2 intact blocks", stats)
+	}
+	for _, path := range []string{tmp, garbage, truncated} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s survived reopen", path)
+		}
+	}
+	if data, ok := reopened.Get(key(3)); !ok || !bytes.Equal(data, block(3)) {
+		t.Errorf("block 3 after reopen: ok=%v", ok)
+	}
+
+	// Shrinking the cache evicts down to the new size
+	reopened.SetMaxSize(100)
+	if stats := reopened.Stats(); stats.Items != 1 || stats.Size != 100 {
+		t.Errorf("stats after SetMaxSize = %+v", stats)
+	}
+}
+
+func TestDiskCacheTier(t *testing.T) {
+	setupStorage(t)
+	config.CacheEnabled = true
+	var err error
+	if diskCache, err = openDiskCache(t.TempDir(), 1<<20); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { diskCache = nil })
+
+	data := make([]byte, 2*cacheBlockSize+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	obj := &countingObject{
+		Reader: bytes.NewReader(data),
+		info:   ObjectInfo{Name: "s3://bucket/video.mp4", Size: int64(len(data)), ETag: `"v1"`},
+	}
+	read := func() []byte {
+		t.Helper()
+		got, err := io.ReadAll(io.NewSectionReader(newCachedFile(obj), 0, int64(len(data))))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+
+	if got := read(); !bytes.Equal(got, data) {
+		t.Fatal("first read returned wrong data")
+	}
+	storageReads := obj.reads.Load()
+
+	// A restart empties the memory tier; the disk tier still has the blocks
+	videoCache = newVideoCache(1 << 20)
+	if got := read(); !bytes.Equal(got, data) {
+		t.Fatal("read through the disk tier returned wrong data")
+	}
+	if obj.reads.Load() != storageReads {
+		t.Errorf("storage read again: %d reads, want %d", obj.reads.Load(), storageReads)
+	}
+	if stats := diskCache.Stats(); stats.Hits != 3 || stats.Items != 3 {
+		t.Errorf("disk cache stats = %+v", stats)
+	}
+
+	rec := adminRequest(t, "GET", "/admin/stats", adminToken(t, "/admin/"), "")
+	var stats struct {
+		Cache     struct{ Items int } `json:"cache"`
+		DiskCache struct{ Items int } `json:"disk_cache"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Cache.Items != 3 || stats.DiskCache.Items != 3 {
+		t.Errorf("/admin/stats tiers = %+v", stats)
+	}
+}
@@ -2,4 +2,9 @@ module playtube-video-server
 
 go 1.21
 
-require github.com/gorilla/mux v1.8.1
+require (
+	github.com/gorilla/mux v1.8.1
+	golang.org/x/net v0.35.0
+)
+
+require golang.org/x/text v0.22.0 // indirect
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Inode numbers are not exposed on this platform; size and mtime still apply
+func fileInode(stat os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// requestIDPattern limits accepted X-Request-ID values to what is safe to
+// echo back and log: UUIDs, hex ids and similar tokens
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// logLevel is the level of the process logger, adjustable on reload
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(level string) (slog.Level, error) {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(level)); err != nil {
+		return lvl, fmt.Errorf("invalid log level %q", level)
+	}
+	return lvl, nil
+}
+
+// Build a logger for the given level and format ("json" or "text")
+func newLogger(w io.Writer, level slog.Leveler, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: level}
+
+	switch strings.ToLower(format) {
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("invalid log format %q", format)
+}
+
+// Return the request id assigned by requestIDMiddleware, or ""
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// Request ID Middleware - accepts the caller's X-Request-ID or assigns one,
+// echoes it on the response and makes it available to later handlers
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)))
+	})
+}
+
+// Logging Middleware - one structured access log entry per request
+func loggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		wrapped := wrapResponseWriter(w)
+		next.ServeHTTP(wrapped, r)
+
+		// A failed write or a cancelled request context means the client
+		// went away before the response was complete
+		aborted := wrapped.writeErr != nil || errors.Is(r.Context().Err(), context.Canceled)
+		// A body that could not be read from storage is our failure, not theirs
+		storageErr := wrapped.readErr
+		if r.Context().Err() != nil {
+			storageErr = nil
+		}
+
+		level := slog.LevelInfo
+		if wrapped.statusCode >= 500 || storageErr != nil {
+			level = slog.LevelError
+		}
+
+		attrs := []slog.Attr{
+			slog.String("request_id", requestID(r.Context())),
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", wrapped.statusCode),
+			slog.Int64("bytes", wrapped.bytes),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("client_ip", clientIP(r).String()),
+			slog.String("user_agent", r.UserAgent()),
+		}
+		if rng := r.Header.Get("Range"); rng != "" {
+			attrs = append(attrs, slog.String("range", rng))
+		}
+		if referer := r.Referer(); referer != "" {
+			attrs = append(attrs, slog.String("referer", referer))
+		}
+		if aborted {
+			attrs = append(attrs, slog.Bool("aborted", true))
+		}
+		if storageErr != nil {
+			attrs = append(attrs, slog.String("storage_error", storageErr.Error()))
+		}
+		logger.LogAttrs(r.Context(), level, "request", attrs...)
+	})
+}
+
+// responseWriter records the status, body bytes and first write error of a
+// response for logging and metrics, and the first error reading its body
+// from storage
+type responseWriter struct {
+	http.ResponseWriter
+	statusCode  int
+	bytes       int64
+	writeErr    error
+	readErr     error
+	wroteHeader bool
+}
+
+// Wrap w, reusing an existing wrapper so stacked middleware share counters
+func wrapResponseWriter(w http.ResponseWriter) *responseWriter {
+	if rw, ok := w.(*responseWriter); ok {
+		return rw
+	}
+	return &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
+}
+
+func (rw *responseWriter) WriteHeader(code int) {
+	if !rw.wroteHeader {
+		rw.statusCode = code
+		rw.wroteHeader = true
+	}
+	rw.ResponseWriter.WriteHeader(code)
+}
+
+func (rw *responseWriter) Write(p []byte) (int, error) {
+	rw.wroteHeader = true
+	n, err := rw.ResponseWriter.Write(p)
+	rw.bytes += int64(n)
+	if err != nil && rw.writeErr == nil {
+		rw.writeErr = err
+	}
+	return n, err
+}
+
+// ReadFrom keeps the sendfile path of the underlying writer reachable
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	rw.wroteHeader = true
+	n, readFailed, err := copyFrom(rw.ResponseWriter, src)
+	rw.bytes += n
+	switch {
+	case err == nil:
+	case readFailed:
+		if rw.readErr == nil {
+			rw.readErr = err
+		}
+	case rw.writeErr == nil:
+		rw.writeErr = err
+	}
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Recovery Middleware
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				logger.Error("panic recovered",
+					"request_id", requestID(r.Context()),
+					"error", fmt.Sprint(err),
+					"stack", string(debug.Stack()))
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			}
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestAccessLog(t *testing.T) {
+	setupStorage(t)
+
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, slog.LevelInfo, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := logger
+	logger = l
+	t.Cleanup(func() { logger = saved })
+
+	tests := []struct {
+		name     string
+		sentID   string
+		wantSame bool
+	}{
+		{"caller id", "laravel-7f3a9c", true},
+		{"missing id", "", false},
+		{"invalid id", "bad id\nwith newline", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf.Reset()
+			req := httptest.NewRequest("GET", "/stream/"+testUUID, nil)
+			req.Header.Set("Range", "bytes=1-3")
+			req.Header.Set("User-Agent", "test-agent")
+			if tt.sentID != "" {
+				req.Header.Set("X-Request-ID", tt.sentID)
+			}
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+
+			var entry map[string]interface{}
+			if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+				t.Fatalf("log line is not JSON: %v\n%s", err, buf.String())
+			}
+
+			id := rec.Header().Get("X-Request-ID")
+			if id == "" || entry["request_id"] != id {
+				t.Errorf("response id %q, logged id %v", id, entry["request_id"])
+			}
+			if (id == tt.sentID) != tt.wantSame {
+				t.Errorf("X-Request-ID = %q, sent %q", id, tt.sentID)
+			}
+
+			if entry["msg"] != "request" || entry["status"] != float64(206) || entry["bytes"] != float64(3) ||
+				entry["range"] != "bytes=1-3" || entry["user_agent"] != "test-agent" || entry["client_ip"] != "192.0.2.1" {
+				t.Errorf("log entry = %v", entry)
+			}
+			if _, ok := entry["aborted"]; ok {
+				t.Errorf("completed request logged as aborted: %v", entry)
+			}
+		})
+	}
+}
+
+func TestStorageReadErrorsAreNotAborts(t *testing.T) {
+	var buf bytes.Buffer
+	l, err := newLogger(&buf, slog.LevelDebug, "json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := logger
+	logger = l
+	t.Cleanup(func() { logger = saved })
+
+	// Storage fails after the first bytes of the body
+	handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := newStreamWriter(w)
+		defer sw.finish(r, "video.mp4")
+		io.Copy(sw, io.MultiReader(strings.NewReader("abc"), iotest.ErrReader(errors.New("origin reset"))))
+	}))
+	before := streamAborts()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stream/"+testUUID, nil))
+
+	entries := map[string]map[string]any{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %v\n%s", err, line)
+		}
+		entries[entry["msg"].(string)] = entry
+	}
+	if e := entries["stream storage read failed"]; e == nil || e["level"] != "ERROR" || e["reason"] != abortStorage {
+		t.Errorf("stream log = %v", e)
+	}
+	if e := entries["request"]; e == nil || e["level"] != "ERROR" || e["storage_error"] != "origin reset" || e["aborted"] != nil {
+		t.Errorf("access log = %v", e)
+	}
+	after := streamAborts()
+	if after[abortStorage] != before[abortStorage]+1 || after[abortClient] != before[abortClient] {
+		t.Errorf("aborts went from %v to %v", before, after)
+	}
+}
+
+func TestNewLoggerRejectsInvalidConfig(t *testing.T) {
+	if _, err := parseLogLevel("verbose"); err == nil {
+		t.Error("accepted invalid level")
+	}
+	if _, err := newLogger(&bytes.Buffer{}, slog.LevelDebug, "xml"); err == nil {
+		t.Error("accepted invalid format")
+	}
+}
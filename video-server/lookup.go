@@ -0,0 +1,215 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"io/fs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Resolving a progressive file tries up to eight names across two stores,
+// and a player sends dozens of range requests per view. LookupCache keeps
+// the outcome per uuid and quality: the file found with its ObjectInfo, or
+// that none exists, for a shorter time. An entry whose file turns out to
+// have changed when it is opened is dropped, and the watcher and admin
+// purges drop entries of changed videos.
+
+// lookupKey names one progressive rendition; quality "" is the default file
+type lookupKey struct {
+	uuid    string
+	quality string
+}
+
+type lookupEntry struct {
+	key     lookupKey
+	file    storedFile // store is nil for a negative entry
+	info    ObjectInfo
+	stats   int // Stat calls the lookup took, saved by every hit
+	expires time.Time
+	element *list.Element
+}
+
+// LookupCache is an LRU of findVideoFile results, bounded by entry count
+type LookupCache struct {
+	mu         sync.Mutex
+	entries    map[lookupKey]*lookupEntry
+	lru        *list.List // front = most recently used
+	maxEntries int
+
+	hits         atomic.Int64
+	negativeHits atomic.Int64
+	misses       atomic.Int64
+	statsSaved   atomic.Int64
+	invalidated  atomic.Int64
+}
+
+// LookupStats is a point-in-time snapshot of lookup cache counters
+type LookupStats struct {
+	Entries      int
+	Hits         int64 // including negative hits
+	NegativeHits int64
+	Misses       int64
+	StatsSaved   int64 // storage Stat calls avoided by hits
+	Invalidated  int64 // entries dropped because their file changed
+}
+
+var videoLookups = newLookupCache(10000)
+
+func newLookupCache(maxEntries int) *LookupCache {
+	return &LookupCache{
+		entries:    make(map[lookupKey]*lookupEntry),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+	}
+}
+
+// Get returns a fresh entry. found is false for a remembered miss.
+func (c *LookupCache) Get(key lookupKey) (file storedFile, found, ok bool) {
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	if ok && time.Now().After(e.expires) {
+		c.remove(e)
+		ok = false
+	}
+	if ok {
+		c.lru.MoveToFront(e.element)
+	}
+	c.mu.Unlock()
+
+	if !ok {
+		c.misses.Add(1)
+		return storedFile{}, false, false
+	}
+	c.hits.Add(1)
+	if e.file.store == nil {
+		c.negativeHits.Add(1)
+	}
+	c.statsSaved.Add(int64(e.stats))
+	return e.file, e.file.store != nil, true
+}
+
+// Put stores a lookup result for ttl, evicting the least recently used entry
+// when full
+func (c *LookupCache) Put(key lookupKey, file storedFile, info ObjectInfo, stats int, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		c.remove(old)
+	}
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back().Value.(*lookupEntry))
+	}
+	e := &lookupEntry{key: key, file: file, info: info, stats: stats, expires: time.Now().Add(ttl)}
+	e.element = c.lru.PushFront(e)
+	c.entries[key] = e
+}
+
+// remove must be called with c.mu held
+func (c *LookupCache) remove(e *lookupEntry) {
+	c.lru.Remove(e.element)
+	delete(c.entries, e.key)
+}
+
+// Verify drops the entry for key if the file opened from it is not the
+// version that was looked up, so the next request resolves it again
+func (c *LookupCache) Verify(key lookupKey, info ObjectInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[key]; ok && e.file.store != nil &&
+		(e.info.ETag != info.ETag || !e.info.ModTime.Equal(info.ModTime)) {
+		c.remove(e)
+		c.invalidated.Add(1)
+	}
+}
+
+// Forget drops the entry for key, reporting whether there was one
+func (c *LookupCache) Forget(key lookupKey) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if ok {
+		c.remove(e)
+	}
+	return ok
+}
+
+// Purge drops the entries of one video, or every entry when uuid is empty
+func (c *LookupCache) Purge(uuid string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, e := range c.entries {
+		if uuid == "" || key.uuid == uuid {
+			c.remove(e)
+			n++
+		}
+	}
+	return n
+}
+
+// PurgeNames drops the entries whose file name satisfies match, and every
+// negative entry, since a matching file may have appeared
+func (c *LookupCache) PurgeNames(match func(name string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, e := range c.entries {
+		if e.file.store == nil || match(e.info.Name) {
+			c.remove(e)
+			n++
+		}
+	}
+	return n
+}
+
+// SetMaxEntries changes the capacity, dropping least recently used entries
+func (c *LookupCache) SetMaxEntries(maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxEntries = maxEntries
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back().Value.(*lookupEntry))
+	}
+}
+
+// Stats returns a snapshot of the lookup cache counters
+func (c *LookupCache) Stats() LookupStats {
+	c.mu.Lock()
+	entries := len(c.entries)
+	c.mu.Unlock()
+
+	return LookupStats{
+		Entries:      entries,
+		Hits:         c.hits.Load(),
+		NegativeHits: c.negativeHits.Load(),
+		Misses:       c.misses.Load(),
+		StatsSaved:   c.statsSaved.Load(),
+		Invalidated:  c.invalidated.Load(),
+	}
+}
+
+// Open the progressive file of uuid and quality. A file that vanished since
+// it was looked up is looked up again once.
+func openVideoFile(ctx context.Context, uuid, quality string) (storedFile, Object, error) {
+	key := lookupKey{uuid, quality}
+	for retried := false; ; retried = true {
+		video, ok := findVideoFile(ctx, uuid, quality)
+		if !ok {
+			return video, nil, fs.ErrNotExist
+		}
+		obj, err := video.store.Open(ctx, video.key)
+		if isNotExist(err) && !retried && videoLookups.Forget(key) {
+			continue
+		}
+		if err != nil {
+			return video, nil, err
+		}
+		videoLookups.Verify(key, obj.Info())
+		return video, obj, nil
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// statCounter counts the Stat calls reaching a store
+type statCounter struct {
+	Storage
+	stats *atomic.Int64
+}
+
+func (s statCounter) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	s.stats.Add(1)
+	return s.Storage.Stat(ctx, key)
+}
+
+func TestVideoLookupCache(t *testing.T) {
+	setupStorage(t)
+	var stats atomic.Int64
+	config.PublicStore = statCounter{config.PublicStore, &stats}
+	config.VideoStore = statCounter{config.VideoStore, &stats}
+	config.LookupTTL, config.LookupNegativeTTL = time.Minute, time.Minute
+	t.Cleanup(func() { config.LookupTTL, config.LookupNegativeTTL = 0, 0 })
+	ctx := context.Background()
+
+	lookup := func(quality string, wantKey string, wantStats int64) {
+		t.Helper()
+		stats.Store(0)
+		video, ok := findVideoFile(ctx, testUUID, quality)
+		if ok != (wantKey != "") || video.key != wantKey {
+			t.Errorf("findVideoFile(%q) = %q, %v, want %q", quality, video.key, ok, wantKey)
+		}
+		if n := stats.Load(); n != wantStats {
+			t.Errorf("findVideoFile(%q) made %d Stat calls, want %d", quality, n, wantStats)
+		}
+	}
+
+	lookup("", testUUID+"/stream.mp4", 1)
+	lookup("", testUUID+"/stream.mp4", 0)
+	// Three names in each of two stores, then remembered as missing
+	lookup("720p", "", 6)
+	lookup("720p", "", 0)
+	if s := videoLookups.Stats(); s.Hits != 2 || s.NegativeHits != 1 || s.Misses != 2 || s.StatsSaved != 7 {
+		t.Errorf("stats = %+v", s)
+	}
+
+	// A file replaced in place is noticed when it is opened
+	stream := filepath.Join(config.PublicBasePath, testUUID, "stream.mp4")
+	if err := os.WriteFile(stream, []byte("re-encoded video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, obj, err := openVideoFile(ctx, testUUID, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Close()
+	if s := videoLookups.Stats(); s.Invalidated != 1 {
+		t.Errorf("replaced file not invalidated: %+v", s)
+	}
+	lookup("", testUUID+"/stream.mp4", 1)
+
+	// A file that vanished is looked up again on open
+	os.Remove(stream)
+	original := filepath.Join(config.PublicBasePath, testUUID, "original.mp4")
+	if err := os.WriteFile(original, []byte("original video"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	video, obj, err := openVideoFile(ctx, testUUID, "")
+	if err != nil || video.key != testUUID+"/original.mp4" {
+		t.Fatalf("openVideoFile after removal = %q, %v", video.key, err)
+	}
+	obj.Close()
+
+	// Purging a video drops its negative entries too
+	if n := videoLookups.Purge(testUUID); n != 2 {
+		t.Errorf("Purge dropped %d entries, want 2", n)
+	}
+	lookup("720p", "", 6)
+}
@@ -2,22 +2,21 @@ package main
 
 import (
 	"context"
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
-	"sync"
 	"syscall"
 	"time"
 
@@ -26,79 +25,185 @@ import (
 
 // Config holds server configuration
 type Config struct {
-	Port            int
-	VideoBasePath   string
-	PublicBasePath  string // Public storage for thumbnails
-	HLSBasePath     string
-	CacheEnabled    bool
-	CacheDuration   time.Duration
-	SignedURLKey    string
-	AllowedOrigins  []string
-	MaxCacheSize    int64 // bytes
-	ChunkSize       int64
-}
-
-// VideoCache implements efficient memory-mapped caching
-type VideoCache struct {
-	mu       sync.RWMutex
-	items    map[string]*CacheItem
-	size     int64
-	maxSize  int64
-	hits     int64
-	misses   int64
-}
-
-type CacheItem struct {
-	data       []byte
-	size       int64
-	accessTime time.Time
-	hitCount   int64
+	ConfigFile             string
+	Port                   int
+	VideoBasePath          string
+	PublicBasePath         string // Public storage for thumbnails
+	HLSBasePath            string
+	StorageDriver          string // local or s3
+	S3Endpoint             string
+	S3Region               string
+	S3Bucket               string
+	S3AccessKey            string
+	S3SecretKey            string
+	S3SessionToken         string
+	S3PathStyle            bool
+	OriginURL              string // upstream server for the origin driver
+	OriginRevalidate       time.Duration
+	ShieldCachePath        string
+	ShieldCacheSize        int64
+	DiskCachePath          string // second cache tier, "" to disable
+	DiskCacheSize          int64
+	PrewarmConcurrency     int // files warmed in parallel per prewarm job
+	LookupCacheSize        int // findVideoFile results kept
+	LookupTTL              time.Duration
+	LookupNegativeTTL      time.Duration // for videos not found
+	WatchMode              string        // auto, poll or off
+	WatchPollInterval      time.Duration
+	VideoStore             Storage
+	PublicStore            Storage
+	HLSStore               Storage
+	CacheEnabled           bool
+	CacheDuration          time.Duration
+	SignedURLKey           string // legacy single secret, kid "default" in the keyring
+	SecretKeys             string // kid:secret keyring spec
+	SigningKeys            []signingKey
+	AdminToken             string // static bearer token for /admin/, "" to disable
+	MetricsToken           string // static bearer token for /metrics, "" to disable
+	AcceptLegacySignatures bool
+	SessionCookie          string
+	TrustedProxySpec       string
+	TrustedProxies         []*net.IPNet
+	HLSTokenTTL            time.Duration
+	AllowedOrigins         []string
+	CORS                   *corsPolicy
+	MaxCacheSize           int64    // bytes
+	RateLimitSpec          []string // group=rate:burst
+	StreamLimitSpec        []string // group=N
+	Limits                 map[string]routeLimits
+	MaxStreams             int      // media requests in flight, 0 for no cap
+	PaceSpec               []string // multiple or quality=multiple
+	Pacing                 pacePolicy
+	PaceBurst              time.Duration // media sent unpaced
+	MaxBandwidth           int64         // bytes per second per progressive response, 0 for no cap
+	WriteIdleTimeout       time.Duration // media responses making no progress are aborted, 0 to wait forever
+	Sendfile               bool          // local ranges not in memory skip the block cache
+	ChunkSize              int64
+	MaxRanges              int    // max ranges accepted in one Range header
+	TLSCert                string // PEM certificate chain, "" to serve plain HTTP
+	TLSKey                 string
+	HTTP2                  bool
+	HTTP2MaxStreams        int    // concurrent streams per HTTP/2 connection
+	LogLevel               string // debug, info, warn or error
+	LogFormat              string // json or text
 }
 
 // Global instances
 var (
 	config     Config
 	videoCache *VideoCache
-	logger     *log.Logger
+	logger     = slog.New(slog.NewJSONHandler(os.Stdout, nil))
 )
 
-func init() {
-	logger = log.New(os.Stdout, "[VIDEO-SERVER] ", log.LstdFlags|log.Lmicroseconds)
-}
-
 func main() {
-	// Parse command line flags
-	flag.IntVar(&config.Port, "port", getEnvInt("VIDEO_SERVER_PORT", 8090), "Server port")
-	flag.StringVar(&config.VideoBasePath, "video-path", getEnv("VIDEO_BASE_PATH", "/workspaces/playtube/storage/app/private/videos"), "Base path for videos")
-	flag.StringVar(&config.PublicBasePath, "public-path", getEnv("PUBLIC_BASE_PATH", "/workspaces/playtube/storage/app/public/videos"), "Base path for public files (thumbnails)")
-	flag.StringVar(&config.HLSBasePath, "hls-path", getEnv("HLS_BASE_PATH", "/workspaces/playtube/storage/app/private/hls"), "Base path for HLS files")
-	flag.StringVar(&config.SignedURLKey, "secret", getEnv("VIDEO_SECRET_KEY", "playtube-video-secret-key-change-in-production"), "Secret key for signed URLs")
-	flag.Int64Var(&config.MaxCacheSize, "cache-size", getEnvInt64("VIDEO_CACHE_SIZE", 1024*1024*1024), "Max cache size in bytes (default 1GB)")
-	flag.Int64Var(&config.ChunkSize, "chunk-size", getEnvInt64("VIDEO_CHUNK_SIZE", 2*1024*1024), "Chunk size for streaming (default 2MB)")
-	flag.BoolVar(&config.CacheEnabled, "cache", getEnvBool("VIDEO_CACHE_ENABLED", true), "Enable caching")
-	flag.Parse()
-
-	// Parse allowed origins
-	originsEnv := getEnv("ALLOWED_ORIGINS", "http://localhost:8000,http://localhost:8080,http://127.0.0.1:8000")
-	config.AllowedOrigins = strings.Split(originsEnv, ",")
-	config.CacheDuration = time.Hour
+	// Load configuration from the config file, environment and flags
+	args := os.Args[1:]
+	cfg, err := loadConfig(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	config = *cfg
+	if err := openStores(&config); err != nil {
+		logger.Error("cannot open storage", "error", err)
+		os.Exit(1)
+	}
+
+	// Configure logging
+	level, _ := parseLogLevel(config.LogLevel)
+	logLevel.Set(level)
+	logger, _ = newLogger(os.Stdout, logLevel, config.LogFormat)
 
 	// Initialize cache
-	videoCache = &VideoCache{
-		items:   make(map[string]*CacheItem),
-		maxSize: config.MaxCacheSize,
+	videoCache = newVideoCache(config.MaxCacheSize)
+	if config.DiskCachePath != "" {
+		if diskCache, err = openDiskCache(config.DiskCachePath, config.DiskCacheSize); err != nil {
+			logger.Error("cannot open disk cache", "error", err)
+			os.Exit(1)
+		}
 	}
-
-	// Start cache cleanup goroutine
-	go videoCache.cleanupLoop()
+	videoLookups = newLookupCache(config.LookupCacheSize)
+	watcher = startWatcher(&config)
 
 	// Create router
+	router := newRouter()
+
+	// Create server with optimized settings
+	server, reloader, err := newServer(&config, router)
+	if err != nil {
+		logger.Error("cannot configure server", "error", err)
+		os.Exit(1)
+	}
+	certs = reloader
+
+	// Optimize Go runtime
+	runtime.GOMAXPROCS(runtime.NumCPU())
+
+	// Graceful shutdown
+	go func() {
+		sigChan := make(chan os.Signal, 1)
+		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+		<-sigChan
+
+		logger.Info("shutting down gracefully")
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	// Reload safe-to-change settings on SIGHUP
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if certs != nil {
+				certs.Reload()
+			}
+			if err := reloadConfig(args); err != nil {
+				logger.Error("configuration reload failed, keeping current settings", "error", err)
+				continue
+			}
+			logger.Info("configuration reloaded")
+		}
+	}()
+
+	logger.Info("go video server starting",
+		"port", config.Port,
+		"storage", config.StorageDriver,
+		"video_path", config.VideoBasePath,
+		"hls_path", config.HLSBasePath,
+		"cache_enabled", config.CacheEnabled,
+		"cache_max_mb", config.MaxCacheSize/(1024*1024),
+		"disk_cache_path", config.DiskCachePath,
+		"tls", certs != nil,
+		"http2", certs != nil && config.HTTP2)
+
+	if certs != nil {
+		err = server.ListenAndServeTLS("", "")
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logger.Error("server error", "error", err)
+		os.Exit(1)
+	}
+}
+
+// Build the router with all middleware and routes
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
 
 	// Middleware
+	router.Use(requestIDMiddleware)
 	router.Use(corsMiddleware)
+	router.Use(metricsMiddleware)
 	router.Use(loggingMiddleware)
 	router.Use(recoveryMiddleware)
+	router.Use(limitMiddleware)
+	router.Use(pathParamsMiddleware)
 
 	// Health check
 	router.HandleFunc("/health", healthHandler).Methods("GET", "HEAD")
@@ -119,122 +224,26 @@ func main() {
 	// Thumbnail endpoint
 	router.HandleFunc("/thumb/{uuid}", thumbnailHandler).Methods("GET", "HEAD", "OPTIONS")
 
-	// Stats endpoint
-	router.HandleFunc("/stats", statsHandler).Methods("GET")
-
-	// Create server with optimized settings
-	server := &http.Server{
-		Addr:              fmt.Sprintf(":%d", config.Port),
-		Handler:           router,
-		ReadTimeout:       30 * time.Second,
-		WriteTimeout:      0, // No write timeout for streaming
-		IdleTimeout:       120 * time.Second,
-		ReadHeaderTimeout: 10 * time.Second,
-		MaxHeaderBytes:    1 << 20, // 1MB
-	}
-
-	// Optimize Go runtime
-	runtime.GOMAXPROCS(runtime.NumCPU())
-
-	// Graceful shutdown
-	go func() {
-		sigChan := make(chan os.Signal, 1)
-		signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-		<-sigChan
-
-		logger.Println("Shutting down gracefully...")
-		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-		defer cancel()
-		server.Shutdown(ctx)
-	}()
-
-	logger.Printf("🚀 Go Video Server starting on port %d", config.Port)
-	logger.Printf("📁 Video path: %s", config.VideoBasePath)
-	logger.Printf("📁 HLS path: %s", config.HLSBasePath)
-	logger.Printf("💾 Cache enabled: %v (max: %d MB)", config.CacheEnabled, config.MaxCacheSize/(1024*1024))
-
-	if err := server.ListenAndServe(); err != http.ErrServerClosed {
-		logger.Fatalf("Server error: %v", err)
-	}
-}
-
-// CORS Middleware
-func corsMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		origin := r.Header.Get("Origin")
-		
-		// In development, allow all origins (GitHub Codespaces, localhost, etc.)
-		// Check if origin matches allowed list or contains github.dev/codespaces patterns
-		allowed := false
-		for _, o := range config.AllowedOrigins {
-			if o == origin || o == "*" {
-				allowed = true
-				break
-			}
-		}
-		
-		// Also allow GitHub Codespaces and common dev patterns
-		if !allowed && origin != "" {
-			if strings.Contains(origin, "github.dev") || 
-			   strings.Contains(origin, "codespaces") ||
-			   strings.Contains(origin, "localhost") ||
-			   strings.Contains(origin, "127.0.0.1") {
-				allowed = true
-			}
-		}
-
-		// Set CORS headers
-		if origin != "" {
-			w.Header().Set("Access-Control-Allow-Origin", origin)
-		} else {
-			w.Header().Set("Access-Control-Allow-Origin", "*")
-		}
-		w.Header().Set("Access-Control-Allow-Credentials", "true")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Range, Accept, Accept-Encoding, Content-Type, Authorization, X-Requested-With")
-		w.Header().Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Accept-Ranges, Content-Type")
-		w.Header().Set("Access-Control-Max-Age", "86400")
-
-		if r.Method == "OPTIONS" {
-			w.WriteHeader(http.StatusNoContent)
-			return
-		}
-
-		next.ServeHTTP(w, r)
-	})
-}
+	// Raw store access for edge instances
+	router.HandleFunc("/origin/{store}", originHandler).Methods("GET")
+	router.HandleFunc("/origin/{store}/{key:.+}", originHandler).Methods("GET", "HEAD")
 
-// Logging Middleware
-func loggingMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		start := time.Now()
-		wrapped := &responseWriter{ResponseWriter: w, statusCode: http.StatusOK}
-		next.ServeHTTP(wrapped, r)
-		logger.Printf("%s %s %d %v %s", r.Method, r.URL.Path, wrapped.statusCode, time.Since(start), r.Header.Get("Range"))
-	})
-}
+	// Admin endpoints
+	router.HandleFunc("/admin/prewarm", requireAdmin(prewarmHandler)).Methods("POST")
+	router.HandleFunc("/admin/prewarm", requireAdmin(prewarmStatusHandler)).Methods("GET")
+	router.HandleFunc("/admin/prewarm/{id}", requireAdmin(prewarmStatusHandler)).Methods("GET")
+	router.HandleFunc("/admin/cache", requireAdmin(cacheListHandler)).Methods("GET")
+	router.HandleFunc("/admin/cache", requireAdmin(cachePurgeHandler)).Methods("DELETE")
+	router.HandleFunc("/admin/cache/{uuid}", requireAdmin(cacheResidencyHandler)).Methods("GET")
+	router.HandleFunc("/admin/stats", requireAdmin(adminStatsHandler)).Methods("GET")
 
-type responseWriter struct {
-	http.ResponseWriter
-	statusCode int
-}
+	// Stats endpoint
+	router.HandleFunc("/stats", statsHandler).Methods("GET")
 
-func (rw *responseWriter) WriteHeader(code int) {
-	rw.statusCode = code
-	rw.ResponseWriter.WriteHeader(code)
-}
+	// Prometheus metrics
+	router.HandleFunc("/metrics", requireMetrics(metricsHandler)).Methods("GET")
 
-// Recovery Middleware
-func recoveryMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if err := recover(); err != nil {
-				logger.Printf("Panic recovered: %v", err)
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			}
-		}()
-		next.ServeHTTP(w, r)
-	})
+	return router
 }
 
 // Health Handler
@@ -248,40 +257,93 @@ func healthHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// Stats Handler
+// Stats Handler - public summary; cache details are in /admin/stats
 func statsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"uptime":        time.Since(startTime).String(),
+		"cache_enabled": currentConfig().CacheEnabled,
+	})
+}
+
+// Admin Stats Handler
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
 
-	videoCache.mu.RLock()
-	cacheHits := videoCache.hits
-	cacheMisses := videoCache.misses
-	cacheSize := videoCache.size
-	cacheItems := len(videoCache.items)
-	videoCache.mu.RUnlock()
-
-	hitRate := float64(0)
-	if cacheHits+cacheMisses > 0 {
-		hitRate = float64(cacheHits) / float64(cacheHits+cacheMisses) * 100
-	}
+	memory := videoCache.Stats()
+	cache := cacheStatsJSON(memory)
+	cache["enabled"] = currentConfig().CacheEnabled
+	cache["coalesced"] = memory.Coalesced
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
-		"uptime":       time.Since(time.Now()).String(),
+	stats := map[string]interface{}{
+		"uptime":       time.Since(startTime).String(),
 		"goroutines":   runtime.NumGoroutine(),
 		"memory_alloc": formatBytes(m.Alloc),
 		"memory_sys":   formatBytes(m.Sys),
 		"gc_runs":      m.NumGC,
-		"cache": map[string]interface{}{
-			"enabled":    config.CacheEnabled,
-			"items":      cacheItems,
-			"size":       formatBytes(uint64(cacheSize)),
-			"max_size":   formatBytes(uint64(config.MaxCacheSize)),
-			"hits":       cacheHits,
-			"misses":     cacheMisses,
-			"hit_rate":   fmt.Sprintf("%.2f%%", hitRate),
-		},
-	})
+		"cache":        cache,
+	}
+	if diskCache != nil {
+		stats["disk_cache"] = cacheStatsJSON(diskCache.Stats())
+	}
+	lookups := videoLookups.Stats()
+	stats["lookup_cache"] = map[string]interface{}{
+		"entries":       lookups.Entries,
+		"hits":          lookups.Hits,
+		"negative_hits": lookups.NegativeHits,
+		"misses":        lookups.Misses,
+		"stats_saved":   lookups.StatsSaved,
+		"invalidated":   lookups.Invalidated,
+	}
+	limited, counts := limitRejections()
+	rejected := make(map[string]int64, len(limited))
+	for i, k := range limited {
+		rejected[k.group+"/"+k.reason] = counts[i]
+	}
+	stats["limits"] = map[string]interface{}{
+		"open_streams": openStreams.Load(),
+		"rejected":     rejected,
+	}
+	if watcher != nil {
+		stats["watcher"] = map[string]interface{}{
+			"mode":          watcher.Mode(),
+			"invalidations": watcher.invalidations.Load(),
+		}
+	}
+	if shieldCache != nil {
+		shield := shieldCache.Stats()
+		stats["shield"] = map[string]interface{}{
+			"items":          shield.Items,
+			"fills":          shield.Fills,
+			"size":           formatBytes(uint64(shield.Size)),
+			"max_size":       formatBytes(uint64(shield.MaxSize)),
+			"hits":           shield.Hits,
+			"misses":         shield.Misses,
+			"coalesced":      shield.Coalesced,
+			"evictions":      shield.Evictions,
+			"upstream_bytes": shield.UpstreamBytes,
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+func cacheStatsJSON(cache CacheStats) map[string]interface{} {
+	hitRate := float64(0)
+	if cache.Hits+cache.Misses > 0 {
+		hitRate = float64(cache.Hits) / float64(cache.Hits+cache.Misses) * 100
+	}
+	return map[string]interface{}{
+		"items":     cache.Items,
+		"size":      formatBytes(uint64(cache.Size)),
+		"max_size":  formatBytes(uint64(cache.MaxSize)),
+		"hits":      cache.Hits,
+		"misses":    cache.Misses,
+		"evictions": cache.Evictions,
+		"hit_rate":  fmt.Sprintf("%.2f%%", hitRate),
+	}
 }
 
 // Stream Handler - Main video streaming with Range support
@@ -295,14 +357,7 @@ func streamHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Find video file
-	videoPath := findVideoFile(uuid, "")
-	if videoPath == "" {
-		http.Error(w, "Video not found", http.StatusNotFound)
-		return
-	}
-
-	serveVideoWithRange(w, r, videoPath)
+	serveVideoWithRange(w, r, uuid, "")
 }
 
 // Stream Quality Handler
@@ -316,13 +371,7 @@ func streamQualityHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	videoPath := findVideoFile(uuid, quality)
-	if videoPath == "" {
-		http.Error(w, "Video not found", http.StatusNotFound)
-		return
-	}
-
-	serveVideoWithRange(w, r, videoPath)
+	serveVideoWithRange(w, r, uuid, quality)
 }
 
 // HLS Master Playlist Handler
@@ -335,8 +384,8 @@ func hlsMasterHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	masterPath := filepath.Join(config.HLSBasePath, uuid, "master.m3u8")
-	if _, err := os.Stat(masterPath); os.IsNotExist(err) {
+	masterKey := uuid + "/master.m3u8"
+	if _, err := config.HLSStore.Stat(r.Context(), masterKey); err != nil {
 		// Generate dynamic master playlist
 		generateMasterPlaylist(w, r, uuid)
 		return
@@ -344,39 +393,45 @@ func hlsMasterHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 	w.Header().Set("Cache-Control", "no-cache")
-	http.ServeFile(w, r, masterPath)
+	servePlaylist(w, r, masterKey, "/hls/"+uuid)
 }
 
 // Generate Dynamic Master Playlist
 func generateMasterPlaylist(w http.ResponseWriter, r *http.Request, uuid string) {
 	baseURL := fmt.Sprintf("/hls/%s", uuid)
 
-	qualities := []struct {
-		name       string
-		bandwidth  int
-		resolution string
-	}{
-		{"360p", 800000, "640x360"},
-		{"480p", 1400000, "854x480"},
-		{"720p", 2500000, "1280x720"},
-		{"1080p", 5000000, "1920x1080"},
-	}
-
 	var playlist strings.Builder
 	playlist.WriteString("#EXTM3U\n")
 	playlist.WriteString("#EXT-X-VERSION:3\n")
 
-	for _, q := range qualities {
-		playlistPath := filepath.Join(config.HLSBasePath, uuid, q.name, "playlist.m3u8")
-		if _, err := os.Stat(playlistPath); err == nil {
-			playlist.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d,RESOLUTION=%s,NAME=\"%s\"\n", q.bandwidth, q.resolution, q.name))
-			playlist.WriteString(fmt.Sprintf("%s/%s/playlist.m3u8\n", baseURL, q.name))
+	for _, quality := range qualityLadder {
+		v, ok := hlsVariantInfo(r.Context(), uuid, quality)
+		if !ok {
+			continue
 		}
+		playlist.WriteString(fmt.Sprintf("#EXT-X-STREAM-INF:BANDWIDTH=%d", v.Bandwidth))
+		if v.AverageBandwidth > 0 {
+			playlist.WriteString(fmt.Sprintf(",AVERAGE-BANDWIDTH=%d", v.AverageBandwidth))
+		}
+		if v.Codecs != "" {
+			playlist.WriteString(fmt.Sprintf(",CODECS=\"%s\"", v.Codecs))
+		}
+		if v.Width > 0 && v.Height > 0 {
+			playlist.WriteString(fmt.Sprintf(",RESOLUTION=%dx%d", v.Width, v.Height))
+		}
+		if v.FrameRate > 0 {
+			playlist.WriteString(fmt.Sprintf(",FRAME-RATE=%.3f", v.FrameRate))
+		}
+		playlist.WriteString(fmt.Sprintf(",NAME=\"%s\"\n", quality))
+		playlist.WriteString(fmt.Sprintf("%s/%s/playlist.m3u8\n", baseURL, quality))
 	}
 
+	// Propagate the caller's token into the variant URIs
+	query, _ := playlistTokenQuery(r, baseURL)
+
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 	w.Header().Set("Cache-Control", "no-cache")
-	w.Write([]byte(playlist.String()))
+	w.Write(rewritePlaylist([]byte(playlist.String()), query))
 }
 
 // HLS Playlist Handler
@@ -390,15 +445,9 @@ func hlsPlaylistHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	playlistPath := filepath.Join(config.HLSBasePath, uuid, quality, "playlist.m3u8")
-	if _, err := os.Stat(playlistPath); os.IsNotExist(err) {
-		http.Error(w, "Playlist not found", http.StatusNotFound)
-		return
-	}
-
 	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
 	w.Header().Set("Cache-Control", "max-age=2")
-	http.ServeFile(w, r, playlistPath)
+	servePlaylist(w, r, uuid+"/"+quality+"/playlist.m3u8", fmt.Sprintf("/hls/%s/%s", uuid, quality))
 }
 
 // HLS Segment Handler
@@ -413,12 +462,6 @@ func hlsSegmentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	segmentPath := filepath.Join(config.HLSBasePath, uuid, quality, segment)
-	if _, err := os.Stat(segmentPath); os.IsNotExist(err) {
-		http.Error(w, "Segment not found", http.StatusNotFound)
-		return
-	}
-
 	// Determine content type
 	contentType := "video/mp2t"
 	if strings.HasSuffix(segment, ".m4s") {
@@ -429,7 +472,7 @@ func hlsSegmentHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Cache-Control", "max-age=31536000") // 1 year for segments
-	http.ServeFile(w, r, segmentPath)
+	serveStoredFile(w, r, config.HLSStore, uuid+"/"+quality+"/"+segment, "Segment not found")
 }
 
 // DASH Manifest Handler
@@ -442,8 +485,8 @@ func dashManifestHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	manifestPath := filepath.Join(config.HLSBasePath, uuid, "manifest.mpd")
-	if _, err := os.Stat(manifestPath); os.IsNotExist(err) {
+	manifestKey := uuid + "/manifest.mpd"
+	if _, err := config.HLSStore.Stat(r.Context(), manifestKey); err != nil {
 		// Generate dynamic DASH manifest
 		generateDashManifest(w, r, uuid)
 		return
@@ -451,13 +494,7 @@ func dashManifestHandler(w http.ResponseWriter, r *http.Request) {
 
 	w.Header().Set("Content-Type", "application/dash+xml")
 	w.Header().Set("Cache-Control", "no-cache")
-	http.ServeFile(w, r, manifestPath)
-}
-
-// Generate Dynamic DASH Manifest
-func generateDashManifest(w http.ResponseWriter, r *http.Request, uuid string) {
-	// For now, return 404 if no static manifest
-	http.Error(w, "DASH manifest not available", http.StatusNotFound)
+	serveStoredFile(w, r, config.HLSStore, manifestKey, "Manifest not found")
 }
 
 // DASH Segment Handler
@@ -472,15 +509,9 @@ func dashSegmentHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	segmentPath := filepath.Join(config.HLSBasePath, uuid, quality, segment)
-	if _, err := os.Stat(segmentPath); os.IsNotExist(err) {
-		http.Error(w, "Segment not found", http.StatusNotFound)
-		return
-	}
-
 	w.Header().Set("Content-Type", "video/iso.segment")
 	w.Header().Set("Cache-Control", "max-age=31536000")
-	http.ServeFile(w, r, segmentPath)
+	serveStoredFile(w, r, config.HLSStore, uuid+"/"+quality+"/"+segment, "Segment not found")
 }
 
 // Thumbnail Handler
@@ -489,21 +520,18 @@ func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 	uuid := vars["uuid"]
 
 	// Check public storage first (where thumbnails are stored)
-	thumbPaths := []string{
-		filepath.Join(config.PublicBasePath, uuid, "thumb.jpg"),
-		filepath.Join(config.PublicBasePath, uuid, "thumbnail.jpg"),
-		filepath.Join(config.VideoBasePath, uuid, "thumb.jpg"),
-		filepath.Join(config.VideoBasePath, uuid, "thumbnail.jpg"),
-	}
-
-	for _, path := range thumbPaths {
-		if _, err := os.Stat(path); err == nil {
-			w.Header().Set("Content-Type", "image/jpeg")
-			w.Header().Set("Cache-Control", "public, max-age=604800, immutable") // 7 days cache
-			w.Header().Set("X-Content-Type-Options", "nosniff")
-			http.ServeFile(w, r, path)
-			return
-		}
+	thumbnail, ok := findStoredFile(r.Context(), []storedFile{
+		{config.PublicStore, uuid + "/thumb.jpg"},
+		{config.PublicStore, uuid + "/thumbnail.jpg"},
+		{config.VideoStore, uuid + "/thumb.jpg"},
+		{config.VideoStore, uuid + "/thumbnail.jpg"},
+	})
+	if ok {
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "public, max-age=604800, immutable") // 7 days cache
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		serveStoredFile(w, r, thumbnail.store, thumbnail.key, "Thumbnail not found")
+		return
 	}
 
 	// Return a 1x1 transparent pixel as fallback (prevents broken image)
@@ -513,29 +541,43 @@ func thumbnailHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Serve video with proper Range support
-func serveVideoWithRange(w http.ResponseWriter, r *http.Request, videoPath string) {
-	file, err := os.Open(videoPath)
-	if err != nil {
-		http.Error(w, "Cannot open video", http.StatusInternalServerError)
+func serveVideoWithRange(w http.ResponseWriter, r *http.Request, uuid, quality string) {
+	video, obj, err := openVideoFile(r.Context(), uuid, quality)
+	if isNotExist(err) {
+		http.Error(w, "Video not found", http.StatusNotFound)
 		return
 	}
-	defer file.Close()
-
-	stat, err := file.Stat()
 	if err != nil {
-		http.Error(w, "Cannot stat video", http.StatusInternalServerError)
+		logger.Error("cannot open video", "request_id", requestID(r.Context()), "key", video.key, "error", err)
+		http.Error(w, "Cannot open video", http.StatusInternalServerError)
 		return
 	}
+	defer obj.Close()
 
-	fileSize := stat.Size()
-	contentType := getContentType(videoPath)
+	sw := newStreamWriter(w)
+	defer sw.finish(r, video.key)
+	w = sw
+
+	info := obj.Info()
+	fileSize := info.Size
+	contentType := getContentType(video.key)
+	cached := newCachedFile(obj)
 
 	w.Header().Set("Content-Type", contentType)
 	w.Header().Set("Accept-Ranges", "bytes")
 	w.Header().Set("Cache-Control", "max-age=31536000")
 
-	// Parse Range header
+	// Conditional requests - answer 304 if the client copy is current
+	etag := info.ETag
+	if checkNotModified(w, r, etag, info.ModTime) {
+		return
+	}
+
+	// Parse Range header, ignoring it if If-Range names another version
 	rangeHeader := r.Header.Get("Range")
+	if rangeHeader != "" && !ifRangeMatches(r, etag, info.ModTime) {
+		rangeHeader = ""
+	}
 	if rangeHeader == "" {
 		// No range requested - HEAD or full file
 		w.Header().Set("Content-Length", strconv.FormatInt(fileSize, 10))
@@ -546,22 +588,37 @@ func serveVideoWithRange(w http.ResponseWriter, r *http.Request, videoPath strin
 		}
 
 		// Stream full file
-		io.Copy(w, file)
+		err := copyRange(pace(w, r, quality, info, cached), cached, 0, fileSize)
+		logReadError(r, sw, video.key, err)
 		return
 	}
 
-	// Parse range
-	start, end, err := parseRange(rangeHeader, fileSize)
+	// Parse range set
+	ranges, err := parseRanges(rangeHeader, fileSize, currentConfig().MaxRanges)
 	if err != nil {
 		w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", fileSize))
 		http.Error(w, "Invalid range", http.StatusRequestedRangeNotSatisfiable)
 		return
 	}
 
+	if len(ranges) > 1 {
+		// Multiple ranges - answer with a multipart/byteranges body
+		body := newMultipartRanges(ranges, contentType, fileSize)
+		w.Header().Set("Content-Type", body.ContentType())
+		w.Header().Set("Content-Length", strconv.FormatInt(body.ContentLength(), 10))
+		w.WriteHeader(http.StatusPartialContent)
+
+		if r.Method != "HEAD" {
+			err := body.WriteTo(pace(w, r, quality, info, cached), cached)
+			logReadError(r, sw, video.key, err)
+		}
+		return
+	}
+
 	// Set response headers for partial content
-	contentLength := end - start + 1
-	w.Header().Set("Content-Length", strconv.FormatInt(contentLength, 10))
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, fileSize))
+	br := ranges[0]
+	w.Header().Set("Content-Length", strconv.FormatInt(br.length, 10))
+	w.Header().Set("Content-Range", br.contentRange(fileSize))
 
 	if r.Method == "HEAD" {
 		w.WriteHeader(http.StatusPartialContent)
@@ -570,131 +627,95 @@ func serveVideoWithRange(w http.ResponseWriter, r *http.Request, videoPath strin
 
 	w.WriteHeader(http.StatusPartialContent)
 
-	// Seek to start position
-	file.Seek(start, io.SeekStart)
-
-	// Stream the requested range using optimized buffer
-	buffer := make([]byte, config.ChunkSize)
-	remaining := contentLength
-
-	for remaining > 0 {
-		toRead := remaining
-		if toRead > config.ChunkSize {
-			toRead = config.ChunkSize
-		}
-
-		n, err := file.Read(buffer[:toRead])
-		if err != nil && err != io.EOF {
-			break
-		}
-
-		if n > 0 {
-			w.Write(buffer[:n])
-			remaining -= int64(n)
-		}
+	err = copyRange(pace(w, r, quality, info, cached), cached, br.start, br.length)
+	logReadError(r, sw, video.key, err)
+}
 
-		if err == io.EOF {
-			break
-		}
+// Wrap w to pace a progressive response when pacing applies to it
+func pace(w io.Writer, r *http.Request, quality string, info ObjectInfo, src io.ReaderAt) io.Writer {
+	if rate, burst := paceFor(r, quality, info, src); rate > 0 {
+		return newPacedWriter(r.Context(), w, rate, burst)
 	}
+	return w
 }
 
-// Find video file by UUID and quality
-func findVideoFile(uuid, quality string) string {
-	var paths []string
-
-	if quality != "" {
-		// Quality-specific paths - check both public and private storage
-		paths = []string{
-			// Public storage (where uploaded videos are)
-			filepath.Join(config.PublicBasePath, uuid, quality+".mp4"),
-			filepath.Join(config.PublicBasePath, uuid, "renditions", quality+".mp4"),
-			filepath.Join(config.PublicBasePath, uuid+"-"+quality+".mp4"),
-			// Private storage
-			filepath.Join(config.VideoBasePath, uuid, quality+".mp4"),
-			filepath.Join(config.VideoBasePath, uuid, "renditions", quality+".mp4"),
-			filepath.Join(config.VideoBasePath, uuid+"-"+quality+".mp4"),
-		}
-	} else {
-		// Default paths (prefer stream-optimized) - check both storages
-		paths = []string{
-			// Public storage first (where most videos are)
-			filepath.Join(config.PublicBasePath, uuid, "stream.mp4"),
-			filepath.Join(config.PublicBasePath, uuid, "original.mp4"),
-			filepath.Join(config.PublicBasePath, uuid+"-stream.mp4"),
-			filepath.Join(config.PublicBasePath, uuid+".mp4"),
-			// Private storage
-			filepath.Join(config.VideoBasePath, uuid, "stream.mp4"),
-			filepath.Join(config.VideoBasePath, uuid, "original.mp4"),
-			filepath.Join(config.VideoBasePath, uuid+"-stream.mp4"),
-			filepath.Join(config.VideoBasePath, uuid+".mp4"),
-		}
+// Log a copy that failed reading storage. Write failures are recorded by the
+// stream writer, and a departed client fails paced writes.
+func logReadError(r *http.Request, sw *streamWriter, key string, err error) {
+	if err != nil && sw.err == nil && r.Context().Err() == nil {
+		logger.Error("cannot read video", "request_id", requestID(r.Context()), "key", key, "error", err)
 	}
+}
 
-	for _, path := range paths {
-		if _, err := os.Stat(path); err == nil {
-			return path
-		}
+// Serve a stored file through the block cache, letting net/http handle Range
+func serveStoredFile(w http.ResponseWriter, r *http.Request, store Storage, key, notFound string) {
+	obj, err := store.Open(r.Context(), key)
+	if isNotExist(err) {
+		http.Error(w, notFound, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		logger.Error("cannot open file", "request_id", requestID(r.Context()), "key", key, "error", err)
+		http.Error(w, "Cannot open file", http.StatusInternalServerError)
+		return
 	}
+	defer obj.Close()
 
-	return ""
+	info := obj.Info()
+	if info.ETag != "" {
+		w.Header().Set("ETag", info.ETag)
+	}
+	sw := newStreamWriter(w)
+	defer sw.finish(r, key)
+	reader := io.NewSectionReader(newCachedFile(obj), 0, info.Size)
+	http.ServeContent(sw, r, path.Base(key), info.ModTime, reader)
 }
 
-// Parse Range header
-func parseRange(rangeHeader string, fileSize int64) (int64, int64, error) {
-	if !strings.HasPrefix(rangeHeader, "bytes=") {
-		return 0, 0, fmt.Errorf("invalid range format")
+// Find video file by UUID and quality
+func findVideoFile(ctx context.Context, uuid, quality string) (storedFile, bool) {
+	if !validUUID(uuid) || (quality != "" && !validQuality(quality)) {
+		return storedFile{}, false
 	}
-
-	rangeSpec := strings.TrimPrefix(rangeHeader, "bytes=")
-	parts := strings.Split(rangeSpec, "-")
-
-	if len(parts) != 2 {
-		return 0, 0, fmt.Errorf("invalid range format")
+	key := lookupKey{uuid, quality}
+	if video, found, ok := videoLookups.Get(key); ok {
+		return video, found
 	}
 
-	var start, end int64
-	var err error
-
-	if parts[0] == "" {
-		// Suffix range: bytes=-500
-		suffix, err := strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			return 0, 0, err
-		}
-		start = fileSize - suffix
-		end = fileSize - 1
-	} else if parts[1] == "" {
-		// Open-ended range: bytes=500-
-		start, err = strconv.ParseInt(parts[0], 10, 64)
-		if err != nil {
-			return 0, 0, err
+	var names []string
+	if quality != "" {
+		// Quality-specific names
+		names = []string{
+			uuid + "/" + quality + ".mp4",
+			uuid + "/renditions/" + quality + ".mp4",
+			uuid + "-" + quality + ".mp4",
 		}
-		end = fileSize - 1
 	} else {
-		// Normal range: bytes=500-999
-		start, err = strconv.ParseInt(parts[0], 10, 64)
-		if err != nil {
-			return 0, 0, err
-		}
-		end, err = strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			return 0, 0, err
+		// Default names (prefer stream-optimized)
+		names = []string{
+			uuid + "/stream.mp4",
+			uuid + "/original.mp4",
+			uuid + "-stream.mp4",
+			uuid + ".mp4",
 		}
 	}
 
-	// Validate range
-	if start < 0 {
-		start = 0
-	}
-	if end >= fileSize {
-		end = fileSize - 1
-	}
-	if start > end {
-		return 0, 0, fmt.Errorf("invalid range: start > end")
+	// Public storage first (where uploaded videos are), then private storage
+	var candidates []storedFile
+	for _, store := range []Storage{config.PublicStore, config.VideoStore} {
+		for _, name := range names {
+			candidates = append(candidates, storedFile{store, name})
+		}
 	}
 
-	return start, end, nil
+	video, info, stats, err := resolveStoredFile(ctx, candidates)
+	// Only a definite miss is remembered, not a storage failure
+	switch {
+	case err == nil:
+		videoLookups.Put(key, video, info, stats, currentConfig().LookupTTL)
+	case isNotExist(err):
+		videoLookups.Put(key, video, info, stats, currentConfig().LookupNegativeTTL)
+	}
+	return video, err == nil
 }
 
 // Get content type from file extension
@@ -714,61 +735,6 @@ func getContentType(path string) string {
 	return "application/octet-stream"
 }
 
-// Validate request (signature check)
-func validateRequest(r *http.Request, uuid string) bool {
-	// In development mode, allow all requests
-	if getEnv("APP_ENV", "local") != "production" {
-		return true
-	}
-
-	// Check for signed URL
-	sig := r.URL.Query().Get("sig")
-	expires := r.URL.Query().Get("expires")
-
-	if sig == "" || expires == "" {
-		return false
-	}
-
-	// Check expiration
-	expTime, err := strconv.ParseInt(expires, 10, 64)
-	if err != nil || time.Now().Unix() > expTime {
-		return false
-	}
-
-	// Verify signature
-	expectedSig := generateSignature(uuid, expires)
-	return hmac.Equal([]byte(sig), []byte(expectedSig))
-}
-
-func generateSignature(uuid, expires string) string {
-	data := fmt.Sprintf("%s:%s", uuid, expires)
-	h := hmac.New(sha256.New, []byte(config.SignedURLKey))
-	h.Write([]byte(data))
-	return hex.EncodeToString(h.Sum(nil))
-}
-
-// Cache methods
-func (c *VideoCache) cleanupLoop() {
-	ticker := time.NewTicker(5 * time.Minute)
-	for range ticker.C {
-		c.cleanup()
-	}
-}
-
-func (c *VideoCache) cleanup() {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
-	now := time.Now()
-	for key, item := range c.items {
-		// Remove items not accessed for 30 minutes
-		if now.Sub(item.accessTime) > 30*time.Minute {
-			c.size -= item.size
-			delete(c.items, key)
-		}
-	}
-}
-
 // Helper functions
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -777,31 +743,6 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if i, err := strconv.Atoi(value); err == nil {
-			return i
-		}
-	}
-	return defaultValue
-}
-
-func getEnvInt64(key string, defaultValue int64) int64 {
-	if value := os.Getenv(key); value != "" {
-		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
-			return i
-		}
-	}
-	return defaultValue
-}
-
-func getEnvBool(key string, defaultValue bool) bool {
-	if value := os.Getenv(key); value != "" {
-		return value == "true" || value == "1"
-	}
-	return defaultValue
-}
-
 func formatBytes(b uint64) string {
 	const unit = 1024
 	if b < unit {
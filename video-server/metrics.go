@@ -0,0 +1,321 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Prometheus text exposition (format 0.0.4) of request, delivery and cache
+// metrics, rendered by hand to keep the server dependency free.
+
+// startTime is the process start, reported as process_start_time_seconds
+var startTime = time.Now()
+
+var (
+	latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 300}
+	sizeBuckets    = []float64{1 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20, 256 << 20, 1 << 30}
+)
+
+// Delivery types reported for bytes served and active streams
+var deliveryTypes = []string{"progressive", "hls", "dash", "thumb", "origin"}
+
+// histogram is a fixed-bucket Prometheus histogram; callers hold Metrics.mu
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // per bucket, not cumulative
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.count++
+	h.sum += v
+}
+
+// requestLabels identifies one request series
+type requestLabels struct {
+	route  string
+	method string
+	code   string
+}
+
+// Metrics collects request and delivery metrics
+type Metrics struct {
+	mu       sync.Mutex
+	requests map[requestLabels]*histogram
+	sizes    map[string]*histogram
+	active   map[string]int64
+}
+
+var metrics = newMetrics()
+
+func newMetrics() *Metrics {
+	m := &Metrics{
+		requests: make(map[requestLabels]*histogram),
+		sizes:    make(map[string]*histogram),
+		active:   make(map[string]int64),
+	}
+	for _, t := range deliveryTypes {
+		m.sizes[t] = newHistogram(sizeBuckets)
+		m.active[t] = 0
+	}
+	return m
+}
+
+// Map a route template to its delivery type, "" for API routes
+func deliveryType(route string) string {
+	switch {
+	case strings.HasPrefix(route, "/stream/"):
+		return "progressive"
+	case strings.HasPrefix(route, "/hls/"):
+		return "hls"
+	case strings.HasPrefix(route, "/dash/"):
+		return "dash"
+	case strings.HasPrefix(route, "/thumb/"):
+		return "thumb"
+	case strings.HasPrefix(route, "/origin/"):
+		return "origin"
+	}
+	return ""
+}
+
+func (m *Metrics) streamStarted(delivery string) {
+	m.mu.Lock()
+	m.active[delivery]++
+	m.mu.Unlock()
+}
+
+func (m *Metrics) streamFinished(delivery string, bytes int64) {
+	m.mu.Lock()
+	m.active[delivery]--
+	m.sizes[delivery].observe(float64(bytes))
+	m.mu.Unlock()
+}
+
+func (m *Metrics) observeRequest(labels requestLabels, duration time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.requests[labels]
+	if !ok {
+		h = newHistogram(latencyBuckets)
+		m.requests[labels] = h
+	}
+	h.observe(duration.Seconds())
+}
+
+// Render writes all metrics in the Prometheus text format
+func (m *Metrics) Render(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	labels := make([]requestLabels, 0, len(m.requests))
+	for l := range m.requests {
+		labels = append(labels, l)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		a, b := labels[i], labels[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	requestSeries := func(l requestLabels) string {
+		return fmt.Sprintf(`route="%s",method="%s",code="%s"`, escapeLabel(l.route), escapeLabel(l.method), l.code)
+	}
+
+	writeHeader(w, "playtube_http_requests_total", "counter", "HTTP requests by route template, method and status code.")
+	for _, l := range labels {
+		fmt.Fprintf(w, "playtube_http_requests_total{%s} %d\n", requestSeries(l), m.requests[l].count)
+	}
+
+	writeHeader(w, "playtube_http_request_duration_seconds", "histogram", "Time to serve a request, including the full body transfer.")
+	for _, l := range labels {
+		writeHistogram(w, "playtube_http_request_duration_seconds", requestSeries(l), m.requests[l])
+	}
+
+	writeHeader(w, "playtube_response_size_bytes", "histogram", "Response body bytes sent per request by delivery type.")
+	for _, t := range deliveryTypes {
+		writeHistogram(w, "playtube_response_size_bytes", fmt.Sprintf(`type="%s"`, t), m.sizes[t])
+	}
+
+	writeHeader(w, "playtube_active_streams", "gauge", "Requests currently being served by delivery type.")
+	for _, t := range deliveryTypes {
+		fmt.Fprintf(w, "playtube_active_streams{type=\"%s\"} %d\n", t, m.active[t])
+	}
+
+	cache := videoCache.Stats()
+	writeHeader(w, "playtube_cache_hits_total", "counter", "Block cache hits.")
+	fmt.Fprintf(w, "playtube_cache_hits_total %d\n", cache.Hits)
+	writeHeader(w, "playtube_cache_misses_total", "counter", "Block cache misses.")
+	fmt.Fprintf(w, "playtube_cache_misses_total %d\n", cache.Misses)
+	writeHeader(w, "playtube_cache_coalesced_total", "counter", "Block cache misses that waited for a read already in flight.")
+	fmt.Fprintf(w, "playtube_cache_coalesced_total %d\n", cache.Coalesced)
+	writeHeader(w, "playtube_cache_evictions_total", "counter", "Block cache evictions.")
+	fmt.Fprintf(w, "playtube_cache_evictions_total %d\n", cache.Evictions)
+	writeHeader(w, "playtube_cache_items", "gauge", "Blocks held in the cache.")
+	fmt.Fprintf(w, "playtube_cache_items %d\n", cache.Items)
+	writeHeader(w, "playtube_cache_size_bytes", "gauge", "Bytes held in the cache.")
+	fmt.Fprintf(w, "playtube_cache_size_bytes %d\n", cache.Size)
+	writeHeader(w, "playtube_cache_max_size_bytes", "gauge", "Configured cache capacity in bytes.")
+	fmt.Fprintf(w, "playtube_cache_max_size_bytes %d\n", cache.MaxSize)
+
+	if diskCache != nil {
+		disk := diskCache.Stats()
+		writeHeader(w, "playtube_disk_cache_hits_total", "counter", "Disk cache hits.")
+		fmt.Fprintf(w, "playtube_disk_cache_hits_total %d\n", disk.Hits)
+		writeHeader(w, "playtube_disk_cache_misses_total", "counter", "Disk cache misses.")
+		fmt.Fprintf(w, "playtube_disk_cache_misses_total %d\n", disk.Misses)
+		writeHeader(w, "playtube_disk_cache_evictions_total", "counter", "Disk cache evictions.")
+		fmt.Fprintf(w, "playtube_disk_cache_evictions_total %d\n", disk.Evictions)
+		writeHeader(w, "playtube_disk_cache_items", "gauge", "Blocks held in the disk cache.")
+		fmt.Fprintf(w, "playtube_disk_cache_items %d\n", disk.Items)
+		writeHeader(w, "playtube_disk_cache_size_bytes", "gauge", "Bytes held in the disk cache.")
+		fmt.Fprintf(w, "playtube_disk_cache_size_bytes %d\n", disk.Size)
+		writeHeader(w, "playtube_disk_cache_max_size_bytes", "gauge", "Configured disk cache capacity in bytes.")
+		fmt.Fprintf(w, "playtube_disk_cache_max_size_bytes %d\n", disk.MaxSize)
+	}
+
+	lookups := videoLookups.Stats()
+	writeHeader(w, "playtube_lookup_cache_hits_total", "counter", "Video file lookups answered from the lookup cache, by outcome.")
+	fmt.Fprintf(w, "playtube_lookup_cache_hits_total{result=\"found\"} %d\n", lookups.Hits-lookups.NegativeHits)
+	fmt.Fprintf(w, "playtube_lookup_cache_hits_total{result=\"missing\"} %d\n", lookups.NegativeHits)
+	writeHeader(w, "playtube_lookup_cache_misses_total", "counter", "Video file lookups that went to storage.")
+	fmt.Fprintf(w, "playtube_lookup_cache_misses_total %d\n", lookups.Misses)
+	writeHeader(w, "playtube_lookup_stat_calls_saved_total", "counter", "Storage Stat calls avoided by lookup cache hits.")
+	fmt.Fprintf(w, "playtube_lookup_stat_calls_saved_total %d\n", lookups.StatsSaved)
+	writeHeader(w, "playtube_lookup_cache_invalidations_total", "counter", "Lookup cache entries dropped because their file changed.")
+	fmt.Fprintf(w, "playtube_lookup_cache_invalidations_total %d\n", lookups.Invalidated)
+	writeHeader(w, "playtube_lookup_cache_entries", "gauge", "Entries held in the lookup cache.")
+	fmt.Fprintf(w, "playtube_lookup_cache_entries %d\n", lookups.Entries)
+
+	if certs != nil {
+		writeHeader(w, "playtube_tls_certificate_expiry_timestamp_seconds", "gauge", "Expiry of the TLS certificate in use.")
+		fmt.Fprintf(w, "playtube_tls_certificate_expiry_timestamp_seconds %d\n", certs.NotAfter().Unix())
+		writeHeader(w, "playtube_tls_certificate_reloads_total", "counter", "TLS certificate reloads, by result.")
+		fmt.Fprintf(w, "playtube_tls_certificate_reloads_total{result=\"ok\"} %d\n", certs.reloads.Load())
+		fmt.Fprintf(w, "playtube_tls_certificate_reloads_total{result=\"error\"} %d\n", certs.failures.Load())
+	}
+	writeHeader(w, "playtube_stream_aborts_total", "counter", "Media responses ended early, by reason: the client went away or stopped reading, or storage failed.")
+	streamAborted := streamAborts()
+	for _, reason := range []string{abortClient, abortStall, abortStorage} {
+		fmt.Fprintf(w, "playtube_stream_aborts_total{reason=%q} %d\n", reason, streamAborted[reason])
+	}
+	writeHeader(w, "playtube_paced_responses_total", "counter", "Progressive responses sent with pacing.")
+	fmt.Fprintf(w, "playtube_paced_responses_total %d\n", pacedResponses.Load())
+	writeHeader(w, "playtube_pacing_delay_seconds_total", "counter", "Time paced responses spent held back.")
+	fmt.Fprintf(w, "playtube_pacing_delay_seconds_total %g\n", time.Duration(pacingDelay.Load()).Seconds())
+	writeHeader(w, "playtube_rate_limited_total", "counter", "Requests rejected by rate and stream limits, by route group and reason.")
+	limited, counts := limitRejections()
+	for i, k := range limited {
+		fmt.Fprintf(w, "playtube_rate_limited_total{group=%q,reason=%q} %d\n", k.group, k.reason, counts[i])
+	}
+
+	if shieldCache != nil {
+		shield := shieldCache.Stats()
+		writeHeader(w, "playtube_shield_hits_total", "counter", "Objects served from the shield cache.")
+		fmt.Fprintf(w, "playtube_shield_hits_total %d\n", shield.Hits)
+		writeHeader(w, "playtube_shield_misses_total", "counter", "Shield misses that started an origin fetch.")
+		fmt.Fprintf(w, "playtube_shield_misses_total %d\n", shield.Misses)
+		writeHeader(w, "playtube_shield_coalesced_total", "counter", "Shield misses that joined a running origin fetch.")
+		fmt.Fprintf(w, "playtube_shield_coalesced_total %d\n", shield.Coalesced)
+		writeHeader(w, "playtube_shield_evictions_total", "counter", "Objects evicted from the shield cache.")
+		fmt.Fprintf(w, "playtube_shield_evictions_total %d\n", shield.Evictions)
+		writeHeader(w, "playtube_shield_upstream_bytes_total", "counter", "Bytes fetched from the origin into the shield cache.")
+		fmt.Fprintf(w, "playtube_shield_upstream_bytes_total %d\n", shield.UpstreamBytes)
+		writeHeader(w, "playtube_shield_size_bytes", "gauge", "Bytes held or reserved in the shield cache.")
+		fmt.Fprintf(w, "playtube_shield_size_bytes %d\n", shield.Size)
+		writeHeader(w, "playtube_shield_max_size_bytes", "gauge", "Configured shield cache capacity in bytes.")
+		fmt.Fprintf(w, "playtube_shield_max_size_bytes %d\n", shield.MaxSize)
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeHeader(w, "process_start_time_seconds", "gauge", "Start time of the process since unix epoch in seconds.")
+	fmt.Fprintf(w, "process_start_time_seconds %s\n", formatFloat(float64(startTime.UnixNano())/1e9))
+	writeHeader(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.")
+	fmt.Fprintf(w, "go_goroutines %d\n", runtime.NumGoroutine())
+	writeHeader(w, "go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.")
+	fmt.Fprintf(w, "go_memstats_alloc_bytes %d\n", mem.Alloc)
+}
+
+func writeHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeHistogram(w io.Writer, name, series string, h *histogram) {
+	var cumulative uint64
+	for i, upper := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, series, formatFloat(upper), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, series, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, series, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, series, h.count)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(v string) string {
+	return labelEscaper.Replace(v)
+}
+
+// Metrics Middleware
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unmatched"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+
+		delivery := deliveryType(route)
+		if delivery != "" {
+			metrics.streamStarted(delivery)
+		}
+
+		start := time.Now()
+		wrapped := wrapResponseWriter(w)
+		defer func() {
+			metrics.observeRequest(requestLabels{
+				route:  route,
+				method: r.Method,
+				code:   strconv.Itoa(wrapped.statusCode),
+			}, time.Since(start))
+			if delivery != "" {
+				metrics.streamFinished(delivery, wrapped.bytes)
+			}
+		}()
+		next.ServeHTTP(wrapped, r)
+	})
+}
+
+// Metrics Handler
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	metrics.Render(w)
+}
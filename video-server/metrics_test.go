@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	setupStorage(t)
+	metrics = newMetrics()
+	router := newRouter()
+
+	for _, path := range []string{
+		"/stream/" + testUUID,
+		"/stream/" + testUUID,
+		"/hls/" + testUUID + "/720p/seg_00001.ts",
+		"/thumb/" + testUUID,
+	} {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+
+	config.MetricsToken = strings.Repeat("m", minAdminTokenLength)
+	t.Cleanup(func() { config.MetricsToken = "" })
+	scrape := func(token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	for _, token := range []string{"", strings.Repeat("x", minAdminTokenLength)} {
+		if rec := scrape(token); rec.Code != http.StatusUnauthorized {
+			t.Errorf("scrape with token %q: status %d, want 401", token, rec.Code)
+		}
+	}
+
+	rec := scrape(config.MetricsToken)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	body := rec.Body.String()
+	want := []string{
+		`playtube_http_requests_total{route="/stream/{uuid}",method="GET",code="200"} 2`,
+		`playtube_http_requests_total{route="/hls/{uuid}/{quality}/{segment}",method="GET",code="200"} 1`,
+		`playtube_http_requests_total{route="/thumb/{uuid}",method="GET",code="404"} 1`,
+		`playtube_http_request_duration_seconds_count{route="/stream/{uuid}",method="GET",code="200"} 2`,
+		`playtube_http_request_duration_seconds_bucket{route="/stream/{uuid}",method="GET",code="200",le="+Inf"} 2`,
+		`playtube_response_size_bytes_sum{type="progressive"} 10`,
+		`playtube_response_size_bytes_count{type="hls"} 1`,
+		`playtube_response_size_bytes_bucket{type="hls",le="1024"} 1`,
+		`playtube_active_streams{type="progressive"} 0`,
+		`playtube_cache_hits_total 0`,
+		`# TYPE playtube_http_request_duration_seconds histogram`,
+		`process_start_time_seconds `,
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics missing %q", line)
+		}
+	}
+	if strings.Contains(body, "process_start_time_seconds 0\n") {
+		t.Error("process start time not set")
+	}
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Minimal ISO BMFF (MP4) reader: just enough of the box tree to describe
+// tracks in an init segment or progressive file and to time fragments.
+
+// maxBoxPayload bounds how much of a single box is read into memory
+const maxBoxPayload = 16 * 1024 * 1024
+
+var errBoxTooLarge = errors.New("mp4 box too large")
+
+type mp4Box struct {
+	typ        string
+	offset     int64 // start of the box header
+	size       int64 // total size including header
+	headerSize int64
+}
+
+func (b mp4Box) payloadOffset() int64 { return b.offset + b.headerSize }
+func (b mp4Box) end() int64           { return b.offset + b.size }
+
+// Read the box header at off. A size of 0 means the box runs to end.
+func readBoxHeader(r io.ReaderAt, off, end int64) (mp4Box, error) {
+	var hdr [16]byte
+	if _, err := r.ReadAt(hdr[:8], off); err != nil {
+		return mp4Box{}, err
+	}
+
+	box := mp4Box{
+		typ:        string(hdr[4:8]),
+		offset:     off,
+		size:       int64(binary.BigEndian.Uint32(hdr[0:4])),
+		headerSize: 8,
+	}
+	switch box.size {
+	case 0:
+		box.size = end - off
+	case 1:
+		if _, err := r.ReadAt(hdr[8:16], off+8); err != nil {
+			return mp4Box{}, err
+		}
+		box.size = int64(binary.BigEndian.Uint64(hdr[8:16]))
+		box.headerSize = 16
+	}
+
+	if box.size < box.headerSize || off+box.size > end {
+		return mp4Box{}, fmt.Errorf("mp4: invalid %q box size %d at %d", box.typ, box.size, off)
+	}
+	return box, nil
+}
+
+// List the boxes between start and end
+func readBoxes(r io.ReaderAt, start, end int64) ([]mp4Box, error) {
+	var boxes []mp4Box
+	for off := start; off+8 <= end; {
+		box, err := readBoxHeader(r, off, end)
+		if err != nil {
+			return boxes, err
+		}
+		boxes = append(boxes, box)
+		off = box.end()
+	}
+	return boxes, nil
+}
+
+func childBoxes(r io.ReaderAt, parent mp4Box) ([]mp4Box, error) {
+	return readBoxes(r, parent.payloadOffset(), parent.end())
+}
+
+// Find the first box matching a path of types below parent
+func findBox(r io.ReaderAt, parent mp4Box, path ...string) (mp4Box, bool) {
+	current := parent
+	for _, typ := range path {
+		children, _ := childBoxes(r, current)
+		found := false
+		for _, child := range children {
+			if child.typ == typ {
+				current, found = child, true
+				break
+			}
+		}
+		if !found {
+			return mp4Box{}, false
+		}
+	}
+	return current, true
+}
+
+func readBoxPayload(r io.ReaderAt, box mp4Box) ([]byte, error) {
+	n := box.size - box.headerSize
+	if n > maxBoxPayload {
+		return nil, errBoxTooLarge
+	}
+	buf := make([]byte, n)
+	if _, err := r.ReadAt(buf, box.payloadOffset()); err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// mp4Track describes one track of a movie
+type mp4Track struct {
+	ID              uint32
+	Handler         string // "vide", "soun", ...
+	Timescale       uint32
+	Duration        uint64 // in Timescale units
+	Codec           string // RFC 6381 codec string, e.g. avc1.64001f
+	Width           int
+	Height          int
+	SampleCount     uint32 // from stts, 0 for fragmented files
+	DefaultDuration uint32 // from mvex/trex, used by fragments without explicit durations
+}
+
+// mp4Info describes a movie from its moov box
+type mp4Info struct {
+	Timescale uint32
+	Duration  uint64 // in Timescale units; 0 for fragmented init segments
+	Tracks    []mp4Track
+}
+
+// DurationSeconds returns the movie duration, falling back to the longest track
+func (m *mp4Info) DurationSeconds() float64 {
+	if m.Duration > 0 && m.Timescale > 0 {
+		return float64(m.Duration) / float64(m.Timescale)
+	}
+	longest := 0.0
+	for _, t := range m.Tracks {
+		if t.Timescale > 0 {
+			if d := float64(t.Duration) / float64(t.Timescale); d > longest {
+				longest = d
+			}
+		}
+	}
+	return longest
+}
+
+// Track returns the first track with the given handler type
+func (m *mp4Info) Track(handler string) (mp4Track, bool) {
+	for _, t := range m.Tracks {
+		if t.Handler == handler {
+			return t, true
+		}
+	}
+	return mp4Track{}, false
+}
+
+// Codecs returns the comma-separated codec list for all audio/video tracks
+func (m *mp4Info) Codecs() string {
+	var codecs []string
+	for _, t := range m.Tracks {
+		if t.Codec != "" && (t.Handler == "vide" || t.Handler == "soun") {
+			codecs = append(codecs, t.Codec)
+		}
+	}
+	return strings.Join(codecs, ",")
+}
+
+// Parse the moov box of an init segment or progressive MP4
+func probeMP4(r io.ReaderAt, size int64) (*mp4Info, error) {
+	top, err := readBoxes(r, 0, size)
+	var moov mp4Box
+	found := false
+	for _, b := range top {
+		if b.typ == "moov" {
+			moov, found = b, true
+			break
+		}
+	}
+	if !found {
+		if err != nil {
+			return nil, err
+		}
+		return nil, errors.New("mp4: no moov box")
+	}
+
+	info := &mp4Info{}
+	if mvhd, ok := findBox(r, moov, "mvhd"); ok {
+		if p, err := readBoxPayload(r, mvhd); err == nil {
+			info.Timescale, info.Duration = parseTimescaleDuration(p)
+		}
+	}
+
+	defaults := make(map[uint32]uint32)
+	if mvex, ok := findBox(r, moov, "mvex"); ok {
+		children, _ := childBoxes(r, mvex)
+		for _, c := range children {
+			if c.typ != "trex" {
+				continue
+			}
+			if p, err := readBoxPayload(r, c); err == nil && len(p) >= 16 {
+				defaults[binary.BigEndian.Uint32(p[4:8])] = binary.BigEndian.Uint32(p[12:16])
+			}
+		}
+	}
+
+	children, _ := childBoxes(r, moov)
+	for _, trak := range children {
+		if trak.typ != "trak" {
+			continue
+		}
+		track := probeTrack(r, trak)
+		track.DefaultDuration = defaults[track.ID]
+		info.Tracks = append(info.Tracks, track)
+	}
+	return info, nil
+}
+
+func probeTrack(r io.ReaderAt, trak mp4Box) mp4Track {
+	var track mp4Track
+
+	if tkhd, ok := findBox(r, trak, "tkhd"); ok {
+		if p, err := readBoxPayload(r, tkhd); err == nil && len(p) > 0 {
+			idOffset := 12 // version 0: flags, creation, modification
+			if p[0] == 1 {
+				idOffset = 20
+			}
+			if len(p) >= idOffset+4 {
+				track.ID = binary.BigEndian.Uint32(p[idOffset:])
+			}
+		}
+	}
+	if mdhd, ok := findBox(r, trak, "mdia", "mdhd"); ok {
+		if p, err := readBoxPayload(r, mdhd); err == nil {
+			track.Timescale, track.Duration = parseTimescaleDuration(p)
+		}
+	}
+	if hdlr, ok := findBox(r, trak, "mdia", "hdlr"); ok {
+		if p, err := readBoxPayload(r, hdlr); err == nil && len(p) >= 12 {
+			track.Handler = string(p[8:12])
+		}
+	}
+	if stts, ok := findBox(r, trak, "mdia", "minf", "stbl", "stts"); ok {
+		if p, err := readBoxPayload(r, stts); err == nil && len(p) >= 8 {
+			entries := binary.BigEndian.Uint32(p[4:8])
+			for i := uint32(0); i < entries && int(8+i*8+8) <= len(p); i++ {
+				track.SampleCount += binary.BigEndian.Uint32(p[8+i*8:])
+			}
+		}
+	}
+	if stsd, ok := findBox(r, trak, "mdia", "minf", "stbl", "stsd"); ok {
+		probeSampleEntry(r, stsd, &track)
+	}
+	return track
+}
+
+// Version 0/1 full box layout shared by mvhd and mdhd
+func parseTimescaleDuration(p []byte) (uint32, uint64) {
+	if len(p) >= 32 && p[0] == 1 {
+		return binary.BigEndian.Uint32(p[20:24]), binary.BigEndian.Uint64(p[24:32])
+	}
+	if len(p) >= 20 {
+		return binary.BigEndian.Uint32(p[12:16]), uint64(binary.BigEndian.Uint32(p[16:20]))
+	}
+	return 0, 0
+}
+
+// Read the first sample entry of an stsd box into track codec fields
+func probeSampleEntry(r io.ReaderAt, stsd mp4Box, track *mp4Track) {
+	// stsd is a full box (4 bytes) with an entry count (4 bytes)
+	entry, err := readBoxHeader(r, stsd.payloadOffset()+8, stsd.end())
+	if err != nil {
+		return
+	}
+	track.Codec = entry.typ
+
+	// Fixed fields before child boxes: 8 bytes common to all sample entries,
+	// then 70 bytes for visual and 20 bytes for audio entries
+	var fixed int64
+	switch entry.typ {
+	case "avc1", "avc3", "hvc1", "hev1", "vp09", "av01":
+		fixed = 78
+		var dims [4]byte
+		if _, err := r.ReadAt(dims[:], entry.payloadOffset()+24); err == nil {
+			track.Width = int(binary.BigEndian.Uint16(dims[0:2]))
+			track.Height = int(binary.BigEndian.Uint16(dims[2:4]))
+		}
+	case "mp4a", "Opus", "ac-3", "ec-3", "fLaC":
+		fixed = 28
+		var version [2]byte
+		if _, err := r.ReadAt(version[:], entry.payloadOffset()+8); err == nil {
+			switch binary.BigEndian.Uint16(version[:]) {
+			case 1:
+				fixed += 16
+			case 2:
+				fixed += 36
+			}
+		}
+	default:
+		return
+	}
+
+	children, _ := readBoxes(r, entry.payloadOffset()+fixed, entry.end())
+	for _, c := range children {
+		p, err := readBoxPayload(r, c)
+		if err != nil {
+			continue
+		}
+		switch c.typ {
+		case "avcC":
+			if len(p) >= 4 {
+				track.Codec = fmt.Sprintf("%s.%02x%02x%02x", entry.typ, p[1], p[2], p[3])
+			}
+		case "hvcC":
+			track.Codec = hevcCodecString(entry.typ, p)
+		case "esds":
+			if oti, aot := parseESDS(p); oti != 0 {
+				track.Codec = fmt.Sprintf("mp4a.%x", oti)
+				if aot != 0 {
+					track.Codec += fmt.Sprintf(".%d", aot)
+				}
+			}
+		}
+	}
+
+	switch entry.typ {
+	case "Opus":
+		track.Codec = "opus"
+	case "fLaC":
+		track.Codec = "flac"
+	}
+}
+
+// Build an RFC 6381 HEVC codec string from an hvcC record
+func hevcCodecString(fourcc string, p []byte) string {
+	if len(p) < 13 {
+		return fourcc
+	}
+	profileSpace := []string{"", "A", "B", "C"}[p[1]>>6]
+	tier := "L"
+	if p[1]&0x20 != 0 {
+		tier = "H"
+	}
+	profile := p[1] & 0x1f
+
+	// Compatibility flags are written in reverse bit order
+	compat := binary.BigEndian.Uint32(p[2:6])
+	var reversed uint32
+	for i := 0; i < 32; i++ {
+		reversed = reversed<<1 | (compat>>i)&1
+	}
+
+	codec := fmt.Sprintf("%s.%s%d.%X.%s%d", fourcc, profileSpace, profile, reversed, tier, p[12])
+
+	// Constraint bytes, trailing zero bytes omitted
+	constraints := p[6:12]
+	last := len(constraints)
+	for last > 0 && constraints[last-1] == 0 {
+		last--
+	}
+	for _, b := range constraints[:last] {
+		codec += fmt.Sprintf(".%X", b)
+	}
+	return codec
+}
+
+// Extract objectTypeIndication and the AAC audio object type from an esds box
+func parseESDS(p []byte) (oti byte, aot byte) {
+	if len(p) < 4 {
+		return 0, 0
+	}
+	desc := p[4:] // skip full box header
+
+	readDescriptor := func(b []byte) (tag byte, body []byte, rest []byte) {
+		if len(b) < 2 {
+			return 0, nil, nil
+		}
+		tag = b[0]
+		size, i := 0, 1
+		for ; i < len(b) && i <= 4; i++ {
+			size = size<<7 | int(b[i]&0x7f)
+			if b[i]&0x80 == 0 {
+				i++
+				break
+			}
+		}
+		if i+size > len(b) {
+			size = len(b) - i
+		}
+		return tag, b[i : i+size], b[i+size:]
+	}
+
+	tag, body, _ := readDescriptor(desc)
+	if tag != 0x03 || len(body) < 3 {
+		return 0, 0
+	}
+	// ES_Descriptor: ES_ID(2), flags(1) and optional fields
+	flags := body[2]
+	body = body[3:]
+	if flags&0x80 != 0 && len(body) >= 2 {
+		body = body[2:]
+	}
+	if flags&0x40 != 0 {
+		// URL_Flag: a length-prefixed URL
+		if len(body) < 1 || 1+int(body[0]) > len(body) {
+			return 0, 0
+		}
+		body = body[1+int(body[0]):]
+	}
+	if flags&0x20 != 0 && len(body) >= 2 {
+		body = body[2:]
+	}
+
+	tag, body, _ = readDescriptor(body)
+	if tag != 0x04 || len(body) < 13 {
+		return 0, 0
+	}
+	oti = body[0]
+
+	tag, dsi, _ := readDescriptor(body[13:])
+	if tag == 0x05 && len(dsi) >= 1 {
+		aot = dsi[0] >> 3
+		if aot == 31 && len(dsi) >= 2 {
+			aot = 32 + ((dsi[0]&0x07)<<3 | dsi[1]>>5)
+		}
+	}
+	return oti, aot
+}
+
+// fragmentTiming is the decode time span of one media segment
+type fragmentTiming struct {
+	Start     uint64
+	Duration  uint64
+	Timescale uint32 // 0 means the track's own timescale
+	Samples   uint32 // samples of the timed track, 0 if unknown
+}
+
+// Time a CMAF/fMP4 media segment from its sidx box, or from the moof's
+// tfdt and trun boxes when there is no sidx
+func probeFragment(r io.ReaderAt, size int64, track mp4Track) (fragmentTiming, error) {
+	boxes, err := readBoxes(r, 0, size)
+	if len(boxes) == 0 && err != nil {
+		return fragmentTiming{}, err
+	}
+
+	var timing fragmentTiming
+	haveStart := false
+	for _, b := range boxes {
+		if b.typ != "moof" {
+			continue
+		}
+		trafs, _ := childBoxes(r, b)
+		for _, traf := range trafs {
+			if traf.typ != "traf" {
+				continue
+			}
+			start, duration, samples, id, ok := parseTRAF(r, traf, track.DefaultDuration)
+			if !ok || (track.ID != 0 && id != track.ID) {
+				continue
+			}
+			if !haveStart {
+				timing.Start, haveStart = start, true
+			}
+			timing.Duration += duration
+			timing.Samples += samples
+		}
+	}
+
+	// sidx timing takes precedence as it accounts for the whole segment
+	for _, b := range boxes {
+		if b.typ == "sidx" {
+			p, err := readBoxPayload(r, b)
+			if err != nil {
+				return fragmentTiming{}, err
+			}
+			if sidx, ok := parseSIDX(p); ok {
+				sidx.Samples = timing.Samples
+				return sidx, nil
+			}
+		}
+	}
+
+	if !haveStart {
+		return fragmentTiming{}, errors.New("mp4: no timing information in segment")
+	}
+	return timing, nil
+}
+
+func parseSIDX(p []byte) (fragmentTiming, bool) {
+	if len(p) < 12 {
+		return fragmentTiming{}, false
+	}
+	timing := fragmentTiming{Timescale: binary.BigEndian.Uint32(p[8:12])}
+	off := 12
+	if p[0] == 0 {
+		if len(p) < off+8 {
+			return fragmentTiming{}, false
+		}
+		timing.Start = uint64(binary.BigEndian.Uint32(p[off:]))
+		off += 8
+	} else {
+		if len(p) < off+16 {
+			return fragmentTiming{}, false
+		}
+		timing.Start = binary.BigEndian.Uint64(p[off:])
+		off += 16
+	}
+	if len(p) < off+4 {
+		return fragmentTiming{}, false
+	}
+	count := int(binary.BigEndian.Uint16(p[off+2:]))
+	off += 4
+	for i := 0; i < count && off+12 <= len(p); i++ {
+		timing.Duration += uint64(binary.BigEndian.Uint32(p[off+4:]))
+		off += 12
+	}
+	return timing, timing.Timescale > 0
+}
+
+// Read baseMediaDecodeTime, the summed sample durations and the sample count of a traf
+func parseTRAF(r io.ReaderAt, traf mp4Box, trexDuration uint32) (start, duration uint64, samples, trackID uint32, ok bool) {
+	children, _ := childBoxes(r, traf)
+	defaultDuration := trexDuration
+	haveTfdt := false
+
+	for _, c := range children {
+		p, err := readBoxPayload(r, c)
+		if err != nil || len(p) < 4 {
+			continue
+		}
+		flags := binary.BigEndian.Uint32(p[0:4]) & 0xffffff
+
+		switch c.typ {
+		case "tfhd":
+			if len(p) < 8 {
+				continue
+			}
+			trackID = binary.BigEndian.Uint32(p[4:8])
+			off := 8
+			if flags&0x01 != 0 {
+				off += 8
+			}
+			if flags&0x02 != 0 {
+				off += 4
+			}
+			if flags&0x08 != 0 && len(p) >= off+4 {
+				defaultDuration = binary.BigEndian.Uint32(p[off:])
+			}
+		case "tfdt":
+			if p[0] == 1 && len(p) >= 12 {
+				start = binary.BigEndian.Uint64(p[4:12])
+			} else if len(p) >= 8 {
+				start = uint64(binary.BigEndian.Uint32(p[4:8]))
+			}
+			haveTfdt = true
+		}
+	}
+
+	// trun may follow tfhd in any order, so sum durations in a second pass
+	for _, c := range children {
+		if c.typ != "trun" {
+			continue
+		}
+		p, err := readBoxPayload(r, c)
+		if err != nil || len(p) < 8 {
+			continue
+		}
+		flags := binary.BigEndian.Uint32(p[0:4]) & 0xffffff
+		count := binary.BigEndian.Uint32(p[4:8])
+		samples += count
+		off := 8
+		if flags&0x01 != 0 {
+			off += 4
+		}
+		if flags&0x04 != 0 {
+			off += 4
+		}
+
+		if flags&0x100 == 0 {
+			duration += uint64(count) * uint64(defaultDuration)
+			continue
+		}
+
+		stride := 0
+		for _, bit := range []uint32{0x100, 0x200, 0x400, 0x800} {
+			if flags&bit != 0 {
+				stride += 4
+			}
+		}
+		for i := uint32(0); i < count && off+4 <= len(p); i++ {
+			duration += uint64(binary.BigEndian.Uint32(p[off:]))
+			off += stride
+		}
+	}
+
+	return start, duration, samples, trackID, haveTfdt
+}
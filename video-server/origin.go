@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Every instance exposes its stores under /origin/{store}/{key} so that edge
+// instances running the origin storage driver can pull from it. Requests
+// carry a v2 token scoped to /origin/, minted from the shared keyring.
+
+// originTokenTTL bounds the tokens an edge sends upstream
+const originTokenTTL = 5 * time.Minute
+
+// Most objects in one listing page. A page cut short carries
+// X-List-Truncated, and the next one starts after its last key.
+const originListLimit = 1000
+
+// Origin Handler - raw stored files and listings for edge instances
+func originHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if _, err := verifyToken(token, r); err != nil {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	vars := mux.Vars(r)
+	store := originStores()[vars["store"]]
+	if store == nil {
+		http.Error(w, "Unknown store", http.StatusNotFound)
+		return
+	}
+
+	key, ok := vars["key"]
+	if !ok {
+		originList(w, r, store)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	serveStoredFile(w, r, store, key, "Not found")
+}
+
+// List one page of a store, in key order: up to limit objects (at most
+// originListLimit) under prefix whose key sorts after after
+func originList(w http.ResponseWriter, r *http.Request, store Storage) {
+	query := r.URL.Query()
+	limit := originListLimit
+	if v := query.Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(n, originListLimit)
+	}
+
+	infos, err := store.List(r.Context(), query.Get("prefix"))
+	if isNotExist(err) {
+		infos, err = nil, nil
+	}
+	if err != nil {
+		http.Error(w, "Cannot list store", http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	after := query.Get("after")
+	infos = infos[sort.Search(len(infos), func(i int) bool { return infos[i].Key > after }):]
+	if len(infos) > limit {
+		infos = infos[:limit]
+		w.Header().Set("X-List-Truncated", "true")
+	}
+
+	listing := make([]originListEntry, 0, len(infos))
+	for _, info := range infos {
+		listing = append(listing, originListEntry{info.Key, info.Size, info.ModTime, info.ETag})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(listing)
+}
+
+func originStores() map[string]Storage {
+	return map[string]Storage{
+		"videos": config.VideoStore,
+		"public": config.PublicStore,
+		"hls":    config.HLSStore,
+	}
+}
+
+// originListEntry is one object in an origin store listing
+type originListEntry struct {
+	Key     string    `json:"key"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	ETag    string    `json:"etag"`
+}
+
+// originClient talks to the /origin/ endpoints of an upstream instance
+type originClient struct {
+	base *url.URL
+	http *http.Client
+}
+
+func newOriginClient(origin string) (*originClient, error) {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid origin URL %q", origin)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 64
+	transport.ResponseHeaderTimeout = 30 * time.Second
+	transport.DisableCompression = true // sizes and ranges refer to stored bytes
+	return &originClient{base: u, http: &http.Client{Transport: transport}}, nil
+}
+
+// originError is a non-2xx answer from the origin
+type originError struct {
+	Status int
+	URL    string
+}
+
+func (e *originError) Error() string {
+	return fmt.Sprintf("origin: %s: HTTP %d", e.URL, e.Status)
+}
+
+func (e *originError) Unwrap() error {
+	if e.Status == http.StatusNotFound {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+// Send an authenticated request for path below /origin/
+func (c *originClient) do(ctx context.Context, method, path string, query url.Values, header http.Header) (*http.Response, error) {
+	u := *c.base
+	u.Path += "/origin/" + path
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	token, err := signToken(tokenClaims{Path: "/origin/", Expires: time.Now().Add(originTokenTTL).Unix()})
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if id := requestID(ctx); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &originError{Status: resp.StatusCode, URL: u.Redacted()}
+	}
+	return resp, nil
+}
+
+// originStorage is one store of an upstream instance
+type originStorage struct {
+	client *originClient
+	store  string // videos, public or hls
+}
+
+func (s *originStorage) name(key string) string {
+	return s.client.base.String() + "/origin/" + s.store + "/" + key
+}
+
+func (s *originStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if _, err := splitKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := s.client.do(ctx, "HEAD", s.store+"/"+key, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("origin: %s: invalid Content-Length", key)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{
+		Key:     key,
+		Name:    s.name(key),
+		Size:    size,
+		ModTime: modTime,
+		ETag:    resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (s *originStorage) Open(ctx context.Context, key string) (Object, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return s.object(ctx, info), nil
+}
+
+// Read one object version through range requests
+func (s *originStorage) object(ctx context.Context, info ObjectInfo) Object {
+	return &rangedObject{info: info, fetch: func(off, length int64) (io.ReadCloser, error) {
+		return s.fetch(ctx, info, off, length)
+	}}
+}
+
+// List the objects under the directory prefix, following listing pages
+func (s *originStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	var infos []ObjectInfo
+	after := ""
+	for {
+		resp, err := s.client.do(ctx, "GET", s.store, url.Values{"prefix": {prefix}, "after": {after}}, nil)
+		if err != nil {
+			return nil, err
+		}
+		var listing []originListEntry
+		err = json.NewDecoder(resp.Body).Decode(&listing)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("origin: list %s: %w", s.store, err)
+		}
+
+		for _, e := range listing {
+			infos = append(infos, ObjectInfo{Key: e.Key, Name: s.name(e.Key), Size: e.Size, ModTime: e.ModTime, ETag: e.ETag})
+		}
+		if resp.Header.Get("X-List-Truncated") == "" || len(listing) == 0 {
+			return infos, nil
+		}
+		after = listing[len(listing)-1].Key
+	}
+}
+
+// Fetch length bytes of one object version from off. If-Match pins the
+// version seen by Stat, so a replaced object fails instead of mixing.
+func (s *originStorage) fetch(ctx context.Context, info ObjectInfo, off, length int64) (io.ReadCloser, error) {
+	header := http.Header{}
+	if info.ETag != "" {
+		header.Set("If-Match", info.ETag)
+	}
+	partial := off > 0 || length < info.Size
+	if partial {
+		header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+length-1))
+	}
+
+	resp, err := s.client.do(ctx, "GET", s.store+"/"+info.Key, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	if partial && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("origin: %s: range read answered with HTTP %d", info.Key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
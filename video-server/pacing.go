@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progressive responses go out as fast as the socket takes them, so a viewer
+// who leaves after ten seconds may already have downloaded the whole file.
+// A paced response sends the first pace-burst of media at full speed and is
+// then throttled to a multiple of the file's average bitrate, taken from its
+// size and the duration in its mvhd box. max-bandwidth caps the rate of a
+// connection whether or not the bitrate is known. A token carrying pace or bw
+// claims is paced by those alone, so it can lift the configured limits as
+// well as tighten them.
+
+// pacePolicy holds the bitrate multiples of the pace setting
+type pacePolicy struct {
+	Default   float64            // every quality, 0 for unpaced
+	Qualities map[string]float64 // named qualities, overriding Default
+}
+
+// Parse pace entries: a bare multiple applies to every quality,
+// quality=multiple to one
+func parsePacePolicy(entries []string) (pacePolicy, error) {
+	policy := pacePolicy{Qualities: make(map[string]float64)}
+	for _, entry := range entries {
+		quality, value, named := strings.Cut(entry, "=")
+		if !named {
+			quality, value = "", entry
+		}
+		multiple, err := strconv.ParseFloat(value, 64)
+		if err != nil || multiple < 0 || multiple > 1000 {
+			return pacePolicy{}, fmt.Errorf("pace: %q: invalid bitrate multiple %q", entry, value)
+		}
+		if !named {
+			policy.Default = multiple
+			continue
+		}
+		if !validQuality(quality) {
+			return pacePolicy{}, fmt.Errorf("pace: %q: invalid quality %q", entry, quality)
+		}
+		policy.Qualities[quality] = multiple
+	}
+	return policy, nil
+}
+
+func (p pacePolicy) multiple(quality string) float64 {
+	if m, ok := p.Qualities[quality]; ok {
+		return m
+	}
+	return p.Default
+}
+
+// Durations of probed files by version; 0 when the file has none
+var (
+	durationsMu sync.Mutex
+	durations   = make(map[fileKey]time.Duration)
+)
+
+// Bound on remembered durations; the map is cleared when it fills up
+const maxDurations = 10000
+
+// Pacing counters for metrics
+var (
+	pacedResponses atomic.Int64
+	pacingDelay    atomic.Int64 // nanoseconds spent waiting
+)
+
+// mediaDuration returns the mvhd duration of a progressive file
+func mediaDuration(info ObjectInfo, src io.ReaderAt) time.Duration {
+	key := fileKey{info.Name, info.ETag}
+	durationsMu.Lock()
+	d, ok := durations[key]
+	durationsMu.Unlock()
+	if ok {
+		return d
+	}
+
+	if mp4, err := probeMP4(src, info.Size); err == nil && mp4.Timescale > 0 {
+		d = time.Duration(float64(mp4.Duration) / float64(mp4.Timescale) * float64(time.Second))
+	}
+	durationsMu.Lock()
+	if len(durations) >= maxDurations {
+		clear(durations)
+	}
+	durations[key] = d
+	durationsMu.Unlock()
+	return d
+}
+
+// paceFor returns the rate in bytes per second and the unpaced burst in bytes
+// for a progressive response, or a zero rate when it is not paced
+func paceFor(r *http.Request, quality string, info ObjectInfo, src io.ReaderAt) (rate float64, burst int64) {
+	cfg := currentConfig()
+	multiple, bandwidth := cfg.Pacing.multiple(quality), float64(cfg.MaxBandwidth)
+	if claims := requestClaims(r); claims != nil && (claims.Pace > 0 || claims.Bandwidth > 0) {
+		multiple, bandwidth = claims.Pace, float64(claims.Bandwidth)
+	}
+	if multiple <= 0 && bandwidth <= 0 {
+		return 0, 0
+	}
+
+	var bitrate float64 // bytes per second of media
+	if multiple > 0 {
+		if d := mediaDuration(info, src); d > 0 {
+			bitrate = float64(info.Size) / d.Seconds()
+			rate = multiple * bitrate
+		}
+	}
+	if bandwidth > 0 && (rate == 0 || bandwidth < rate) {
+		rate = bandwidth
+	}
+	if rate == 0 {
+		return 0, 0
+	}
+	if bitrate == 0 {
+		bitrate = rate
+	}
+	return rate, int64(cfg.PaceBurst.Seconds() * bitrate)
+}
+
+// pacedWriter holds writes back so that no more than burst bytes plus rate
+// bytes per second since start have been written
+type pacedWriter struct {
+	w       io.Writer
+	ctx     context.Context
+	rate    float64
+	burst   int64
+	step    int // largest write, so the pace stays smooth
+	start   time.Time
+	written int64
+}
+
+func newPacedWriter(ctx context.Context, w io.Writer, rate float64, burst int64) *pacedWriter {
+	pacedResponses.Add(1)
+	return &pacedWriter{w: w, ctx: ctx, rate: rate, burst: burst, step: max(int(rate/10), 32*1024), start: time.Now()}
+}
+
+func (p *pacedWriter) Write(b []byte) (int, error) {
+	n := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), p.step)]
+		ahead := float64(p.written+int64(len(chunk))-p.burst) - p.rate*time.Since(p.start).Seconds()
+		if ahead > 0 {
+			wait := time.Duration(ahead / p.rate * float64(time.Second))
+			timer := time.NewTimer(wait)
+			select {
+			case <-p.ctx.Done():
+				timer.Stop()
+				return n, p.ctx.Err()
+			case <-timer.C:
+			}
+			pacingDelay.Add(int64(wait))
+		}
+
+		m, err := p.w.Write(chunk)
+		n += m
+		p.written += int64(m)
+		if err != nil {
+			return n, err
+		}
+		b = b[m:]
+	}
+	return n, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParsePacePolicy(t *testing.T) {
+	policy, err := parsePacePolicy([]string{"1.5", "1080p=1.25", "144p=0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for quality, want := range map[string]float64{"": 1.5, "720p": 1.5, "1080p": 1.25, "144p": 0} {
+		if got := policy.multiple(quality); got != want {
+			t.Errorf("multiple(%q) = %v, want %v", quality, got, want)
+		}
+	}
+
+	for _, entry := range []string{"fast", "-1", "720p=", "4k=2"} {
+		if _, err := parsePacePolicy([]string{entry}); err == nil {
+			t.Errorf("parsePacePolicy(%q) accepted", entry)
+		}
+	}
+}
+
+// Write a progressive MP4 of size bytes whose mvhd lasts seconds
+func writeTestMP4(t *testing.T, path string, seconds uint32, size int) []byte {
+	t.Helper()
+	moov := box("moov", box("mvhd", u32(0), u32(0), u32(0), u32(1000), u32(seconds*1000), make([]byte, 80)))
+	header := append(box("ftyp", []byte("isom"), u32(0)), moov...)
+	data := append(header, box("mdat", bytes.Repeat([]byte{0x55}, size-len(header)-8))...)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestPacedStream(t *testing.T) {
+	setupStorage(t)
+	// 100 KB over 10s is 10 KB/s of media
+	data := writeTestMP4(t, filepath.Join(config.PublicBasePath, testUUID, "stream.mp4"), 10, 100_000)
+	config.PaceBurst = time.Second
+	config.MaxBandwidth = 0
+	t.Cleanup(func() { config.Pacing, config.PaceBurst, config.MaxBandwidth = pacePolicy{}, 0, 0 })
+
+	get := func(token string) (*httptest.ResponseRecorder, time.Duration) {
+		req := httptest.NewRequest("GET", "/stream/"+testUUID+"?token="+token, nil)
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		newRouter().ServeHTTP(rec, req)
+		return rec, time.Since(start)
+	}
+
+	// Unpaced
+	if rec, _ := get(""); !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatal("unpaced body differs from the file")
+	}
+
+	// 40x the bitrate sends the 90 KB after the burst in about 225ms
+	config.Pacing = pacePolicy{Default: 40}
+	rec, elapsed := get("")
+	if !bytes.Equal(rec.Body.Bytes(), data) {
+		t.Fatal("paced body differs from the file")
+	}
+	if elapsed < 150*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("paced response took %v, want about 225ms", elapsed)
+	}
+
+	// A token's bandwidth replaces the configured pace
+	var err error
+	if config.SigningKeys, err = parseKeyring("k1:pace-secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	token, err := signToken(tokenClaims{Path: "/stream/", Bandwidth: 1 << 30, Expires: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, elapsed := get(token); elapsed > 100*time.Millisecond {
+		t.Errorf("response with a 1 GB/s token took %v", elapsed)
+	}
+}
+
+func TestPacedWriterStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var out bytes.Buffer
+	w := newPacedWriter(ctx, &out, 1000, 0)
+	time.AfterFunc(20*time.Millisecond, cancel)
+
+	n, err := w.Write(make([]byte, 10_000))
+	if err != context.Canceled {
+		t.Errorf("Write error = %v, want context.Canceled", err)
+	}
+	if n != out.Len() || n > 1000 {
+		t.Errorf("wrote %d bytes (buffer %d) before the cancel", n, out.Len())
+	}
+}
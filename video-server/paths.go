@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+)
+
+var (
+	errInvalidPathParam = errors.New("invalid path parameter")
+	errOutsideRoot      = errors.New("path resolves outside storage roots")
+)
+
+var (
+	uuidPattern    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	segmentPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{0,127}\.(ts|m4s|mp4|m4a|aac|vtt|key)$`)
+)
+
+// qualityLadder lists every rendition name the encoding jobs can produce
+var qualityLadder = []string{"144p", "240p", "360p", "480p", "720p", "1080p", "1440p", "2160p"}
+
+func validUUID(s string) bool {
+	return uuidPattern.MatchString(s)
+}
+
+func validQuality(s string) bool {
+	for _, q := range qualityLadder {
+		if s == q {
+			return true
+		}
+	}
+	return false
+}
+
+func validSegment(s string) bool {
+	return segmentPattern.MatchString(s)
+}
+
+// Check every known route variable against its grammar
+func validateRouteVars(vars map[string]string) error {
+	if v, ok := vars["uuid"]; ok && !validUUID(v) {
+		return errInvalidPathParam
+	}
+	if v, ok := vars["quality"]; ok && !validQuality(v) {
+		return errInvalidPathParam
+	}
+	if v, ok := vars["segment"]; ok && !validSegment(v) {
+		return errInvalidPathParam
+	}
+	if v, ok := vars["key"]; ok {
+		if _, err := splitKey(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Path Params Middleware - rejects malformed route variables before any handler
+// builds a filesystem path from them
+func pathParamsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := validateRouteVars(mux.Vars(r)); err != nil {
+			http.Error(w, "Invalid request", http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Join elems under root and resolve symlinks, refusing any result that does not
+// live under one of the configured storage roots. The returned path is the
+// fully resolved one, so it is safe to open even if a symlink changes later.
+func resolvePath(root string, elems ...string) (string, error) {
+	for _, e := range elems {
+		if !validPathElem(e) {
+			return "", errInvalidPathParam
+		}
+	}
+
+	realRoot, err := resolveRoot(root)
+	if err != nil {
+		return "", err
+	}
+
+	joined := filepath.Join(append([]string{realRoot}, elems...)...)
+	if !withinRoot(realRoot, joined) {
+		return "", errOutsideRoot
+	}
+
+	real, err := filepath.EvalSymlinks(joined)
+	if err != nil {
+		return "", err
+	}
+	if !withinStorageRoots(real) {
+		return "", errOutsideRoot
+	}
+	return real, nil
+}
+
+// Storage roots with symlinks resolved, by configured path. The base paths
+// only change with a restart, so each root is resolved once rather than on
+// every request; a root that does not exist yet is tried again next time.
+var resolvedRoots sync.Map
+
+func resolveRoot(root string) (string, error) {
+	if real, ok := resolvedRoots.Load(root); ok {
+		return real.(string), nil
+	}
+	real, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	resolvedRoots.Store(root, real)
+	return real, nil
+}
+
+// Resolve a path and confirm it is a regular file
+func resolveFile(root string, elems ...string) (string, os.FileInfo, error) {
+	path, err := resolvePath(root, elems...)
+	if err != nil {
+		return "", nil, err
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		return "", nil, os.ErrNotExist
+	}
+	return path, stat, nil
+}
+
+// A path element must name something inside its parent directory
+func validPathElem(e string) bool {
+	return e != "" && e != "." && e != ".." && !strings.ContainsAny(e, "/\\\x00")
+}
+
+func withinStorageRoots(path string) bool {
+	for _, root := range []string{config.PublicBasePath, config.VideoBasePath, config.HLSBasePath} {
+		if root == "" {
+			continue
+		}
+		realRoot, err := resolveRoot(root)
+		if err != nil {
+			continue
+		}
+		if withinRoot(realRoot, path) {
+			return true
+		}
+	}
+	return false
+}
+
+func withinRoot(root, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil || filepath.IsAbs(rel) {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uriAttrPattern matches the URI attribute of EXT-X-KEY, EXT-X-MAP,
+// EXT-X-MEDIA, EXT-X-I-FRAME-STREAM-INF and EXT-X-SESSION-KEY tags
+var uriAttrPattern = regexp.MustCompile(`URI="([^"]*)"`)
+
+// Append query to every URI in an HLS playlist: variant and segment lines as
+// well as URI attributes on tags (keys, init segments, alternate renditions)
+func rewritePlaylist(content []byte, query string) []byte {
+	lines := strings.Split(string(content), "\n")
+	for i, line := range lines {
+		trimmed := strings.TrimRight(line, "\r")
+		switch {
+		case trimmed == "":
+			continue
+		case strings.HasPrefix(trimmed, "#"):
+			if strings.Contains(trimmed, `URI="`) {
+				lines[i] = uriAttrPattern.ReplaceAllStringFunc(line, func(attr string) string {
+					uri := attr[len(`URI="`) : len(attr)-1]
+					return `URI="` + appendQuery(uri, query) + `"`
+				})
+			}
+		default:
+			lines[i] = appendQuery(trimmed, query) + line[len(trimmed):]
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
+
+// Append query to a playlist URI. Absolute URIs point at other hosts and data:
+// URIs carry their content inline, so neither gets the token.
+func appendQuery(uri, query string) string {
+	if query == "" {
+		return uri
+	}
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return uri
+	}
+
+	sep := "?"
+	if strings.Contains(uri, "?") {
+		sep = "&"
+	}
+	if hash := strings.Index(uri, "#"); hash >= 0 {
+		return uri[:hash] + sep + query + uri[hash:]
+	}
+	return uri + sep + query
+}
+
+// Work out the query string to propagate into a playlist covering scope. A v2
+// token that already covers scope is passed through; a narrower one is
+// exchanged for a short-lived token scoped to the playlist's directory tree
+// with the same client bindings. Legacy signatures cover the whole video and
+// are passed through. Returns "" when the request carried no credentials.
+func playlistTokenQuery(r *http.Request, scope string) (string, time.Time) {
+	q := r.URL.Query()
+
+	if token := q.Get("token"); token != "" {
+		claims, err := verifyToken(token, r)
+		if err != nil {
+			return "", time.Time{}
+		}
+		if pathCovered(claims.Path, scope) {
+			return "token=" + url.QueryEscape(token), time.Unix(claims.Expires, 0)
+		}
+
+		// Bucket the issue time so repeated requests derive the same token and
+		// the rewritten playlist stays cacheable
+		expires := time.Now().Truncate(time.Minute).Add(currentConfig().HLSTokenTTL).Unix()
+		if claims.Expires < expires {
+			expires = claims.Expires
+		}
+		derived, err := signToken(tokenClaims{
+			Expires: expires,
+			Path:    scope,
+			IP:      claims.IP,
+			Session: claims.Session,
+		})
+		if err != nil {
+			return "", time.Time{}
+		}
+		return "token=" + url.QueryEscape(derived), time.Unix(expires, 0)
+	}
+
+	sig, expires := q.Get("sig"), q.Get("expires")
+	if sig == "" || expires == "" {
+		return "", time.Time{}
+	}
+	expTime, _ := strconv.ParseInt(expires, 10, 64)
+	return "expires=" + url.QueryEscape(expires) + "&sig=" + url.QueryEscape(sig), time.Unix(expTime, 0)
+}
+
+// Serve an HLS playlist from HLS storage, rewriting its URIs to carry the
+// caller's token. Rewritten playlists are cached per file version and token.
+func servePlaylist(w http.ResponseWriter, r *http.Request, key, scope string) {
+	query, expires := playlistTokenQuery(r, scope)
+	if query == "" {
+		serveStoredFile(w, r, config.HLSStore, key, "Playlist not found")
+		return
+	}
+
+	obj, err := config.HLSStore.Open(r.Context(), key)
+	if err != nil {
+		http.Error(w, "Playlist not found", http.StatusNotFound)
+		return
+	}
+	defer obj.Close()
+	info := obj.Info()
+
+	cacheKey := playlistKey{path: info.Name, etag: info.ETag, query: query}
+	data, ok := rewrittenPlaylists.Get(cacheKey)
+	if !ok {
+		content, err := io.ReadAll(io.NewSectionReader(obj, 0, info.Size))
+		if err != nil {
+			http.Error(w, "Cannot read playlist", http.StatusInternalServerError)
+			return
+		}
+		data = rewritePlaylist(content, query)
+		rewrittenPlaylists.Put(cacheKey, data, expires)
+	}
+
+	http.ServeContent(w, r, path.Base(key), info.ModTime, bytes.NewReader(data))
+}
+
+// playlistKey identifies one rewritten version of one playlist file
+type playlistKey struct {
+	path  string
+	etag  string
+	query string
+}
+
+type playlistEntry struct {
+	key     playlistKey
+	data    []byte
+	expires time.Time
+}
+
+// PlaylistCache is a small LRU of rewritten playlists, bounded by entry count
+// and total bytes. Every viewer with a session-bound token adds its own
+// entries, so long VOD playlists would otherwise add up. Entries expire
+// together with the token they embed.
+type PlaylistCache struct {
+	mu         sync.Mutex
+	entries    map[playlistKey]*list.Element
+	lru        *list.List
+	maxEntries int
+	maxBytes   int64
+	size       int64
+}
+
+var rewrittenPlaylists = newPlaylistCache(4096, 32<<20)
+
+func newPlaylistCache(maxEntries int, maxBytes int64) *PlaylistCache {
+	return &PlaylistCache{
+		entries:    make(map[playlistKey]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+	}
+}
+
+// remove must be called with c.mu held
+func (c *PlaylistCache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*playlistEntry)
+	delete(c.entries, entry.key)
+	c.size -= int64(len(entry.data))
+}
+
+func (c *PlaylistCache) Get(key playlistKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*playlistEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(el)
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return entry.data, true
+}
+
+func (c *PlaylistCache) Put(key playlistKey, data []byte, expires time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.remove(el)
+	}
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+	for c.lru.Len() > 0 && (c.lru.Len() >= c.maxEntries || c.size+size > c.maxBytes) {
+		c.remove(c.lru.Back())
+	}
+	c.entries[key] = c.lru.PushFront(&playlistEntry{key: key, data: data, expires: expires})
+	c.size += size
+}
+
+// Purge drops the rewritten versions of playlists whose name satisfies match
+func (c *PlaylistCache) Purge(match func(name string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		if match(key.path) {
+			c.remove(el)
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRewritePlaylist(t *testing.T) {
+	in := strings.Join([]string{
+		"#EXTM3U",
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin",IV=0x1`,
+		`#EXT-X-MAP:URI="init.mp4"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",URI="https://cdn.example/audio.m3u8"`,
+		`#EXT-X-SESSION-KEY:METHOD=AES-128,URI="data:text/plain;base64,AAAA"`,
+		"#EXTINF:6.0,",
+		"seg_00001.ts\r",
+		"#EXTINF:6.0,",
+		"seg_00002.ts?part=1",
+		"seg_00003.ts#t=2",
+		"//cdn.example/seg_00004.ts",
+		"",
+	}, "\n")
+	want := strings.Join([]string{
+		"#EXTM3U",
+		`#EXT-X-KEY:METHOD=AES-128,URI="key.bin?token=abc",IV=0x1`,
+		`#EXT-X-MAP:URI="init.mp4?token=abc"`,
+		`#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",URI="https://cdn.example/audio.m3u8"`,
+		`#EXT-X-SESSION-KEY:METHOD=AES-128,URI="data:text/plain;base64,AAAA"`,
+		"#EXTINF:6.0,",
+		"seg_00001.ts?token=abc\r",
+		"#EXTINF:6.0,",
+		"seg_00002.ts?part=1&token=abc",
+		"seg_00003.ts?token=abc#t=2",
+		"//cdn.example/seg_00004.ts",
+		"",
+	}, "\n")
+	if got := string(rewritePlaylist([]byte(in), "token=abc")); got != want {
+		t.Errorf("rewritePlaylist:\n%s\nwant:\n%s", got, want)
+	}
+	if got := string(rewritePlaylist([]byte(in), "")); got != in {
+		t.Errorf("rewritePlaylist without a query changed the playlist:\n%s", got)
+	}
+}
+
+func TestPlaylistTokenQuery(t *testing.T) {
+	var err error
+	if config.SigningKeys, err = parseKeyring("k1:playlist-secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	defer func(ttl time.Duration) { config.HLSTokenTTL = ttl }(config.HLSTokenTTL)
+	config.HLSTokenTTL = 10 * time.Minute
+	scope := "/hls/" + testUUID
+
+	tokenRequest := func(path string, claims tokenClaims) (string, time.Time) {
+		t.Helper()
+		token, err := signToken(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest("GET", path+"?token="+url.QueryEscape(token), nil)
+		req.Header.Set("X-Playtube-Session", "viewer-1")
+		query, expires := playlistTokenQuery(req, scope)
+		if claims.Path == scope && query != "token="+url.QueryEscape(token) {
+			t.Errorf("covering token not passed through: %q", query)
+		}
+		return query, expires
+	}
+	// The claims of a derived token, checked on a request inside scope
+	derived := func(query string) *tokenClaims {
+		t.Helper()
+		values, err := url.ParseQuery(query)
+		if err != nil || values.Get("token") == "" {
+			t.Fatalf("query %q carries no token", query)
+		}
+		req := httptest.NewRequest("GET", scope+"/720p/seg_00001.ts", nil)
+		req.Header.Set("X-Playtube-Session", "viewer-1")
+		claims, err := verifyToken(values.Get("token"), req)
+		if err != nil {
+			t.Fatalf("derived token rejected: %v", err)
+		}
+		return claims
+	}
+
+	// A token for the whole video is passed through with its expiry
+	exp := time.Now().Add(time.Hour).Unix()
+	if _, expires := tokenRequest(scope+"/master.m3u8", tokenClaims{Path: scope, Expires: exp}); expires.Unix() != exp {
+		t.Errorf("expires = %v, want the token's", expires)
+	}
+
+	// A token for the master playlist alone is exchanged for one covering
+	// the video, keeping the session binding
+	query, expires := tokenRequest(scope+"/master.m3u8", tokenClaims{Path: scope + "/master.m3u8", Session: "viewer-1", Expires: exp})
+	claims := derived(query)
+	if claims.Path != scope || claims.Session != "viewer-1" {
+		t.Errorf("derived claims = %+v", claims)
+	}
+	if ttl := time.Until(expires); ttl > config.HLSTokenTTL || ttl < config.HLSTokenTTL-time.Minute-time.Second {
+		t.Errorf("derived token lives %s, want about %s", ttl, config.HLSTokenTTL)
+	}
+	if claims.Expires != expires.Unix() {
+		t.Errorf("claims expire at %d, query at %d", claims.Expires, expires.Unix())
+	}
+
+	// A derived token never outlives its parent
+	soon := time.Now().Add(2 * time.Minute).Unix()
+	query, expires = tokenRequest(scope+"/master.m3u8", tokenClaims{Path: scope + "/master.m3u8", Session: "viewer-1", Expires: soon})
+	if claims := derived(query); claims.Expires != soon || expires.Unix() != soon {
+		t.Errorf("derived token expires at %d (query %d), want the parent's %d", claims.Expires, expires.Unix(), soon)
+	}
+
+	// Invalid tokens and requests without credentials propagate nothing;
+	// legacy signatures are passed through
+	for _, tt := range []struct{ target, want string }{
+		{scope + "/master.m3u8?token=v2.bogus.token", ""},
+		{scope + "/master.m3u8", ""},
+		{scope + "/master.m3u8?expires=123&sig=abc", "expires=123&sig=abc"},
+	} {
+		if got, _ := playlistTokenQuery(httptest.NewRequest("GET", tt.target, nil), scope); got != tt.want {
+			t.Errorf("playlistTokenQuery(%s) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestPlaylistCacheBytes(t *testing.T) {
+	c := newPlaylistCache(100, 25)
+	expires := time.Now().Add(time.Minute)
+	key := func(query string) playlistKey { return playlistKey{path: "/hls/a.m3u8", etag: "e1", query: query} }
+	for _, q := range []string{"a", "b", "c"} {
+		c.Put(key(q), make([]byte, 10), expires)
+	}
+	// Three 10-byte playlists do not fit in 25 bytes; the oldest goes
+	if _, ok := c.Get(key("a")); ok {
+		t.Error("oldest playlist kept past the byte limit")
+	}
+	for _, q := range []string{"b", "c"} {
+		if _, ok := c.Get(key(q)); !ok {
+			t.Errorf("playlist %s evicted", q)
+		}
+	}
+	c.Put(key("big"), make([]byte, 30), expires)
+	if _, ok := c.Get(key("big")); ok || c.size != 20 {
+		t.Errorf("playlist larger than the cache kept; %d bytes cached", c.size)
+	}
+	if n := c.Purge(func(string) bool { return true }); n != 2 || c.size != 0 {
+		t.Errorf("Purge dropped %d entries, %d bytes left", n, c.size)
+	}
+}
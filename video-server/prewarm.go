@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Pre-warming loads the start of newly published or trending videos into the
+// cache before the first viewer asks: the moov atom and first megabytes of
+// each progressive rendition, and the first segments of each HLS rendition.
+// Jobs run in the background; their progress is polled by id. At most
+// maxRunningPrewarmJobs run at once, and each reads at most a quarter of the
+// cache, so prewarming never flushes what viewers are watching.
+
+// Limits on one prewarm request
+const (
+	maxPrewarmUUIDs     = 500
+	maxPrewarmSegments  = 100
+	maxPrewarmMegabytes = 256
+
+	defaultPrewarmSegments  = 3
+	defaultPrewarmMegabytes = 4
+
+	// Finished jobs kept for status queries
+	maxPrewarmJobs = 100
+	// Jobs running at once; more are refused until one finishes
+	maxRunningPrewarmJobs = 2
+	// Share of the cache one job may fill
+	prewarmBudgetFraction = 4
+)
+
+// prewarmRequest is the body of POST /admin/prewarm
+type prewarmRequest struct {
+	UUIDs     []string `json:"uuids"`
+	Qualities []string `json:"qualities"` // default: the default file plus every quality
+	Segments  *int     `json:"segments"`  // HLS segments per rendition
+	Megabytes *int     `json:"megabytes"` // bytes per progressive rendition, in MB
+}
+
+// prewarmTask warms one rendition of one video
+type prewarmTask struct {
+	uuid    string
+	quality string // "" for the default progressive file
+	hls     bool
+}
+
+// prewarmStatus is the progress of one job as reported by the status endpoint
+type prewarmStatus struct {
+	ID        string     `json:"id"`
+	State     string     `json:"state"` // running or done
+	Created   time.Time  `json:"created"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Tasks     int        `json:"tasks"`
+	Completed int        `json:"completed"`
+	Warmed    int        `json:"warmed"`  // files read into the cache
+	Missing   int        `json:"missing"` // renditions that do not exist
+	Failed    int        `json:"failed"`
+	Skipped   int        `json:"skipped"` // tasks left once the budget ran out
+	Bytes     int64      `json:"bytes"`
+	Budget    int64      `json:"budget"`           // bytes the job may read
+	Errors    []string   `json:"errors,omitempty"` // first few failures
+}
+
+// prewarmJob is one prewarm request
+type prewarmJob struct {
+	segments int   // HLS segments per rendition
+	bytes    int64 // bytes per progressive rendition
+
+	mu       sync.Mutex
+	status   prewarmStatus
+	reserved int64 // bytes claimed against the budget
+	spent    bool  // a claim failed; the remaining tasks are skipped
+}
+
+var (
+	prewarmMu   sync.Mutex
+	prewarmJobs = make(map[string]*prewarmJob)
+)
+
+// Prewarm Handler - start a background prewarm job
+func prewarmHandler(w http.ResponseWriter, r *http.Request) {
+	if !currentConfig().CacheEnabled && shieldCache == nil {
+		http.Error(w, "Caching is disabled", http.StatusConflict)
+		return
+	}
+
+	var req prewarmRequest
+	body := http.MaxBytesReader(w, r.Body, 1<<20)
+	if err := json.NewDecoder(body).Decode(&req); err != nil {
+		http.Error(w, "Invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	tasks, err := req.tasks()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	job := &prewarmJob{
+		segments: defaultPrewarmSegments,
+		bytes:    defaultPrewarmMegabytes << 20,
+		status: prewarmStatus{
+			ID:      newRequestID(),
+			State:   "running",
+			Created: time.Now().UTC(),
+			Tasks:   len(tasks),
+			Budget:  prewarmBudget(),
+		},
+	}
+	if req.Segments != nil {
+		job.segments = *req.Segments
+	}
+	if req.Megabytes != nil {
+		job.bytes = int64(*req.Megabytes) << 20
+	}
+	if !addPrewarmJob(job) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, fmt.Sprintf("%d prewarm jobs are already running", maxRunningPrewarmJobs), http.StatusTooManyRequests)
+		return
+	}
+	go job.run(tasks, currentConfig().PrewarmConcurrency)
+
+	logger.Info("prewarm started", "request_id", requestID(r.Context()), "job", job.status.ID,
+		"videos", len(req.UUIDs), "tasks", len(tasks))
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/admin/prewarm/"+job.status.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// Prewarm Status Handler - progress of one job, or of every kept job
+func prewarmStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	id, ok := mux.Vars(r)["id"]
+	if !ok {
+		prewarmMu.Lock()
+		jobs := make([]*prewarmJob, 0, len(prewarmJobs))
+		for _, job := range prewarmJobs {
+			jobs = append(jobs, job)
+		}
+		prewarmMu.Unlock()
+
+		list := make([]prewarmStatus, 0, len(jobs))
+		for _, job := range jobs {
+			list = append(list, job.snapshot())
+		}
+		sort.Slice(list, func(i, j int) bool { return list[i].Created.After(list[j].Created) })
+		json.NewEncoder(w).Encode(list)
+		return
+	}
+
+	prewarmMu.Lock()
+	job := prewarmJobs[id]
+	prewarmMu.Unlock()
+	if job == nil {
+		http.Error(w, "Unknown job", http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(job.snapshot())
+}
+
+// Validate a request and expand it into one task per video and rendition
+func (req *prewarmRequest) tasks() ([]prewarmTask, error) {
+	if len(req.UUIDs) == 0 || len(req.UUIDs) > maxPrewarmUUIDs {
+		return nil, fmt.Errorf("uuids: between 1 and %d required", maxPrewarmUUIDs)
+	}
+	for _, uuid := range req.UUIDs {
+		if !validUUID(uuid) {
+			return nil, fmt.Errorf("uuids: invalid uuid %q", uuid)
+		}
+	}
+	for _, q := range req.Qualities {
+		if !validQuality(q) {
+			return nil, fmt.Errorf("qualities: invalid quality %q", q)
+		}
+	}
+	if req.Segments != nil && (*req.Segments < 0 || *req.Segments > maxPrewarmSegments) {
+		return nil, fmt.Errorf("segments: must be between 0 and %d", maxPrewarmSegments)
+	}
+	if req.Megabytes != nil && (*req.Megabytes < 0 || *req.Megabytes > maxPrewarmMegabytes) {
+		return nil, fmt.Errorf("megabytes: must be between 0 and %d", maxPrewarmMegabytes)
+	}
+
+	qualities := req.Qualities
+	if len(qualities) == 0 {
+		qualities = append([]string{""}, qualityLadder...)
+	}
+	var tasks []prewarmTask
+	for _, uuid := range req.UUIDs {
+		for _, q := range qualities {
+			tasks = append(tasks, prewarmTask{uuid: uuid, quality: q})
+			if q != "" {
+				tasks = append(tasks, prewarmTask{uuid: uuid, quality: q, hls: true})
+			}
+		}
+	}
+	return tasks, nil
+}
+
+// The bytes one job may read: a share of the memory cache, or of the
+// shield when only the shield caches
+func prewarmBudget() int64 {
+	cfg := currentConfig()
+	if cfg.CacheEnabled {
+		return cfg.MaxCacheSize / prewarmBudgetFraction
+	}
+	return cfg.ShieldCacheSize / prewarmBudgetFraction
+}
+
+// Register a job, dropping the oldest finished jobs beyond maxPrewarmJobs.
+// It reports false, registering nothing, while maxRunningPrewarmJobs run.
+func addPrewarmJob(job *prewarmJob) bool {
+	prewarmMu.Lock()
+	defer prewarmMu.Unlock()
+	running := 0
+	for _, j := range prewarmJobs {
+		if j.snapshot().State == "running" {
+			running++
+		}
+	}
+	if running >= maxRunningPrewarmJobs {
+		return false
+	}
+	prewarmJobs[job.status.ID] = job
+
+	for len(prewarmJobs) > maxPrewarmJobs {
+		var oldest *prewarmStatus
+		for _, j := range prewarmJobs {
+			s := j.snapshot()
+			if s.State == "done" && (oldest == nil || s.Created.Before(oldest.Created)) {
+				oldest = &s
+			}
+		}
+		if oldest == nil {
+			return true
+		}
+		delete(prewarmJobs, oldest.ID)
+	}
+	return true
+}
+
+// snapshot returns a copy of the job's progress
+func (job *prewarmJob) snapshot() prewarmStatus {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	status := job.status
+	status.Errors = append([]string(nil), status.Errors...)
+	return status
+}
+
+// run works through the tasks with at most workers in parallel. Jobs are
+// not tied to the request that started them.
+func (job *prewarmJob) run(tasks []prewarmTask, workers int) {
+	ctx := context.Background()
+	queue := make(chan prewarmTask)
+	var wg sync.WaitGroup
+	for i := 0; i < min(workers, len(tasks)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for task := range queue {
+				job.finishTask(task, job.warm(ctx, task))
+			}
+		}()
+	}
+	for _, task := range tasks {
+		queue <- task
+	}
+	close(queue)
+	wg.Wait()
+
+	job.mu.Lock()
+	now := time.Now().UTC()
+	job.status.State, job.status.Finished = "done", &now
+	job.mu.Unlock()
+
+	status := job.snapshot()
+	logger.Info("prewarm finished", "job", status.ID, "warmed", status.Warmed, "missing", status.Missing,
+		"failed", status.Failed, "skipped", status.Skipped, "bytes", status.Bytes)
+}
+
+// prewarmResult is what one task did
+type prewarmResult struct {
+	files int
+	bytes int64
+	err   error
+}
+
+var (
+	errPrewarmMissing = errors.New("rendition not found")
+	errPrewarmBudget  = errors.New("prewarm budget used up")
+)
+
+// reserve claims n bytes of the job's budget. Once a claim would overrun
+// it, every later claim fails too.
+func (job *prewarmJob) reserve(n int64) bool {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	if job.spent || job.reserved+n > job.status.Budget {
+		job.spent = true
+		return false
+	}
+	job.reserved += n
+	return true
+}
+
+func (job *prewarmJob) finishTask(task prewarmTask, res prewarmResult) {
+	job.mu.Lock()
+	defer job.mu.Unlock()
+	status := &job.status
+	status.Completed++
+	status.Warmed += res.files
+	status.Bytes += res.bytes
+	switch {
+	case errors.Is(res.err, errPrewarmMissing):
+		status.Missing++
+	case errors.Is(res.err, errPrewarmBudget):
+		status.Skipped++
+	case res.err != nil:
+		status.Failed++
+		if len(status.Errors) < 10 {
+			kind := "progressive"
+			if task.hls {
+				kind = "hls"
+			}
+			status.Errors = append(status.Errors, fmt.Sprintf("%s %s %s: %v", task.uuid, task.quality, kind, res.err))
+		}
+	}
+}
+
+func (job *prewarmJob) warm(ctx context.Context, task prewarmTask) prewarmResult {
+	if !job.reserve(0) {
+		return prewarmResult{err: errPrewarmBudget}
+	}
+	if task.hls {
+		return job.warmHLS(ctx, task.uuid, task.quality)
+	}
+	return job.warmProgressive(ctx, task.uuid, task.quality)
+}
+
+// Warm the moov atom and the first bytes of a progressive file. The moov is
+// what every player reads first, wherever it sits in the file.
+func (job *prewarmJob) warmProgressive(ctx context.Context, uuid, quality string) prewarmResult {
+	video, ok := findVideoFile(ctx, uuid, quality)
+	if !ok {
+		return prewarmResult{err: errPrewarmMissing}
+	}
+	obj, err := video.store.Open(ctx, video.key)
+	if err != nil {
+		return prewarmResult{err: err}
+	}
+	defer obj.Close()
+
+	file := newCachedFile(obj)
+	size := obj.Info().Size
+	var read int64
+	if boxes, err := readBoxes(file, 0, size); err == nil {
+		for _, b := range boxes {
+			if b.typ == "moov" {
+				if !job.reserve(b.size) {
+					return prewarmResult{err: errPrewarmBudget}
+				}
+				n, err := io.Copy(io.Discard, io.NewSectionReader(file, b.offset, b.size))
+				read += n
+				if err != nil {
+					return prewarmResult{bytes: read, err: err}
+				}
+			}
+		}
+	}
+	head := min(job.bytes, size)
+	if !job.reserve(head) {
+		return prewarmResult{files: 1, bytes: read, err: errPrewarmBudget}
+	}
+	n, err := io.Copy(io.Discard, io.NewSectionReader(file, 0, head))
+	read += n
+	return prewarmResult{files: 1, bytes: read, err: err}
+}
+
+// Warm a media playlist, its init segment and its first segments
+func (job *prewarmJob) warmHLS(ctx context.Context, uuid, quality string) prewarmResult {
+	dir := uuid + "/" + quality + "/"
+	playlist, err := readHLSMediaPlaylist(ctx, dir+"playlist.m3u8")
+	if isNotExist(err) {
+		return prewarmResult{err: errPrewarmMissing}
+	}
+	if err != nil {
+		return prewarmResult{err: err}
+	}
+
+	keys := []string{dir + "playlist.m3u8"}
+	if playlist.Init != "" && validSegment(playlist.Init) {
+		keys = append(keys, dir+playlist.Init)
+	}
+	for _, s := range playlist.Segments[:min(job.segments, len(playlist.Segments))] {
+		if validSegment(s) {
+			keys = append(keys, dir+s)
+		}
+	}
+
+	var res prewarmResult
+	for _, key := range keys {
+		n, err := job.warmFile(ctx, config.HLSStore, key)
+		res.bytes += n
+		if err != nil {
+			res.err = err
+			return res
+		}
+		res.files++
+	}
+	return res
+}
+
+// Read a whole stored file through the cache if it fits in the budget
+func (job *prewarmJob) warmFile(ctx context.Context, store Storage, key string) (int64, error) {
+	obj, err := store.Open(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Close()
+	if !job.reserve(obj.Info().Size) {
+		return 0, errPrewarmBudget
+	}
+	return warmObject(obj)
+}
+
+// Read a whole stored file through the cache
+func warmStoredFile(ctx context.Context, store Storage, key string) (int64, error) {
+	obj, err := store.Open(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	defer obj.Close()
+	return warmObject(obj)
+}
+
+func warmObject(obj Object) (int64, error) {
+	return io.Copy(io.Discard, io.NewSectionReader(newCachedFile(obj), 0, obj.Info().Size))
+}
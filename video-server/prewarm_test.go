@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminToken(t *testing.T, path string) string {
+	t.Helper()
+	var err error
+	if config.SigningKeys, err = parseKeyring("k1:admin-secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	token, err := signToken(tokenClaims{Path: path, Expires: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func adminRequest(t *testing.T, method, path, token, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	return rec
+}
+
+// Report whether the block at offset of a stored file is in the memory cache
+func blockCached(t *testing.T, store Storage, key string, offset int64) bool {
+	t.Helper()
+	info, err := store.Stat(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ok := videoCache.Get(cacheKey{path: info.Name, etag: info.ETag, offset: offset})
+	return ok
+}
+
+// Poll a job until it is done
+func waitPrewarm(t *testing.T, token string, status prewarmStatus) prewarmStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for status.State != "done" {
+		if time.Now().After(deadline) {
+			t.Fatalf("job did not finish: %+v", status)
+		}
+		time.Sleep(5 * time.Millisecond)
+		rec := adminRequest(t, "GET", "/admin/prewarm/"+status.ID, token, "")
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatalf("status body %q: %v", rec.Body.String(), err)
+		}
+	}
+	return status
+}
+
+func TestPrewarm(t *testing.T) {
+	setupStorage(t)
+	config.CacheEnabled = true
+	config.PrewarmConcurrency = 2
+	config.MaxCacheSize = 64 << 20
+	videoCache = newVideoCache(config.MaxCacheSize)
+	token := adminToken(t, "/admin/")
+
+	// moov after the media data, in the fourth cache block
+	mp4 := append(box("ftyp", []byte("isom")), box("mdat", make([]byte, 3*cacheBlockSize))...)
+	mp4 = append(mp4, box("moov", box("mvhd", make([]byte, 100)))...)
+	files := map[string][]byte{
+		filepath.Join(config.VideoBasePath, testUUID, "720p.mp4"): mp4,
+		filepath.Join(config.HLSBasePath, testUUID, "720p", "playlist.m3u8"): []byte(
+			"#EXTM3U\n#EXTINF:4.0,\nseg_00001.ts\n#EXTINF:4.0,\nseg_00002.ts\n#EXTINF:4.0,\nseg_00003.ts\n#EXT-X-ENDLIST\n"),
+	}
+	for i := 1; i <= 3; i++ {
+		files[filepath.Join(config.HLSBasePath, testUUID, "720p", fmt.Sprintf("seg_%05d.ts", i))] = []byte("segment")
+	}
+	for path, data := range files {
+		os.MkdirAll(filepath.Dir(path), 0o755)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rec := adminRequest(t, "POST", "/admin/prewarm", token,
+		`{"uuids": ["`+testUUID+`"], "qualities": ["720p", "1080p"], "segments": 2, "megabytes": 0}`)
+	if rec.Code != 202 {
+		t.Fatalf("POST status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var status prewarmStatus
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	if rec.Header().Get("Location") != "/admin/prewarm/"+status.ID || status.Tasks != 4 {
+		t.Fatalf("job = %+v, Location %q", status, rec.Header().Get("Location"))
+	}
+
+	status = waitPrewarm(t, token, status)
+	// 720p.mp4, the playlist and two segments; 1080p has neither form
+	if status.Completed != 4 || status.Warmed != 4 || status.Missing != 2 || status.Failed != 0 ||
+		status.Skipped != 0 || status.Budget != 16<<20 {
+		t.Errorf("finished job = %+v", status)
+	}
+
+	moov := int64(len(mp4)) - 1
+	if !blockCached(t, config.VideoStore, testUUID+"/720p.mp4", moov-moov%cacheBlockSize) {
+		t.Error("moov block not warmed")
+	}
+	if blockCached(t, config.VideoStore, testUUID+"/720p.mp4", cacheBlockSize) {
+		t.Error("media data warmed although megabytes was 0")
+	}
+	for seg, want := range map[string]bool{"seg_00001.ts": true, "seg_00002.ts": true, "seg_00003.ts": false} {
+		if got := blockCached(t, config.HLSStore, testUUID+"/720p/"+seg, 0); got != want {
+			t.Errorf("%s cached = %v, want %v", seg, got, want)
+		}
+	}
+
+	var jobs []prewarmStatus
+	json.Unmarshal(adminRequest(t, "GET", "/admin/prewarm", token, "").Body.Bytes(), &jobs)
+	if len(jobs) == 0 || jobs[0].ID != status.ID {
+		t.Errorf("job list = %+v", jobs)
+	}
+}
+
+func TestPrewarmRejectsBadRequests(t *testing.T) {
+	setupStorage(t)
+	config.CacheEnabled = true
+	token := adminToken(t, "/admin/")
+	streamToken := adminToken(t, "/stream/"+testUUID)
+
+	tests := []struct {
+		name       string
+		token      string
+		body       string
+		wantStatus int
+	}{
+		{"no token", "", `{"uuids": ["` + testUUID + `"]}`, 401},
+		{"playback token", streamToken, `{"uuids": ["` + testUUID + `"]}`, 401},
+		{"malformed body", token, `{"uuids": `, 400},
+		{"no uuids", token, `{"uuids": []}`, 400},
+		{"bad uuid", token, `{"uuids": ["../etc"]}`, 400},
+		{"bad quality", token, `{"uuids": ["` + testUUID + `"], "qualities": ["9999p"]}`, 400},
+		{"too many segments", token, `{"uuids": ["` + testUUID + `"], "segments": 1000}`, 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if rec := adminRequest(t, "POST", "/admin/prewarm", tt.token, tt.body); rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body.String())
+			}
+		})
+	}
+
+	if rec := adminRequest(t, "GET", "/admin/prewarm/unknown", token, ""); rec.Code != 404 {
+		t.Errorf("unknown job: status %d, want 404", rec.Code)
+	}
+}
+
+func TestPrewarmBudget(t *testing.T) {
+	setupStorage(t)
+	config.CacheEnabled = true
+	config.PrewarmConcurrency = 1
+	config.MaxCacheSize = 4 * cacheBlockSize
+	videoCache = newVideoCache(config.MaxCacheSize)
+	token := adminToken(t, "/admin/")
+
+	// The playlist and the first segment fit in a quarter of the cache; the
+	// second segment does not. There is no progressive 720p file.
+	dir := filepath.Join(config.HLSBasePath, testUUID, "720p")
+	os.MkdirAll(dir, 0o755)
+	os.WriteFile(filepath.Join(dir, "playlist.m3u8"), []byte(
+		"#EXTM3U\n#EXTINF:4.0,\nseg_00001.ts\n#EXTINF:4.0,\nseg_00002.ts\n#EXT-X-ENDLIST\n"), 0o644)
+	os.WriteFile(filepath.Join(dir, "seg_00001.ts"), make([]byte, cacheBlockSize/2), 0o644)
+	os.WriteFile(filepath.Join(dir, "seg_00002.ts"), make([]byte, cacheBlockSize), 0o644)
+
+	rec := adminRequest(t, "POST", "/admin/prewarm", token,
+		`{"uuids": ["`+testUUID+`"], "qualities": ["720p"], "segments": 2}`)
+	var status prewarmStatus
+	json.Unmarshal(rec.Body.Bytes(), &status)
+	status = waitPrewarm(t, token, status)
+	if status.Budget != cacheBlockSize || status.Bytes > status.Budget ||
+		status.Warmed != 2 || status.Skipped != 1 || status.Missing != 1 {
+		t.Errorf("finished job = %+v", status)
+	}
+	if blockCached(t, config.HLSStore, testUUID+"/720p/seg_00002.ts", 0) {
+		t.Error("segment past the budget was warmed")
+	}
+}
+
+func TestPrewarmRunningJobs(t *testing.T) {
+	setupStorage(t)
+	config.CacheEnabled = true
+	token := adminToken(t, "/admin/")
+
+	// Jobs that never finish hold the running slots
+	prewarmMu.Lock()
+	for i := 0; i < maxRunningPrewarmJobs; i++ {
+		id := fmt.Sprintf("running-%d", i)
+		prewarmJobs[id] = &prewarmJob{status: prewarmStatus{ID: id, State: "running", Created: time.Now()}}
+	}
+	prewarmMu.Unlock()
+	defer func() {
+		prewarmMu.Lock()
+		for i := 0; i < maxRunningPrewarmJobs; i++ {
+			delete(prewarmJobs, fmt.Sprintf("running-%d", i))
+		}
+		prewarmMu.Unlock()
+	}()
+
+	rec := adminRequest(t, "POST", "/admin/prewarm", token, `{"uuids": ["`+testUUID+`"]}`)
+	if rec.Code != 429 || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("job past the running cap: status %d, Retry-After %q; want 429",
+			rec.Code, rec.Header().Get("Retry-After"))
+	}
+}
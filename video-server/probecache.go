@@ -0,0 +1,177 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Probes read a video's playlists and media files to describe it, so their
+// results are kept in a small LRU and checked against a version, like a
+// playlist etag, on every use. Concurrent requests for one version share a
+// single probe. The probe runs under probeTimeout and is cancelled once every
+// request waiting on it has gone. A failed probe, timeouts included, is kept
+// for probeFailureTTL so a slow backend is not probed again on every
+// request; one cancelled by its waiters is not kept. A probe that panics fails like any other; it runs
+// outside the request, where recoveryMiddleware cannot catch it.
+
+// Longest a probe may take
+const probeTimeout = 30 * time.Second
+
+// How long a failed probe is remembered
+var probeFailureTTL = 30 * time.Second
+
+// probeCache is an LRU of probe results, bounded by entry count
+type probeCache[V any] struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	maxEntries int
+	runs       map[string]*probeRun[V]
+}
+
+type probeEntry[V any] struct {
+	key     string
+	version string
+	value   V
+	err     error
+	expires time.Time // of a failure
+}
+
+// probeRun is one probe in progress. Requests for the same key and version
+// wait on done and share its result.
+type probeRun[V any] struct {
+	version string
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	value   V
+	err     error
+}
+
+func newProbeCache[V any](maxEntries int) *probeCache[V] {
+	return &probeCache[V]{
+		entries:    make(map[string]*list.Element),
+		lru:        list.New(),
+		maxEntries: maxEntries,
+		runs:       make(map[string]*probeRun[V]),
+	}
+}
+
+// Get returns the result for key at version, running probe unless it is
+// cached or another request is already probing it. When ctx ends first Get
+// returns its error.
+func (c *probeCache[V]) Get(ctx context.Context, key, version string, probe func(context.Context) (V, error)) (V, error) {
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		entry := el.Value.(*probeEntry[V])
+		if entry.version == version && (entry.err == nil || time.Now().Before(entry.expires)) {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return entry.value, entry.err
+		}
+	}
+	run, ok := c.runs[key]
+	if !ok || run.version != version {
+		probeCtx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+		run = &probeRun[V]{version: version, done: make(chan struct{}), cancel: cancel}
+		c.runs[key] = run
+		go c.run(probeCtx, key, run, probe)
+	}
+	run.waiters++
+	c.mu.Unlock()
+
+	select {
+	case <-run.done:
+		return run.value, run.err
+	case <-ctx.Done():
+		c.mu.Lock()
+		if run.waiters--; run.waiters == 0 {
+			// Nobody wants it any more; a later request starts afresh
+			run.cancel()
+			if c.runs[key] == run {
+				delete(c.runs, key)
+			}
+		}
+		c.mu.Unlock()
+		var zero V
+		return zero, ctx.Err()
+	}
+}
+
+func (c *probeCache[V]) run(ctx context.Context, key string, run *probeRun[V], probe func(context.Context) (V, error)) {
+	defer run.cancel()
+	value, err := safeProbe(ctx, key, probe)
+	if err == nil {
+		// A probe cut short may have skipped what it could not read
+		err = ctx.Err()
+	}
+
+	c.mu.Lock()
+	if c.runs[key] == run {
+		delete(c.runs, key)
+	}
+	if !errors.Is(err, context.Canceled) {
+		c.put(key, &probeEntry[V]{key: key, version: run.version, value: value, err: err})
+	}
+	c.mu.Unlock()
+
+	run.value, run.err = value, err
+	close(run.done)
+}
+
+// Run probe, turning a panic into an error
+func safeProbe[V any](ctx context.Context, key string, probe func(context.Context) (V, error)) (value V, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			logger.Error("probe panic recovered", "key", key, "error", fmt.Sprint(p), "stack", string(debug.Stack()))
+			var zero V
+			value, err = zero, fmt.Errorf("probe panicked: %v", p)
+		}
+	}()
+	return probe(ctx)
+}
+
+// put must be called with c.mu held
+func (c *probeCache[V]) put(key string, entry *probeEntry[V]) {
+	if entry.err != nil {
+		var zero V
+		entry.value, entry.expires = zero, time.Now().Add(probeFailureTTL)
+	}
+	if el, ok := c.entries[key]; ok {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+	for c.lru.Len() >= c.maxEntries {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*probeEntry[V]).key)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+}
+
+// Purge drops the results and failures whose key satisfies match
+func (c *probeCache[V]) Purge(match func(key string) bool) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, el := range c.entries {
+		if match(key) {
+			c.lru.Remove(el)
+			delete(c.entries, key)
+			n++
+		}
+	}
+	return n
+}
+
+// Len is the number of cached results and failures
+func (c *probeCache[V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProbeCacheCoalesces(t *testing.T) {
+	c := newProbeCache[int](2)
+	var probes atomic.Int32
+	gate := make(chan struct{})
+	probe := func(context.Context) (int, error) {
+		probes.Add(1)
+		<-gate
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.Get(context.Background(), "a", "v1", probe); v != 42 || err != nil {
+				t.Errorf("Get = %d, %v", v, err)
+			}
+		}()
+	}
+	waitFor(t, "the waiters", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.runs["a"] != nil && c.runs["a"].waiters == 10
+	})
+	close(gate)
+	wg.Wait()
+	if n := probes.Load(); n != 1 {
+		t.Errorf("%d probes, want 1", n)
+	}
+
+	// Cached until the version changes
+	c.Get(context.Background(), "a", "v1", probe)
+	if n := probes.Load(); n != 1 {
+		t.Errorf("%d probes after a cached Get, want 1", n)
+	}
+	c.Get(context.Background(), "a", "v2", probe)
+	if n := probes.Load(); n != 2 {
+		t.Errorf("%d probes after a new version, want 2", n)
+	}
+}
+
+func TestProbeCacheFailuresExpire(t *testing.T) {
+	defer func(ttl time.Duration) { probeFailureTTL = ttl }(probeFailureTTL)
+	probeFailureTTL = 20 * time.Millisecond
+	c := newProbeCache[int](2)
+	fail := errors.New("unreadable")
+	if _, err := c.Get(context.Background(), "a", "v1", func(context.Context) (int, error) { return 0, fail }); err != fail {
+		t.Fatalf("Get error = %v", err)
+	}
+	good := func(context.Context) (int, error) { return 7, nil }
+	if _, err := c.Get(context.Background(), "a", "v1", good); err != fail {
+		t.Errorf("Get right after a failure = %v; want the kept failure", err)
+	}
+	// A new version is probed at once
+	if v, err := c.Get(context.Background(), "a", "v2", good); v != 7 || err != nil {
+		t.Errorf("Get of a new version = %d, %v", v, err)
+	}
+
+	c.Get(context.Background(), "b", "v1", func(context.Context) (int, error) { return 0, fail })
+	time.Sleep(2 * probeFailureTTL)
+	if v, err := c.Get(context.Background(), "b", "v1", good); v != 7 || err != nil {
+		t.Errorf("Get after the failure expired = %d, %v; want a new probe", v, err)
+	}
+}
+
+func TestProbeCacheEvicts(t *testing.T) {
+	c := newProbeCache[int](2)
+	value := func(v int) func(context.Context) (int, error) {
+		return func(context.Context) (int, error) { return v, nil }
+	}
+	c.Get(context.Background(), "a", "v1", value(1))
+	c.Get(context.Background(), "b", "v1", value(2))
+	c.Get(context.Background(), "a", "v1", value(0)) // a is now the most recent
+	c.Get(context.Background(), "c", "v1", value(3))
+
+	if n := c.Len(); n != 2 {
+		t.Errorf("%d entries, want 2", n)
+	}
+	if v, _ := c.Get(context.Background(), "a", "v1", value(0)); v != 1 {
+		t.Errorf("a = %d, want the cached 1", v)
+	}
+	if v, _ := c.Get(context.Background(), "b", "v1", value(0)); v != 0 {
+		t.Errorf("b = %d, want it evicted and probed again", v)
+	}
+	if n := c.Purge(func(key string) bool { return key != "a" }); n != 1 {
+		t.Errorf("Purge dropped %d entries, want 1", n)
+	}
+}
+
+func TestProbeCacheCancel(t *testing.T) {
+	c := newProbeCache[int](2)
+	started, stopped := make(chan struct{}), make(chan struct{})
+	probe := func(ctx context.Context) (int, error) {
+		close(started)
+		<-ctx.Done()
+		close(stopped)
+		return 0, ctx.Err()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		_, err := c.Get(ctx, "a", "v1", probe)
+		result <- err
+	}()
+	<-started
+	cancel()
+	if err := <-result; err != context.Canceled {
+		t.Errorf("Get error = %v, want context.Canceled", err)
+	}
+	// The last waiter leaving stops the probe
+	<-stopped
+	waitFor(t, "the run to end", func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.runs) == 0
+	})
+	if c.Len() != 0 {
+		t.Error("cancelled probe was cached")
+	}
+}
+
+func TestProbeCachePanic(t *testing.T) {
+	c := newProbeCache[int](2)
+	_, err := c.Get(context.Background(), "a", "v1", func(context.Context) (int, error) { panic("corrupt box") })
+	if err == nil {
+		t.Fatal("panicking probe returned no error")
+	}
+	if _, again := c.Get(context.Background(), "a", "v1", func(context.Context) (int, error) { return 1, nil }); again == nil {
+		t.Error("panic not kept as a failure")
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// byteRange is one satisfiable range of a representation
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (br byteRange) end() int64 {
+	return br.start + br.length - 1
+}
+
+func (br byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", br.start, br.end(), size)
+}
+
+// Parse an RFC 7233 byte range set such as "bytes=0-99,500-599,-100".
+// Unsatisfiable ranges are dropped; an error is returned if the header is
+// malformed, has more than maxRanges entries, or nothing is satisfiable.
+// The result is sorted and coalesced.
+func parseRanges(rangeHeader string, fileSize int64, maxRanges int) ([]byteRange, error) {
+	const prefix = "bytes="
+	if len(rangeHeader) < len(prefix) || !strings.EqualFold(rangeHeader[:len(prefix)], prefix) {
+		return nil, fmt.Errorf("invalid range format")
+	}
+
+	specs := strings.Split(rangeHeader[len(prefix):], ",")
+	if maxRanges > 0 && len(specs) > maxRanges {
+		return nil, fmt.Errorf("too many ranges: %d (max %d)", len(specs), maxRanges)
+	}
+
+	var ranges []byteRange
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			// Empty list elements are allowed by RFC 7230 #rule
+			continue
+		}
+
+		first, last, ok := strings.Cut(spec, "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid range spec %q", spec)
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var start, end int64
+		if first == "" {
+			// Suffix range: bytes=-500
+			suffix, err := parseRangeInt(last)
+			if err != nil {
+				return nil, err
+			}
+			if suffix == 0 || fileSize == 0 {
+				continue
+			}
+			if suffix > fileSize {
+				suffix = fileSize
+			}
+			start = fileSize - suffix
+			end = fileSize - 1
+		} else {
+			var err error
+			start, err = parseRangeInt(first)
+			if err != nil {
+				return nil, err
+			}
+			if last == "" {
+				// Open-ended range: bytes=500-
+				end = fileSize - 1
+			} else {
+				// Normal range: bytes=500-999
+				end, err = parseRangeInt(last)
+				if err != nil {
+					return nil, err
+				}
+				if end < start {
+					return nil, fmt.Errorf("invalid range: start > end")
+				}
+				if end >= fileSize {
+					end = fileSize - 1
+				}
+			}
+			if start >= fileSize {
+				continue
+			}
+		}
+
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("range not satisfiable")
+	}
+
+	return coalesceRanges(ranges), nil
+}
+
+func parseRangeInt(s string) (int64, error) {
+	if s == "" || strings.TrimLeft(s, "0123456789") != "" {
+		return 0, fmt.Errorf("invalid range value %q", s)
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// Merge overlapping and adjacent ranges so no byte is sent twice
+func coalesceRanges(ranges []byteRange) []byteRange {
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].start < ranges[j].start
+	})
+
+	merged := ranges[:1]
+	for _, br := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if br.start <= last.end()+1 {
+			if br.end() > last.end() {
+				last.length = br.end() - last.start + 1
+			}
+			continue
+		}
+		merged = append(merged, br)
+	}
+	return merged
+}
+
+// multipartRanges writes a multipart/byteranges body for a set of ranges
+type multipartRanges struct {
+	ranges      []byteRange
+	contentType string
+	size        int64
+	boundary    string
+}
+
+func newMultipartRanges(ranges []byteRange, contentType string, size int64) *multipartRanges {
+	return &multipartRanges{
+		ranges:      ranges,
+		contentType: contentType,
+		size:        size,
+		boundary:    multipart.NewWriter(io.Discard).Boundary(),
+	}
+}
+
+func (m *multipartRanges) ContentType() string {
+	return "multipart/byteranges; boundary=" + m.boundary
+}
+
+// ContentLength returns the exact body size without reading any data
+func (m *multipartRanges) ContentLength() int64 {
+	var counter countingWriter
+	mw := multipart.NewWriter(&counter)
+	mw.SetBoundary(m.boundary)
+	for _, br := range m.ranges {
+		mw.CreatePart(m.partHeader(br))
+		counter += countingWriter(br.length)
+	}
+	mw.Close()
+	return int64(counter)
+}
+
+// WriteTo streams every part, reading the data from src
+func (m *multipartRanges) WriteTo(w io.Writer, src io.ReaderAt) error {
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(m.boundary)
+	for _, br := range m.ranges {
+		part, err := mw.CreatePart(m.partHeader(br))
+		if err != nil {
+			return err
+		}
+		if err := copyRange(part, src, br.start, br.length); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+func (m *multipartRanges) partHeader(br byteRange) textproto.MIMEHeader {
+	return textproto.MIMEHeader{
+		"Content-Range": {br.contentRange(m.size)},
+		"Content-Type":  {m.contentType},
+	}
+}
+
+type countingWriter int64
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	*c += countingWriter(len(p))
+	return len(p), nil
+}
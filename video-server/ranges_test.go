@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseRanges(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		name   string
+		header string
+		want   []byteRange
+	}{
+		{"single", "bytes=0-99", []byteRange{{0, 100}}},
+		{"case-insensitive unit", "Bytes=10-19", []byteRange{{10, 10}}},
+		{"open-ended", "bytes=900-", []byteRange{{900, 100}}},
+		{"end past the file", "bytes=950-2000", []byteRange{{950, 50}}},
+		{"suffix", "bytes=-100", []byteRange{{900, 100}}},
+		{"suffix longer than the file", "bytes=-5000", []byteRange{{0, size}}},
+		{"sorted", "bytes=500-599, 0-99", []byteRange{{0, 100}, {500, 100}}},
+		{"overlapping", "bytes=0-99,50-149", []byteRange{{0, 150}}},
+		{"adjacent", "bytes=0-99,100-199", []byteRange{{0, 200}}},
+		{"contained", "bytes=0-499,100-199", []byteRange{{0, 500}}},
+		{"suffix overlapping", "bytes=850-949,-100", []byteRange{{850, 150}}},
+		{"unsatisfiable dropped", "bytes=0-9,2000-2099", []byteRange{{0, 10}}},
+		{"empty elements", "bytes=0-9,,20-29", []byteRange{{0, 10}, {20, 10}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseRanges(tt.header, size, 4)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseRanges(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+
+	for _, header := range []string{
+		"items=0-9",
+		"bytes=abc",
+		"bytes=9-0",
+		"bytes=+1-9",
+		"bytes=0-9,x-y",
+		"bytes=1000-",               // starts at the end
+		"bytes=-0",                  // empty suffix
+		"bytes=0-1,2-3,4-5,6-7,8-9", // more than maxRanges
+	} {
+		if got, err := parseRanges(header, size, 4); err == nil {
+			t.Errorf("parseRanges(%q) = %v, want an error", header, got)
+		}
+	}
+	if _, err := parseRanges("bytes=-10", 0, 4); err == nil {
+		t.Error("suffix of an empty file accepted")
+	}
+}
+
+func TestMultipartRanges(t *testing.T) {
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	ranges := []byteRange{{0, 10}, {500, 100}, {990, 10}}
+	m := newMultipartRanges(ranges, "video/mp4", int64(len(data)))
+
+	var body bytes.Buffer
+	if err := m.WriteTo(&body, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if got := m.ContentLength(); got != int64(body.Len()) {
+		t.Errorf("ContentLength = %d, body is %d bytes", got, body.Len())
+	}
+
+	_, params, err := mime.ParseMediaType(m.ContentType())
+	if err != nil {
+		t.Fatal(err)
+	}
+	reader := multipart.NewReader(&body, params["boundary"])
+	for _, br := range ranges {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := part.Header.Get("Content-Range"), br.contentRange(int64(len(data))); got != want {
+			t.Errorf("Content-Range = %q, want %q", got, want)
+		}
+		if got := part.Header.Get("Content-Type"); got != "video/mp4" {
+			t.Errorf("part Content-Type = %q", got)
+		}
+		if got, _ := io.ReadAll(part); !bytes.Equal(got, data[br.start:br.start+br.length]) {
+			t.Errorf("part %s has the wrong bytes", br.contentRange(int64(len(data))))
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("after the last part: %v, want io.EOF", err)
+	}
+}
+
+func TestUnsatisfiableRanges(t *testing.T) {
+	setupStorage(t)
+	defer func(n int) { config.MaxRanges = n }(config.MaxRanges)
+	config.MaxRanges = 2
+
+	// stream.mp4 holds the 5 bytes "video"
+	for _, header := range []string{"bytes=5-", "bytes=0-0,2-2,4-4", "bytes=3-1"} {
+		req := httptest.NewRequest("GET", "/stream/"+testUUID, nil)
+		req.Header.Set("Range", header)
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		if rec.Code != http.StatusRequestedRangeNotSatisfiable || rec.Header().Get("Content-Range") != "bytes */5" {
+			t.Errorf("Range %q: status %d, Content-Range %q; want 416 with bytes */5",
+				header, rec.Code, rec.Header().Get("Content-Range"))
+		}
+	}
+}
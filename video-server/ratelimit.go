@@ -0,0 +1,294 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Limits are applied per route group. Each client gets a token bucket of
+// requests per group and a cap on the requests it has in flight, and all
+// media requests share a global cap. A client is the subject of its token
+// when the token is bound to a viewer, and its IP otherwise, so viewers
+// behind one NAT do not share a budget. Limits are read from the live
+// config, so they change on reload. They are off by default: behind a proxy
+// that is not listed in trusted-proxies every viewer has the proxy's IP.
+
+// Route groups that limits can be set for
+var limitGroups = []string{"progressive", "hls", "thumb", "admin"}
+
+// routeLimits are the limits of one route group; zero means unlimited
+type routeLimits struct {
+	Rate    float64 // requests per second per client
+	Burst   int     // bucket size
+	Streams int     // requests in flight per client
+}
+
+// Map a route template to its limit group; other routes are not limited
+func limitGroup(route string) string {
+	switch {
+	case strings.HasPrefix(route, "/stream/"):
+		return "progressive"
+	case strings.HasPrefix(route, "/hls/"), strings.HasPrefix(route, "/dash/"):
+		return "hls"
+	case strings.HasPrefix(route, "/thumb/"):
+		return "thumb"
+	case strings.HasPrefix(route, "/admin/"), strings.HasPrefix(route, "/origin/"):
+		// Server-to-server callers
+		return "admin"
+	}
+	return ""
+}
+
+// Parse the rate-limits ("group=rate:burst") and stream-limits ("group=N")
+// entries into limits per group
+func parseRouteLimits(rates, streams []string) (map[string]routeLimits, error) {
+	limits := make(map[string]routeLimits)
+	group := func(entry string) (string, string, error) {
+		name, value, ok := strings.Cut(entry, "=")
+		if !ok {
+			return "", "", fmt.Errorf("%q: want group=value", entry)
+		}
+		for _, g := range limitGroups {
+			if g == name {
+				return name, value, nil
+			}
+		}
+		return "", "", fmt.Errorf("%q: unknown route group %q (want one of %s)", entry, name, strings.Join(limitGroups, ", "))
+	}
+
+	for _, entry := range rates {
+		name, value, err := group(entry)
+		if err != nil {
+			return nil, fmt.Errorf("rate-limits: %w", err)
+		}
+		rateStr, burstStr, _ := strings.Cut(value, ":")
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate < 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("rate-limits: %q: invalid rate %q", entry, rateStr)
+		}
+		burst := int(math.Ceil(rate))
+		if burstStr != "" {
+			if burst, err = strconv.Atoi(burstStr); err != nil || burst < 1 {
+				return nil, fmt.Errorf("rate-limits: %q: invalid burst %q", entry, burstStr)
+			}
+		}
+		l := limits[name]
+		l.Rate, l.Burst = rate, max(burst, 1)
+		limits[name] = l
+	}
+	for _, entry := range streams {
+		name, value, err := group(entry)
+		if err != nil {
+			return nil, fmt.Errorf("stream-limits: %w", err)
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("stream-limits: %q: invalid stream count %q", entry, value)
+		}
+		l := limits[name]
+		l.Streams = n
+		limits[name] = l
+	}
+	return limits, nil
+}
+
+// tokenBucket holds up to burst tokens, refilled at rate per second
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	rate   float64
+	burst  int
+}
+
+// full reports whether the bucket has refilled completely by now
+func (b *tokenBucket) full(now time.Time) bool {
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= float64(b.burst)
+}
+
+// rateLimiter keeps one bucket per client key. Buckets that have refilled
+// completely carry no state and are swept.
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// Idle buckets are swept at most this often
+const rateSweepInterval = time.Minute
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: make(map[string]*tokenBucket), lastSweep: time.Now()}
+}
+
+// allow takes a token from the bucket of key. When empty it reports how
+// long until the next token.
+func (l *rateLimiter) allow(key string, rate float64, burst int, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > rateSweepInterval {
+		// Each bucket by the limits of its own group
+		for k, b := range l.buckets {
+			if b.full(now) {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(burst), b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last, b.rate, b.burst = now, rate, burst
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// streamTracker counts requests in flight per client key
+type streamTracker struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (t *streamTracker) acquire(key string, limit int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts[key] >= limit {
+		return false
+	}
+	t.counts[key]++
+	return true
+}
+
+func (t *streamTracker) release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.counts[key]--; t.counts[key] <= 0 {
+		delete(t.counts, key)
+	}
+}
+
+// limitRejection labels one kind of rejected request in metrics
+type limitRejection struct {
+	group  string
+	reason string // rate, client_streams or global_streams
+}
+
+var (
+	requestLimiter = newRateLimiter()
+	clientStreams  = &streamTracker{counts: make(map[string]int)}
+	openStreams    atomic.Int64
+
+	rejectionsMu sync.Mutex
+	rejections   = make(map[limitRejection]int64)
+)
+
+// Limit Middleware - request rates, per-client streams and the global stream cap
+func limitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := ""
+		if current := mux.CurrentRoute(r); current != nil {
+			route, _ = current.GetPathTemplate()
+		}
+		group := limitGroup(route)
+		if group == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		cfg := currentConfig()
+		limits := cfg.Limits[group]
+
+		client := tokenSubject(r)
+		if client == "" {
+			client = "ip:" + clientIP(r).String()
+		}
+		if limits.Rate > 0 {
+			if ok, wait := requestLimiter.allow(group+"|"+client, limits.Rate, limits.Burst, time.Now()); !ok {
+				rejectRequest(w, r, group, "rate", http.StatusTooManyRequests, wait)
+				return
+			}
+		}
+
+		if deliveryType(route) != "" {
+			if n := openStreams.Add(1); cfg.MaxStreams > 0 && n > int64(cfg.MaxStreams) {
+				openStreams.Add(-1)
+				rejectRequest(w, r, group, "global_streams", http.StatusServiceUnavailable, time.Second)
+				return
+			}
+			defer openStreams.Add(-1)
+		}
+		if limits.Streams > 0 {
+			key := group + "|" + client
+			if !clientStreams.acquire(key, limits.Streams) {
+				rejectRequest(w, r, group, "client_streams", http.StatusTooManyRequests, time.Second)
+				return
+			}
+			defer clientStreams.release(key)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// The subject of a valid token bound to a viewer: its session, or else its
+// client IP. Unbound tokens are shared by everyone holding the URL, so they
+// have no subject of their own.
+func tokenSubject(r *http.Request) string {
+	claims := requestClaims(r)
+	switch {
+	case claims == nil:
+		return ""
+	case claims.Session != "":
+		return "sid:" + claims.Session
+	case claims.IP != "":
+		return "ip:" + claims.IP
+	}
+	return ""
+}
+
+func rejectRequest(w http.ResponseWriter, r *http.Request, group, reason string, status int, retry time.Duration) {
+	rejectionsMu.Lock()
+	rejections[limitRejection{group, reason}]++
+	rejectionsMu.Unlock()
+
+	logger.Warn("request limited", "request_id", requestID(r.Context()), "group", group, "reason", reason,
+		"client_ip", clientIP(r).String())
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(max(retry, time.Second).Seconds()))))
+	http.Error(w, http.StatusText(status), status)
+}
+
+// limitRejections returns the rejection counters in a stable order
+func limitRejections() ([]limitRejection, []int64) {
+	rejectionsMu.Lock()
+	defer rejectionsMu.Unlock()
+	keys := make([]limitRejection, 0, len(rejections))
+	for k := range rejections {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].group != keys[j].group {
+			return keys[i].group < keys[j].group
+		}
+		return keys[i].reason < keys[j].reason
+	})
+	counts := make([]int64, len(keys))
+	for i, k := range keys {
+		counts[i] = rejections[k]
+	}
+	return keys, counts
+}
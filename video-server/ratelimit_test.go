@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// resetLimits installs limits on the global config with fresh limiter state
+func resetLimits(t *testing.T, limits map[string]routeLimits, maxStreams int) {
+	t.Helper()
+	requestLimiter = newRateLimiter()
+	clientStreams = &streamTracker{counts: make(map[string]int)}
+	rejectionsMu.Lock()
+	rejections = make(map[limitRejection]int64)
+	rejectionsMu.Unlock()
+	config.Limits, config.MaxStreams = limits, maxStreams
+	t.Cleanup(func() { config.Limits, config.MaxStreams = nil, 0 })
+}
+
+func TestParseRouteLimits(t *testing.T) {
+	limits, err := parseRouteLimits([]string{"progressive=2.5", "hls=50:200"}, []string{"progressive=4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := limits["progressive"]; got != (routeLimits{Rate: 2.5, Burst: 3, Streams: 4}) {
+		t.Errorf("progressive = %+v", got)
+	}
+	if got := limits["hls"]; got != (routeLimits{Rate: 50, Burst: 200}) {
+		t.Errorf("hls = %+v", got)
+	}
+
+	for _, tt := range []struct{ rates, streams []string }{
+		{[]string{"progressive"}, nil},
+		{[]string{"video=10"}, nil},
+		{[]string{"thumb=fast"}, nil},
+		{[]string{"thumb=-1"}, nil},
+		{[]string{"thumb=10:0"}, nil},
+		{nil, []string{"hls=many"}},
+		{nil, []string{"hls=-2"}},
+	} {
+		if _, err := parseRouteLimits(tt.rates, tt.streams); err == nil {
+			t.Errorf("parseRouteLimits(%q, %q) accepted", tt.rates, tt.streams)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	setupStorage(t)
+	resetLimits(t, map[string]routeLimits{"thumb": {Rate: 0.5, Burst: 2}}, 0)
+	var err error
+	if config.SigningKeys, err = parseKeyring("k1:limit-secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	token, err := signToken(tokenClaims{Path: "/thumb/", Session: "viewer-1", Expires: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(ip, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/thumb/"+testUUID+".jpg?token="+token, nil)
+		req.RemoteAddr = ip + ":40000"
+		req.Header.Set("X-Playtube-Session", "viewer-1")
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, req)
+		return rec
+	}
+
+	for i := 0; i < 2; i++ {
+		if rec := get("192.0.2.1", ""); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("request %d limited within the burst", i+1)
+		}
+	}
+	rec := get("192.0.2.1", "")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("request past the burst: status %d, want 429", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "2" {
+		t.Errorf("Retry-After = %q, want 2", got)
+	}
+	if rec := get("192.0.2.2", ""); rec.Code == http.StatusTooManyRequests {
+		t.Error("another client was limited")
+	}
+
+	// A viewer's session is limited on its own, not by the address it shares,
+	// and across the addresses it uses
+	for _, ip := range []string{"192.0.2.1", "192.0.2.3"} {
+		if rec := get(ip, token); rec.Code == http.StatusTooManyRequests {
+			t.Fatalf("session limited from %s within the burst", ip)
+		}
+	}
+	if rec := get("192.0.2.4", token); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("session past the burst from a new address: status %d, want 429", rec.Code)
+	}
+
+	keys, counts := limitRejections()
+	if len(keys) != 1 || keys[0] != (limitRejection{"thumb", "rate"}) || counts[0] != 2 {
+		t.Errorf("rejections = %v %v", keys, counts)
+	}
+}
+
+func TestRateLimiterSweep(t *testing.T) {
+	l := newRateLimiter()
+	now := time.Now()
+	for i := 0; i < 100; i++ {
+		l.allow("hls|ip:192.0.2.1", 0.1, 200, now)
+	}
+	// A sweep triggered by a group with a smaller burst keeps the drained
+	// bucket of the other group
+	now = now.Add(rateSweepInterval + time.Second)
+	l.allow("thumb|ip:192.0.2.1", 1, 60, now)
+	if b := l.buckets["hls|ip:192.0.2.1"]; b == nil {
+		t.Fatal("drained hls bucket swept")
+	}
+	now = now.Add(rateSweepInterval + time.Second)
+	for i := 0; i < 160; i++ {
+		if ok, _ := l.allow("hls|ip:192.0.2.1", 0.1, 200, now); !ok {
+			return
+		}
+	}
+	t.Error("hls bucket came back full after a sweep")
+}
+
+func TestStreamLimits(t *testing.T) {
+	resetLimits(t, map[string]routeLimits{"progressive": {Streams: 1}}, 2)
+
+	gate := make(chan struct{})
+	router := mux.NewRouter()
+	router.Use(limitMiddleware)
+	router.HandleFunc("/stream/{uuid}", func(w http.ResponseWriter, r *http.Request) { <-gate })
+
+	var wg sync.WaitGroup
+	get := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/stream/"+testUUID, nil)
+		req.RemoteAddr = ip + ":40000"
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+	hold := func(ip string, open int64) {
+		t.Helper()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			get(ip)
+		}()
+		waitFor(t, "the stream to open", func() bool { return openStreams.Load() == open })
+	}
+
+	hold("192.0.2.1", 1)
+	rec := get("192.0.2.1")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("second stream of a client: status %d, Retry-After %q, want 429",
+			rec.Code, rec.Header().Get("Retry-After"))
+	}
+	hold("192.0.2.2", 2)
+	rec = get("192.0.2.3")
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("stream past the global cap: status %d, Retry-After %q, want 503",
+			rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	close(gate)
+	wg.Wait()
+	if n := openStreams.Load(); n != 0 {
+		t.Errorf("%d streams still open", n)
+	}
+	if len(clientStreams.counts) != 0 {
+		t.Errorf("client streams not released: %v", clientStreams.counts)
+	}
+	if rec := get("192.0.2.1"); rec.Code != http.StatusOK {
+		t.Errorf("stream after release: status %d", rec.Code)
+	}
+}
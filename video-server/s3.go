@@ -0,0 +1,365 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3-compatible object storage (AWS S3, MinIO, Cloudflare R2) over plain
+// HTTP with AWS Signature Version 4. Objects are read with ranged GETs, so a
+// Range request from a player becomes a range read on the bucket.
+
+// SHA-256 of an empty body, sent with every GET, HEAD and list request
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+type s3Client struct {
+	endpoint     *url.URL
+	region       string
+	bucket       string
+	accessKey    string
+	secretKey    string
+	sessionToken string
+	pathStyle    bool
+	http         *http.Client
+	now          func() time.Time
+}
+
+func newS3Client(c *Config) (*s3Client, error) {
+	endpoint := c.S3Endpoint
+	if endpoint == "" {
+		endpoint = "https://s3." + c.S3Region + ".amazonaws.com"
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 64
+	transport.ResponseHeaderTimeout = 30 * time.Second
+
+	return &s3Client{
+		endpoint:     u,
+		region:       c.S3Region,
+		bucket:       c.S3Bucket,
+		accessKey:    c.S3AccessKey,
+		secretKey:    c.S3SecretKey,
+		sessionToken: c.S3SessionToken,
+		pathStyle:    c.S3PathStyle,
+		http:         &http.Client{Transport: transport},
+		now:          time.Now,
+	}, nil
+}
+
+// Normalise a configured root into a key prefix: "" or "dir/sub/"
+func s3Prefix(root string) string {
+	root = strings.Trim(root, "/")
+	if root == "" {
+		return ""
+	}
+	return root + "/"
+}
+
+// s3Error is an error response from the object store
+type s3Error struct {
+	Status  int
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: HTTP %d", e.Status)
+	}
+	return fmt.Sprintf("s3: HTTP %d %s: %s", e.Status, e.Code, e.Message)
+}
+
+func (e *s3Error) Unwrap() error {
+	if e.Status == http.StatusNotFound {
+		return fs.ErrNotExist
+	}
+	return nil
+}
+
+// Build the URL of an object key, or of the bucket when key is ""
+func (c *s3Client) objectURL(key string, query url.Values) *url.URL {
+	u := *c.endpoint
+	path := u.Path + "/" + key
+	if c.pathStyle {
+		path = u.Path + "/" + c.bucket + "/" + key
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	u.Path = path
+	u.RawPath = s3EncodePath(path)
+	u.RawQuery = s3CanonicalQuery(query)
+	return &u
+}
+
+// Send a signed request. Non-2xx responses are returned as *s3Error.
+func (c *s3Client) do(ctx context.Context, method, key string, query url.Values, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.objectURL(key, query).String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.sign(req, c.now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		e := &s3Error{}
+		xml.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(e)
+		e.Status = resp.StatusCode
+		return nil, e
+	}
+	return resp, nil
+}
+
+// Sign req with AWS Signature Version 4. Host, Range and every x-amz-*
+// header are signed; the payload is always empty. Anonymous clients send
+// unsigned requests, which public buckets accept.
+func (c *s3Client) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyPayloadHash)
+	if c.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.sessionToken)
+	}
+	if c.accessKey == "" {
+		return
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "range" {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		s3EmptyPayloadHash,
+	}, "\n")
+
+	scope := amzDate[:8] + "/" + c.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), amzDate[:8])
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+c.accessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URI-encode every byte except unreserved characters, as SigV4 requires
+func s3Encode(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case 'A' <= ch && ch <= 'Z', 'a' <= ch && ch <= 'z', '0' <= ch && ch <= '9',
+			ch == '-', ch == '_', ch == '.', ch == '~', ch == '/' && keepSlash:
+			b.WriteByte(ch)
+		default:
+			fmt.Fprintf(&b, "%%%02X", ch)
+		}
+	}
+	return b.String()
+}
+
+func s3EncodePath(path string) string {
+	return s3Encode(path, true)
+}
+
+// Encode query parameters sorted by name, the form both sent and signed
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var parts []string
+	for _, name := range names {
+		values := append([]string(nil), query[name]...)
+		sort.Strings(values)
+		for _, v := range values {
+			parts = append(parts, s3Encode(name, false)+"="+s3Encode(v, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3Storage serves one root from a key prefix in the bucket
+type s3Storage struct {
+	client *s3Client
+	prefix string
+}
+
+func (s *s3Storage) objectKey(key string) (string, error) {
+	if _, err := splitKey(key); err != nil {
+		return "", err
+	}
+	return s.prefix + key, nil
+}
+
+func (s *s3Storage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	objectKey, err := s.objectKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp, err := s.client.do(ctx, "HEAD", objectKey, nil, nil)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+
+	size, err := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return ObjectInfo{}, fmt.Errorf("s3: %s: invalid Content-Length", objectKey)
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{
+		Key:     key,
+		Name:    "s3://" + s.client.bucket + "/" + objectKey,
+		Size:    size,
+		ModTime: modTime,
+		ETag:    resp.Header.Get("ETag"),
+	}, nil
+}
+
+func (s *s3Storage) Open(ctx context.Context, key string) (Object, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	objectKey := s.prefix + key
+	return &rangedObject{info: info, fetch: func(off, length int64) (io.ReadCloser, error) {
+		return s.client.getRange(ctx, objectKey, info.ETag, off, length)
+	}}, nil
+}
+
+// s3ListResult is one page of a ListObjectsV2 response
+type s3ListResult struct {
+	Contents []struct {
+		Key          string `xml:"Key"`
+		LastModified string `xml:"LastModified"`
+		ETag         string `xml:"ETag"`
+		Size         int64  `xml:"Size"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List the objects under the directory prefix, following continuation tokens
+func (s *s3Storage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	listPrefix := s.prefix
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		if _, err := splitKey(prefix); err != nil {
+			return nil, err
+		}
+		listPrefix += prefix + "/"
+	}
+
+	var infos []ObjectInfo
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {listPrefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := s.client.do(ctx, "GET", "", query, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("s3: list %s: %w", listPrefix, err)
+		}
+
+		for _, obj := range page.Contents {
+			key := strings.TrimPrefix(obj.Key, s.prefix)
+			if strings.HasSuffix(key, "/") {
+				continue // directory placeholder
+			}
+			modTime, _ := time.Parse(time.RFC3339, obj.LastModified)
+			infos = append(infos, ObjectInfo{
+				Key:     key,
+				Name:    "s3://" + s.client.bucket + "/" + obj.Key,
+				Size:    obj.Size,
+				ModTime: modTime,
+				ETag:    obj.ETag,
+			})
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return infos, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Fetch length bytes of one object version from off with a ranged GET.
+// If-Match pins the version seen by Stat, so a replaced object fails
+// instead of mixing two versions.
+func (c *s3Client) getRange(ctx context.Context, key, etag string, off, length int64) (io.ReadCloser, error) {
+	header := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+length-1)}}
+	if etag != "" {
+		header.Set("If-Match", etag)
+	}
+	resp, err := c.do(ctx, "GET", key, nil, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s: range read answered with HTTP %d", key, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
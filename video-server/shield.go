@@ -0,0 +1,652 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Origin shield: edge instances run the origin storage driver and keep whole
+// objects pulled from the upstream in a bounded directory. A miss starts one
+// background fetch per object; every client asking for it meanwhile reads the
+// partial file as it grows. Each object is stored as <sha256(name)> with a
+// <sha256(name)>.json sidecar holding its ObjectInfo, so the index can be
+// rebuilt on startup.
+
+const (
+	// Readers further than this beyond the fill position fetch their range
+	// from the origin directly instead of waiting for the fill to get there
+	shieldWaitWindow = 4 << 20
+
+	// Bound on remembered origin answers, including misses
+	shieldMaxChecked = 64 * 1024
+
+	shieldTempPrefix = "tmp-"
+)
+
+// A fill fails when the origin sends nothing for this long, so readers
+// waiting on it fall back to range reads
+var shieldFillIdleTimeout = 30 * time.Second
+
+var shieldCache *ShieldCache
+
+// ShieldCache is an on-disk LRU of objects pulled from the origin
+type ShieldCache struct {
+	dir        string
+	revalidate time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*shieldEntry // by object name
+	lru     *list.List              // front = most recently used
+	size    int64                   // bytes on disk plus bytes reserved by fills
+	maxSize int64
+	fills   map[string]*shieldFill
+	checked map[string]shieldCheck
+
+	hits          atomic.Int64
+	misses        atomic.Int64
+	coalesced     atomic.Int64
+	evictions     atomic.Int64
+	upstreamBytes atomic.Int64
+}
+
+type shieldEntry struct {
+	info    ObjectInfo
+	element *list.Element
+}
+
+// shieldCheck is the last origin answer for an object name
+type shieldCheck struct {
+	info ObjectInfo
+	err  error // set for a remembered miss
+	at   time.Time
+}
+
+// ShieldStats is a point-in-time snapshot of shield counters
+type ShieldStats struct {
+	Items         int
+	Fills         int
+	Size          int64
+	MaxSize       int64
+	Hits          int64
+	Misses        int64
+	Coalesced     int64
+	Evictions     int64
+	UpstreamBytes int64
+}
+
+// Open the cache directory, dropping partial downloads and rebuilding the
+// index from the sidecars. Least recently filled objects are evicted until
+// the cache fits maxSize.
+func openShieldCache(dir string, maxSize int64, revalidate time.Duration) (*ShieldCache, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("shield cache: %w", err)
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("shield cache: %w", err)
+	}
+
+	c := &ShieldCache{
+		dir:        dir,
+		revalidate: revalidate,
+		entries:    make(map[string]*shieldEntry),
+		lru:        list.New(),
+		maxSize:    maxSize,
+		fills:      make(map[string]*shieldFill),
+		checked:    make(map[string]shieldCheck),
+	}
+
+	type found struct {
+		info    ObjectInfo
+		modTime time.Time
+	}
+	var objects []found
+	valid := make(map[string]bool)
+	for _, d := range dirEntries {
+		name := d.Name()
+		if strings.HasPrefix(name, shieldTempPrefix) {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		base := strings.TrimSuffix(name, ".json")
+		info, modTime, err := c.readMeta(base)
+		if err != nil {
+			logger.Warn("dropping shield cache entry", "file", name, "error", err)
+			os.Remove(filepath.Join(dir, name))
+			os.Remove(filepath.Join(dir, base))
+			continue
+		}
+		valid[base] = true
+		objects = append(objects, found{info, modTime})
+	}
+	// Data files without a sidecar were never completed
+	for _, d := range dirEntries {
+		if name := d.Name(); !strings.Contains(name, ".") && !strings.HasPrefix(name, shieldTempPrefix) && !valid[name] {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool { return objects[i].modTime.Before(objects[j].modTime) })
+	for _, o := range objects {
+		c.addEntry(o.info)
+	}
+	c.mu.Lock()
+	c.evict(0)
+	c.mu.Unlock()
+	return c, nil
+}
+
+// Read and check the sidecar of a data file
+func (c *ShieldCache) readMeta(base string) (ObjectInfo, time.Time, error) {
+	var info ObjectInfo
+	data, err := os.ReadFile(filepath.Join(c.dir, base+".json"))
+	if err != nil {
+		return info, time.Time{}, err
+	}
+	if err := json.Unmarshal(data, &info); err != nil {
+		return info, time.Time{}, err
+	}
+	if shieldFileName(info.Name) != base {
+		return info, time.Time{}, errors.New("sidecar does not match its file name")
+	}
+	stat, err := os.Stat(filepath.Join(c.dir, base))
+	if err != nil {
+		return info, time.Time{}, err
+	}
+	if stat.Size() != info.Size {
+		return info, time.Time{}, fmt.Errorf("size %d, want %d", stat.Size(), info.Size)
+	}
+	return info, stat.ModTime(), nil
+}
+
+func shieldFileName(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *ShieldCache) dataPath(name string) string {
+	return filepath.Join(c.dir, shieldFileName(name))
+}
+
+// addEntry indexes a complete object as most recently used
+func (c *ShieldCache) addEntry(info ObjectInfo) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[info.Name]; ok {
+		c.lru.Remove(old.element)
+		c.size -= old.info.Size
+	}
+	e := &shieldEntry{info: info}
+	e.element = c.lru.PushFront(e)
+	c.entries[info.Name] = e
+	c.size += info.Size
+}
+
+// removeEntry must be called with c.mu held
+func (c *ShieldCache) removeEntry(e *shieldEntry) {
+	c.lru.Remove(e.element)
+	delete(c.entries, e.info.Name)
+	c.size -= e.info.Size
+	path := c.dataPath(e.info.Name)
+	os.Remove(path + ".json")
+	os.Remove(path)
+}
+
+// Evict least recently used objects until n more bytes fit; callers hold c.mu
+func (c *ShieldCache) evict(n int64) bool {
+	for c.size+n > c.maxSize {
+		oldest := c.lru.Back()
+		if oldest == nil {
+			return false
+		}
+		c.removeEntry(oldest.Value.(*shieldEntry))
+		c.evictions.Add(1)
+	}
+	return true
+}
+
+// Return the remembered origin answer for name if still fresh
+func (c *ShieldCache) lookup(name string) (ObjectInfo, error, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	check, ok := c.checked[name]
+	if !ok || time.Since(check.at) > c.revalidate {
+		return ObjectInfo{}, nil, false
+	}
+	return check.info, check.err, true
+}
+
+// Remember an origin answer, dropping a stored copy the origin no longer has
+func (c *ShieldCache) remember(name string, info ObjectInfo, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.checked) >= shieldMaxChecked {
+		c.checked = make(map[string]shieldCheck)
+	}
+	c.checked[name] = shieldCheck{info: info, err: err, at: time.Now()}
+	if e, ok := c.entries[name]; ok && (err != nil || e.info.ETag != info.ETag) {
+		c.removeEntry(e)
+	}
+}
+
+// Return the stored copy of name, if any
+func (c *ShieldCache) stored(name string) (ObjectInfo, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[name]
+	if !ok {
+		return ObjectInfo{}, false
+	}
+	return e.info, true
+}
+
+// Open the stored copy of one object version
+func (c *ShieldCache) open(info ObjectInfo) (Object, bool) {
+	c.mu.Lock()
+	e, ok := c.entries[info.Name]
+	if ok && e.info.ETag == info.ETag {
+		c.lru.MoveToFront(e.element)
+	}
+	c.mu.Unlock()
+	if !ok || e.info.ETag != info.ETag {
+		return nil, false
+	}
+
+	path := c.dataPath(info.Name)
+	file, err := os.Open(path)
+	if err != nil {
+		c.mu.Lock()
+		if c.entries[info.Name] == e {
+			c.removeEntry(e)
+		}
+		c.mu.Unlock()
+		return nil, false
+	}
+	// The modification time orders the LRU when the index is rebuilt
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return &localObject{File: file, info: e.info}, true
+}
+
+// Join the running fill for one object version or start one. It returns nil
+// when the object cannot be cached and should be read from the origin.
+func (c *ShieldCache) fill(origin *originStorage, info ObjectInfo) *shieldFill {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.fills[info.Name]; ok && f.info.ETag == info.ETag {
+		c.coalesced.Add(1)
+		return f
+	}
+	if e, ok := c.entries[info.Name]; ok {
+		c.removeEntry(e)
+	}
+	if info.Size > c.maxSize || !c.evict(info.Size) {
+		return nil
+	}
+	file, err := os.CreateTemp(c.dir, shieldTempPrefix+"*")
+	if err != nil {
+		logger.Warn("cannot create shield cache file", "error", err)
+		return nil
+	}
+	c.misses.Add(1)
+	c.size += info.Size
+
+	f := &shieldFill{cache: c, info: info, temp: file.Name(), changed: make(chan struct{})}
+	c.fills[info.Name] = f
+	go f.run(origin, file)
+	return f
+}
+
+// finish installs a completed fill or discards a failed one
+func (c *ShieldCache) finish(f *shieldFill, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.fills[f.info.Name] == f {
+		delete(c.fills, f.info.Name)
+	}
+	c.size -= f.info.Size
+	if err == nil {
+		if e, ok := c.entries[f.info.Name]; ok {
+			c.removeEntry(e)
+		}
+		err = c.install(f)
+	}
+	if err != nil {
+		os.Remove(f.temp)
+		delete(c.checked, f.info.Name)
+		return err
+	}
+
+	if !c.evict(f.info.Size) {
+		os.Remove(c.dataPath(f.info.Name) + ".json")
+		os.Remove(c.dataPath(f.info.Name))
+		return nil
+	}
+	e := &shieldEntry{info: f.info}
+	e.element = c.lru.PushFront(e)
+	c.entries[f.info.Name] = e
+	c.size += f.info.Size
+	return nil
+}
+
+// Move a fill's data into place and write its sidecar atomically
+func (c *ShieldCache) install(f *shieldFill) error {
+	path := c.dataPath(f.info.Name)
+	if err := os.Rename(f.temp, path); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(f.info)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(c.dir, shieldTempPrefix+"*")
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	_, err = tmp.Write(meta)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path+".json")
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		os.Remove(path)
+	}
+	return err
+}
+
+// Files lists the stored objects whose name satisfies match
+func (c *ShieldCache) Files(match func(name string) bool) []cacheFileInfo {
+	c.mu.Lock()
+	var files []cacheFileInfo
+	for name, e := range c.entries {
+		if match(name) {
+			files = append(files, cacheFileInfo{Name: name, ETag: e.info.ETag, Bytes: e.info.Size})
+		}
+	}
+	c.mu.Unlock()
+	sortCacheFiles(files)
+	return files
+}
+
+// Purge deletes the stored objects whose name satisfies match and forgets
+// the origin answers for them, so the next request revalidates at once.
+// A fill in flight still installs its version, which the next revalidation
+// replaces if the origin has moved on.
+func (c *ShieldCache) Purge(match func(name string) bool) (objects int, bytes int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for name, e := range c.entries {
+		if match(name) {
+			objects++
+			bytes += e.info.Size
+			c.removeEntry(e)
+		}
+	}
+	for name := range c.checked {
+		if match(name) {
+			delete(c.checked, name)
+		}
+	}
+	return objects, bytes
+}
+
+// Stats returns a snapshot of the shield counters
+func (c *ShieldCache) Stats() ShieldStats {
+	c.mu.Lock()
+	items, fills, size, maxSize := len(c.entries), len(c.fills), c.size, c.maxSize
+	c.mu.Unlock()
+
+	return ShieldStats{
+		Items:         items,
+		Fills:         fills,
+		Size:          size,
+		MaxSize:       maxSize,
+		Hits:          c.hits.Load(),
+		Misses:        c.misses.Load(),
+		Coalesced:     c.coalesced.Load(),
+		Evictions:     c.evictions.Load(),
+		UpstreamBytes: c.upstreamBytes.Load(),
+	}
+}
+
+// shieldFill downloads one object version into a temporary file
+type shieldFill struct {
+	cache *ShieldCache
+	info  ObjectInfo
+	temp  string
+
+	mu      sync.Mutex
+	written int64
+	err     error
+	done    bool
+	changed chan struct{} // closed and replaced whenever the fields above change
+}
+
+// run fetches the whole object. It is not tied to any client request, so the
+// object is completed even if the client that started it goes away.
+func (f *shieldFill) run(origin *originStorage, file *os.File) {
+	err := f.download(origin, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err = f.cache.finish(f, err); err != nil {
+		logger.Warn("shield fill failed", "object", f.info.Name, "error", err)
+	}
+
+	f.mu.Lock()
+	f.err, f.done = err, true
+	close(f.changed)
+	f.mu.Unlock()
+}
+
+func (f *shieldFill) download(origin *originStorage, file *os.File) error {
+	timeout := shieldFillIdleTimeout
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	idle := time.AfterFunc(timeout, cancel)
+	defer idle.Stop()
+	stalled := func(err error) error {
+		if ctx.Err() != nil {
+			return fmt.Errorf("origin sent nothing for %s: %w", timeout, err)
+		}
+		return err
+	}
+
+	body, err := origin.fetch(ctx, f.info, 0, f.info.Size)
+	if err != nil {
+		return stalled(err)
+	}
+	defer body.Close()
+
+	buf := make([]byte, cacheBlockSize)
+	var written int64
+	for written < f.info.Size {
+		n, err := body.Read(buf)
+		if n > 0 {
+			idle.Reset(timeout)
+			if _, err := file.Write(buf[:n]); err != nil {
+				return err
+			}
+			written += int64(n)
+			f.cache.upstreamBytes.Add(int64(n))
+			f.advance(written)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stalled(err)
+		}
+	}
+	if written != f.info.Size {
+		return fmt.Errorf("got %d of %d bytes: %w", written, f.info.Size, io.ErrUnexpectedEOF)
+	}
+	return nil
+}
+
+func (f *shieldFill) advance(written int64) {
+	f.mu.Lock()
+	f.written = written
+	close(f.changed)
+	f.changed = make(chan struct{})
+	f.mu.Unlock()
+}
+
+func (f *shieldFill) state() (written int64, err error, changed chan struct{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.written, f.err, f.changed
+}
+
+// shieldReader reads an object while its fill is running: from the partial
+// file where the fill has got to, from the origin where it is far behind
+type shieldReader struct {
+	ctx    context.Context
+	fill   *shieldFill
+	origin *originStorage
+	file   *os.File
+
+	mu     sync.Mutex
+	direct Object
+}
+
+func (r *shieldReader) Info() ObjectInfo { return r.fill.info }
+
+func (r *shieldReader) Close() error {
+	r.mu.Lock()
+	if r.direct != nil {
+		r.direct.Close()
+	}
+	r.mu.Unlock()
+	return r.file.Close()
+}
+
+func (r *shieldReader) ReadAt(p []byte, off int64) (int, error) {
+	size := r.fill.info.Size
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end > size {
+		end = size
+	}
+
+	for {
+		written, err, changed := r.fill.state()
+		if end <= written {
+			n, err := r.file.ReadAt(p[:end-off], off)
+			if err == nil && n < len(p) {
+				err = io.EOF
+			}
+			return n, err
+		}
+		if err != nil || off > written+shieldWaitWindow {
+			return r.originObject().ReadAt(p, off)
+		}
+		select {
+		case <-changed:
+		case <-r.ctx.Done():
+			return 0, r.ctx.Err()
+		}
+	}
+}
+
+func (r *shieldReader) originObject() Object {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.direct == nil {
+		r.direct = r.origin.object(r.ctx, r.fill.info)
+	}
+	return r.direct
+}
+
+// shieldStorage is an origin store fronted by the shield cache
+type shieldStorage struct {
+	cache  *ShieldCache
+	origin *originStorage
+}
+
+// Stat answers from the remembered origin answer while it is fresh. When the
+// origin cannot be reached, a stored copy is served as is.
+func (s *shieldStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	if _, err := splitKey(key); err != nil {
+		return ObjectInfo{}, err
+	}
+	name := s.origin.name(key)
+	if info, err, ok := s.cache.lookup(name); ok {
+		return info, err
+	}
+
+	info, err := s.origin.Stat(ctx, key)
+	switch {
+	case err == nil:
+		s.cache.remember(name, info, nil)
+	case errors.Is(err, fs.ErrNotExist):
+		s.cache.remember(name, ObjectInfo{}, fmt.Errorf("origin: %s: %w", key, fs.ErrNotExist))
+	default:
+		if stored, ok := s.cache.stored(name); ok && ctx.Err() == nil {
+			logger.Warn("origin unavailable, serving shield copy", "object", name, "error", err)
+			return stored, nil
+		}
+	}
+	return info, err
+}
+
+func (s *shieldStorage) Open(ctx context.Context, key string) (Object, error) {
+	info, err := s.Stat(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if obj, ok := s.cache.open(info); ok {
+		s.cache.hits.Add(1)
+		return obj, nil
+	}
+	// Without a validator a stored copy could never be checked
+	if info.ETag == "" {
+		return s.origin.object(ctx, info), nil
+	}
+
+	f := s.cache.fill(s.origin, info)
+	if f == nil {
+		return s.origin.object(ctx, info), nil
+	}
+	file, err := os.Open(f.temp)
+	if err != nil {
+		// The fill has already been installed or discarded
+		if obj, ok := s.cache.open(info); ok {
+			return obj, nil
+		}
+		return s.origin.object(ctx, info), nil
+	}
+	return &shieldReader{ctx: ctx, fill: f, origin: s.origin, file: file}, nil
+}
+
+func (s *shieldStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	return s.origin.List(ctx, prefix)
+}
@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testOrigin is an upstream instance serving the local test stores. Full
+// GETs, the ones shield fills make, wait until release is closed.
+type testOrigin struct {
+	*httptest.Server
+	heads   atomic.Int64
+	fills   atomic.Int64
+	ranges  atomic.Int64
+	release chan struct{}
+}
+
+func setupShield(t *testing.T, maxSize int64) (*testOrigin, *shieldStorage) {
+	t.Helper()
+	setupStorage(t)
+	var err error
+	if config.SigningKeys, err = parseKeyring("k1:origin-secret", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	origin := &testOrigin{release: make(chan struct{})}
+	router := newRouter()
+	origin.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "HEAD":
+			origin.heads.Add(1)
+		case r.Header.Get("Range") != "":
+			origin.ranges.Add(1)
+		default:
+			origin.fills.Add(1)
+			<-origin.release
+		}
+		router.ServeHTTP(w, r)
+	}))
+	t.Cleanup(origin.Close)
+
+	cache, err := openShieldCache(t.TempDir(), maxSize, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newOriginClient(origin.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return origin, &shieldStorage{cache: cache, origin: &originStorage{client: client, store: "videos"}}
+}
+
+func putVideo(t *testing.T, name string, size int) []byte {
+	t.Helper()
+	data := make([]byte, size)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	path := filepath.Join(config.VideoBasePath, testUUID, name)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// waitFills waits until no shield fill is running
+func waitFills(t *testing.T, c *ShieldCache) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().Fills > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("shield fill did not finish")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func readAll(t *testing.T, obj Object) []byte {
+	t.Helper()
+	data, err := io.ReadAll(io.NewSectionReader(obj, 0, obj.Info().Size))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestShieldCoalescesMisses(t *testing.T) {
+	origin, store := setupShield(t, 64<<20)
+	video := putVideo(t, "stream.mp4", 1<<20)
+	ctx := context.Background()
+	key := testUUID + "/stream.mp4"
+
+	// Every client opens while the single upstream fetch is held back
+	var objects []Object
+	for i := 0; i < 8; i++ {
+		obj, err := store.Open(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		objects = append(objects, obj)
+	}
+
+	var wg sync.WaitGroup
+	for _, obj := range objects {
+		wg.Add(1)
+		go func(obj Object) {
+			defer wg.Done()
+			defer obj.Close()
+			if got := readAll(t, obj); !bytes.Equal(got, video) {
+				t.Errorf("read %d bytes, want the %d byte object", len(got), len(video))
+			}
+		}(obj)
+	}
+	close(origin.release)
+	wg.Wait()
+	waitFills(t, store.cache)
+
+	if n := origin.fills.Load(); n != 1 {
+		t.Errorf("upstream fetches = %d, want 1", n)
+	}
+	if n := origin.heads.Load(); n != 1 {
+		t.Errorf("upstream HEADs = %d, want 1 within the revalidate interval", n)
+	}
+	stats := store.cache.Stats()
+	if stats.Misses != 1 || stats.Coalesced != 7 || stats.Items != 1 || stats.Size != int64(len(video)) {
+		t.Errorf("stats after fill = %+v", stats)
+	}
+	if stats.UpstreamBytes != int64(len(video)) {
+		t.Errorf("upstream bytes = %d, want %d", stats.UpstreamBytes, len(video))
+	}
+
+	// Later opens are served from disk
+	obj, err := store.Open(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := obj.(*localObject); !ok {
+		t.Errorf("Open after fill returned %T, want a file on disk", obj)
+	}
+	if got := readAll(t, obj); !bytes.Equal(got, video) {
+		t.Error("cached copy differs from the origin object")
+	}
+	obj.Close()
+	if hits := store.cache.Stats().Hits; hits != 1 || origin.fills.Load() != 1 {
+		t.Errorf("hits = %d, upstream fetches = %d", hits, origin.fills.Load())
+	}
+
+	// With the origin gone, the stored copy is still served
+	origin.Close()
+	store.cache.revalidate = 0
+	if info, err := store.Stat(ctx, key); err != nil || info.Size != int64(len(video)) {
+		t.Errorf("Stat with origin down = %+v, %v", info, err)
+	}
+}
+
+func TestShieldReadAheadOfFill(t *testing.T) {
+	origin, store := setupShield(t, 64<<20)
+	video := putVideo(t, "stream.mp4", 2*shieldWaitWindow)
+
+	obj, err := store.Open(context.Background(), testUUID+"/stream.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+
+	// A seek far past the stalled fill is read straight from the origin
+	off := int64(len(video) - 1000)
+	buf := make([]byte, 1000)
+	if n, err := obj.ReadAt(buf, off); n != len(buf) || (err != nil && err != io.EOF) {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(buf, video[off:]) {
+		t.Error("range read ahead of the fill returned wrong bytes")
+	}
+	if origin.ranges.Load() == 0 {
+		t.Error("no range request sent to the origin")
+	}
+	close(origin.release)
+	waitFills(t, store.cache)
+}
+
+func TestShieldStalledFill(t *testing.T) {
+	origin, store := setupShield(t, 64<<20)
+	defer close(origin.release)
+	video := putVideo(t, "stream.mp4", 1<<20)
+	shieldFillIdleTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { shieldFillIdleTimeout = 30 * time.Second })
+
+	obj, err := store.Open(context.Background(), testUUID+"/stream.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer obj.Close()
+
+	// The fill gives up on the silent origin and the reader falls back
+	if got := readAll(t, obj); !bytes.Equal(got, video) {
+		t.Errorf("read %d bytes, want the %d byte object", len(got), len(video))
+	}
+	waitFills(t, store.cache)
+	if stats := store.cache.Stats(); stats.Items != 0 || stats.Size != 0 {
+		t.Errorf("stats after a stalled fill = %+v", stats)
+	}
+	if origin.ranges.Load() == 0 {
+		t.Error("no range request sent to the origin")
+	}
+}
+
+func TestOriginListPages(t *testing.T) {
+	origin, store := setupShield(t, 64<<20)
+	close(origin.release)
+	const files = originListLimit + 5
+	for i := 0; i < files; i++ {
+		putVideo(t, fmt.Sprintf("part-%04d.bin", i), 1)
+	}
+
+	infos, err := store.List(context.Background(), testUUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(infos) != files {
+		t.Fatalf("listed %d objects, want %d", len(infos), files)
+	}
+	for i, info := range infos {
+		if want := fmt.Sprintf("%s/part-%04d.bin", testUUID, i); info.Key != want {
+			t.Fatalf("object %d is %q, want %q", i, info.Key, want)
+		}
+	}
+
+	// A short page is marked as cut short and continues after its last key
+	token, err := signToken(tokenClaims{Path: "/origin/", Expires: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest("GET", "/origin/videos?prefix="+testUUID+"&limit=2&after="+testUUID+"/part-0001.bin", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, req)
+	var page []originListEntry
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != 2 || page[0].Key != testUUID+"/part-0002.bin" || rec.Header().Get("X-List-Truncated") == "" {
+		t.Errorf("page = %+v, truncated %q", page, rec.Header().Get("X-List-Truncated"))
+	}
+}
+
+func TestShieldEvictionAndRebuild(t *testing.T) {
+	origin, store := setupShield(t, 2500)
+	close(origin.release)
+	ctx := context.Background()
+
+	for _, name := range []string{"a.mp4", "b.mp4", "c.mp4"} {
+		putVideo(t, name, 1000)
+		obj, err := store.Open(ctx, testUUID+"/"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		readAll(t, obj)
+		obj.Close()
+		waitFills(t, store.cache)
+	}
+
+	stats := store.cache.Stats()
+	if stats.Items != 2 || stats.Evictions != 1 || stats.Size > stats.MaxSize {
+		t.Errorf("stats = %+v, want 2 objects after one eviction", stats)
+	}
+	if _, err := os.Stat(store.cache.dataPath(store.origin.name(testUUID + "/a.mp4"))); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("evicted object still on disk: %v", err)
+	}
+
+	// Partial downloads are dropped and complete objects kept on reopen
+	os.WriteFile(filepath.Join(store.cache.dir, shieldTempPrefix+"partial"), []byte("x"), 0o644)
+	reopened, err := openShieldCache(store.cache.dir, 2500, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats := reopened.Stats(); stats.Items != 2 || stats.Size != 2000 {
+		t.Errorf("rebuilt stats = %+v", stats)
+	}
+	if _, err := os.Stat(filepath.Join(store.cache.dir, shieldTempPrefix+"partial")); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("partial download survived reopen")
+	}
+	store.cache = reopened
+	fills := origin.fills.Load()
+	obj, err := store.Open(ctx, testUUID+"/c.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.Close()
+	if origin.fills.Load() != fills || reopened.Stats().Hits != 1 {
+		t.Error("object kept across reopen was fetched again")
+	}
+}
+
+func TestShieldRemembersMisses(t *testing.T) {
+	origin, store := setupShield(t, 1<<20)
+	close(origin.release)
+
+	for i := 0; i < 3; i++ {
+		if _, err := store.Stat(context.Background(), testUUID+"/missing.mp4"); !isNotExist(err) {
+			t.Fatalf("Stat of missing object = %v, want not-exist", err)
+		}
+	}
+	if n := origin.heads.Load(); n != 1 {
+		t.Errorf("upstream HEADs = %d, want the miss remembered", n)
+	}
+}
+
+func TestOriginRequiresToken(t *testing.T) {
+	setupStorage(t)
+	var err error
+	if config.SigningKeys, err = parseKeyring("k1:origin-secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	token, err := signToken(tokenClaims{Path: "/origin/", Expires: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	streamToken, err := signToken(tokenClaims{Path: "/stream/" + testUUID, Expires: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name       string
+		path       string
+		token      string
+		wantStatus int
+	}{
+		{"no token", "/origin/public/" + testUUID + "/stream.mp4", "", 401},
+		{"token for another path", "/origin/public/" + testUUID + "/stream.mp4", streamToken, 401},
+		{"valid token", "/origin/public/" + testUUID + "/stream.mp4", token, 200},
+		{"unknown store", "/origin/secrets/" + testUUID + "/stream.mp4", token, 404},
+		{"missing key", "/origin/hls/" + testUUID + "/missing.ts", token, 404},
+		{"listing", "/origin/hls?prefix=" + testUUID, token, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			newRouter().ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
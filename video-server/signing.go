@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// tokenVersion prefixes every path-scoped token so the format can evolve
+const tokenVersion = "v2"
+
+var (
+	errTokenMalformed  = errors.New("malformed token")
+	errTokenVersion    = errors.New("unsupported token version")
+	errTokenUnknownKey = errors.New("unknown signing key")
+	errTokenSignature  = errors.New("invalid token signature")
+	errTokenExpired    = errors.New("token expired")
+	errTokenPath       = errors.New("token does not cover path")
+	errTokenClient     = errors.New("token bound to another client")
+	errTokenSession    = errors.New("token bound to another session")
+)
+
+// signingKey is one entry of the keyring
+type signingKey struct {
+	ID     string
+	Secret []byte
+}
+
+// tokenClaims is the signed payload of a v2 token
+type tokenClaims struct {
+	KeyID   string `json:"kid"`
+	Expires int64  `json:"exp"`
+	Path    string `json:"path"`          // path prefix the token unlocks
+	IP      string `json:"ip,omitempty"`  // client IP or CIDR
+	Session string `json:"sid,omitempty"` // viewer session id
+
+	// Progressive pacing; either one replaces the configured pace and
+	// max-bandwidth
+	Pace      float64 `json:"pace,omitempty"` // multiple of the file's bitrate
+	Bandwidth int64   `json:"bw,omitempty"`   // bytes per second
+}
+
+// Parse a keyring spec of the form "kid:secret,kid2:secret2". The first key is
+// the current one; the rest are previous keys still accepted for verification.
+// The legacy single secret is appended as kid "default" unless already present.
+func parseKeyring(spec, legacySecret string) ([]signingKey, error) {
+	var keys []signingKey
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		id, secret, ok := strings.Cut(entry, ":")
+		id, secret = strings.TrimSpace(id), strings.TrimSpace(secret)
+		if !ok || id == "" || secret == "" {
+			return nil, fmt.Errorf("invalid key entry %q (want kid:secret)", entry)
+		}
+		if seen[id] {
+			return nil, fmt.Errorf("duplicate key id %q", id)
+		}
+		seen[id] = true
+		keys = append(keys, signingKey{ID: id, Secret: []byte(secret)})
+	}
+
+	if legacySecret != "" && !seen["default"] {
+		keys = append(keys, signingKey{ID: "default", Secret: []byte(legacySecret)})
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.New("no signing keys configured")
+	}
+	return keys, nil
+}
+
+func findSigningKey(id string) (signingKey, bool) {
+	for _, k := range currentConfig().SigningKeys {
+		if k.ID == id {
+			return k, true
+		}
+	}
+	return signingKey{}, false
+}
+
+// Sign claims with the current key, filling in its key id
+func signToken(claims tokenClaims) (string, error) {
+	keys := currentConfig().SigningKeys
+	if len(keys) == 0 {
+		return "", errTokenUnknownKey
+	}
+	key := keys[0]
+	claims.KeyID = key.ID
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signed := tokenVersion + "." + base64.RawURLEncoding.EncodeToString(payload)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(key.Secret, signed)), nil
+}
+
+// Verify a v2 token against the keyring and the request it arrived on
+func verifyToken(token string, r *http.Request) (*tokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errTokenMalformed
+	}
+	if parts[0] != tokenVersion {
+		return nil, errTokenVersion
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errTokenMalformed
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, errTokenMalformed
+	}
+
+	key, ok := findSigningKey(claims.KeyID)
+	if !ok {
+		return nil, errTokenUnknownKey
+	}
+	if !hmac.Equal(sig, tokenMAC(key.Secret, parts[0]+"."+parts[1])) {
+		return nil, errTokenSignature
+	}
+
+	if time.Now().Unix() > claims.Expires {
+		return nil, errTokenExpired
+	}
+	if !pathCovered(claims.Path, r.URL.Path) {
+		return nil, errTokenPath
+	}
+	if claims.IP != "" && !ipAllowed(claims.IP, clientIP(r)) {
+		return nil, errTokenClient
+	}
+	if claims.Session != "" && !sessionMatches(claims.Session, r) {
+		return nil, errTokenSession
+	}
+
+	return &claims, nil
+}
+
+func tokenMAC(secret []byte, signed string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(signed))
+	return h.Sum(nil)
+}
+
+// Report whether prefix covers path on a path-segment boundary, so that
+// "/hls/abc" covers "/hls/abc/720p/seg.ts" but not "/hls/abcdef"
+func pathCovered(prefix, path string) bool {
+	if prefix == "" || !strings.HasPrefix(prefix, "/") {
+		return false
+	}
+	if path == prefix || strings.HasSuffix(prefix, "/") && strings.HasPrefix(path, prefix) {
+		return true
+	}
+	return strings.HasPrefix(path, prefix+"/")
+}
+
+func ipAllowed(bound string, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(bound); err == nil {
+		return network.Contains(ip)
+	}
+	allowed := net.ParseIP(bound)
+	return allowed != nil && allowed.Equal(ip)
+}
+
+// The session id is read from the configured cookie, or from the
+// X-Playtube-Session header for clients that cannot send cookies
+func sessionMatches(expected string, r *http.Request) bool {
+	actual := r.Header.Get("X-Playtube-Session")
+	if c, err := r.Cookie(currentConfig().SessionCookie); err == nil {
+		actual = c.Value
+	}
+	return actual != "" && subtle.ConstantTimeCompare([]byte(actual), []byte(expected)) == 1
+}
+
+// The claims of the request's valid token, or nil. Like validateRequest it
+// only reads ?token=, so pacing and limits follow the token that authorized
+// the request.
+func requestClaims(r *http.Request) *tokenClaims {
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		return nil
+	}
+	claims, err := verifyToken(token, r)
+	if err != nil {
+		return nil
+	}
+	return claims
+}
+
+// Validate request (signature check)
+func validateRequest(r *http.Request, uuid string) bool {
+	// In development mode, allow all requests
+	if getEnv("APP_ENV", "local") != "production" {
+		return true
+	}
+
+	// Path-scoped token
+	if token := r.URL.Query().Get("token"); token != "" {
+		_, err := verifyToken(token, r)
+		return err == nil
+	}
+
+	if !currentConfig().AcceptLegacySignatures {
+		return false
+	}
+
+	// Legacy signed URL
+	sig := r.URL.Query().Get("sig")
+	expires := r.URL.Query().Get("expires")
+
+	if sig == "" || expires == "" {
+		return false
+	}
+
+	// Check expiration
+	expTime, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expTime {
+		return false
+	}
+
+	// Verify signature against every key so rotation does not break old URLs
+	for _, key := range currentConfig().SigningKeys {
+		expectedSig := generateSignature(key.Secret, uuid, expires)
+		if hmac.Equal([]byte(sig), []byte(expectedSig)) {
+			return true
+		}
+	}
+	return false
+}
+
+func generateSignature(secret []byte, uuid, expires string) string {
+	data := fmt.Sprintf("%s:%s", uuid, expires)
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(data))
+	return hex.EncodeToString(h.Sum(nil))
+}
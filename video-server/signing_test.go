@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	var err error
+	config.SigningKeys, err = parseKeyring("k2:new-secret,k1:old-secret", "legacy-secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SessionCookie = "playtube_vsid"
+	config.TrustedProxies = nil
+
+	exp := time.Now().Add(time.Hour).Unix()
+	sign := func(claims tokenClaims) string {
+		token, err := signToken(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	// A token minted with a previous key must keep working after rotation
+	current := config.SigningKeys
+	config.SigningKeys = current[1:]
+	oldKeyToken := sign(tokenClaims{Expires: exp, Path: "/hls/" + testUUID})
+	config.SigningKeys = current
+
+	tests := []struct {
+		name   string
+		token  string
+		path   string
+		remote string
+		cookie string
+		want   error
+	}{
+		{"covers child path", sign(tokenClaims{Expires: exp, Path: "/hls/" + testUUID}), "/hls/" + testUUID + "/720p/seg_00001.ts", "", "", nil},
+		{"covers exact path", sign(tokenClaims{Expires: exp, Path: "/stream/" + testUUID}), "/stream/" + testUUID, "", "", nil},
+		{"previous key", oldKeyToken, "/hls/" + testUUID + "/master.m3u8", "", "", nil},
+		{"other video", sign(tokenClaims{Expires: exp, Path: "/hls/" + testUUID}), "/hls/" + testUUID + "0/master.m3u8", "", "", errTokenPath},
+		{"other delivery type", sign(tokenClaims{Expires: exp, Path: "/hls/" + testUUID}), "/thumb/" + testUUID, "", "", errTokenPath},
+		{"expired", sign(tokenClaims{Expires: time.Now().Add(-time.Minute).Unix(), Path: "/"}), "/stream/" + testUUID, "", "", errTokenExpired},
+		{"ip match", sign(tokenClaims{Expires: exp, Path: "/", IP: "203.0.113.7"}), "/stream/" + testUUID, "203.0.113.7:5000", "", nil},
+		{"cidr match", sign(tokenClaims{Expires: exp, Path: "/", IP: "203.0.113.0/24"}), "/stream/" + testUUID, "203.0.113.99:5000", "", nil},
+		{"ip mismatch", sign(tokenClaims{Expires: exp, Path: "/", IP: "203.0.113.7"}), "/stream/" + testUUID, "198.51.100.1:5000", "", errTokenClient},
+		{"session match", sign(tokenClaims{Expires: exp, Path: "/", Session: "abc"}), "/stream/" + testUUID, "", "abc", nil},
+		{"session mismatch", sign(tokenClaims{Expires: exp, Path: "/", Session: "abc"}), "/stream/" + testUUID, "", "xyz", errTokenSession},
+		{"tampered payload", sign(tokenClaims{Expires: exp, Path: "/"})[:10] + "x" + sign(tokenClaims{Expires: exp, Path: "/"})[11:], "/stream/" + testUUID, "", "", errTokenMalformed},
+		{"wrong version", "v9.e30.AA", "/stream/" + testUUID, "", "", errTokenVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", tt.path, nil)
+			if tt.remote != "" {
+				req.RemoteAddr = tt.remote
+			}
+			if tt.cookie != "" {
+				req.Header.Set("Cookie", config.SessionCookie+"="+tt.cookie)
+			}
+
+			_, err := verifyToken(tt.token, req)
+			if tt.want == nil && err != nil {
+				t.Fatalf("verifyToken() = %v, want success", err)
+			}
+			if tt.want != nil && err == nil {
+				t.Fatalf("verifyToken() succeeded, want %v", tt.want)
+			}
+		})
+	}
+}
+
+func TestLegacySignatureKeyRotation(t *testing.T) {
+	t.Setenv("APP_ENV", "production")
+	config.AcceptLegacySignatures = true
+	config.SigningKeys, _ = parseKeyring("k2:new-secret", "legacy-secret")
+
+	expires := "9999999999"
+	sig := generateSignature([]byte("legacy-secret"), testUUID, expires)
+	req := httptest.NewRequest("GET", "/stream/"+testUUID+"?expires="+expires+"&sig="+sig, nil)
+	if !validateRequest(req, testUUID) {
+		t.Fatal("legacy signature from the default key was rejected")
+	}
+
+	config.AcceptLegacySignatures = false
+	if validateRequest(req, testUUID) {
+		t.Fatal("legacy signature accepted while legacy signatures are disabled")
+	}
+}
+
+func TestRequestClaimsFollowValidateRequest(t *testing.T) {
+	t.Setenv("APP_ENV", "production")
+	var err error
+	if config.SigningKeys, err = parseKeyring("k1:claims-secret", ""); err != nil {
+		t.Fatal(err)
+	}
+	token, err := signToken(tokenClaims{Path: "/stream/" + testUUID, Pace: 2, Expires: time.Now().Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/stream/"+testUUID+"?token="+token, nil)
+	if claims := requestClaims(req); claims == nil || claims.Pace != 2 || !validateRequest(req, testUUID) {
+		t.Errorf("query token: claims %+v, valid %v", claims, validateRequest(req, testUUID))
+	}
+
+	// A bearer header does not authorize playback, so its claims are ignored
+	req = httptest.NewRequest("GET", "/stream/"+testUUID, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if claims := requestClaims(req); claims != nil || validateRequest(req, testUUID) {
+		t.Errorf("bearer token: claims %+v, valid %v", claims, validateRequest(req, testUUID))
+	}
+}
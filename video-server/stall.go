@@ -0,0 +1,165 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The server has no WriteTimeout, since a stream may legitimately take hours.
+// Instead every write of a media response gets its own deadline of
+// write-idle-timeout, so a response is aborted only when the client accepts
+// no data for that long. Writes are split into small pieces so that a slow
+// but steady client keeps pushing the deadline out.
+
+// Largest write made under one deadline, and largest sendfile call
+const (
+	stallWriteSize    = 64 * 1024
+	stallSendfileSize = 4 << 20
+)
+
+// Reasons a media response ended early
+const (
+	abortClient  = "client_abort"
+	abortStall   = "stall"
+	abortStorage = "storage_error"
+)
+
+var (
+	abortsMu sync.Mutex
+	aborts   = map[string]int64{abortClient: 0, abortStall: 0, abortStorage: 0}
+)
+
+// streamWriter sets a write deadline before every write and remembers the
+// first write error, failing every write after it. A failed read of the
+// body's source is kept apart in readErr.
+type streamWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	idle    time.Duration
+	written int64
+	err     error
+	readErr error
+}
+
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	return &streamWriter{ResponseWriter: w, rc: http.NewResponseController(w), idle: currentConfig().WriteIdleTimeout}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 && s.err == nil {
+		s.deadline(time.Now().Add(s.idle))
+		m, err := s.ResponseWriter.Write(p[:min(len(p), stallWriteSize)])
+		n += m
+		s.written += int64(m)
+		s.err = err
+		p = p[m:]
+	}
+	return n, s.err
+}
+
+// ReadFrom passes src on to the underlying writer in pieces, each under its
+// own deadline. A file handed over as an io.LimitedReader stays one, so
+// net/http can still send it with sendfile.
+func (s *streamWriter) ReadFrom(src io.Reader) (int64, error) {
+	limited, isLimited := src.(*io.LimitedReader)
+	var n int64
+	for s.err == nil {
+		piece := &io.LimitedReader{R: src, N: stallSendfileSize}
+		if isLimited {
+			piece.R, piece.N = limited.R, min(limited.N, stallSendfileSize)
+		}
+		if piece.N <= 0 {
+			break
+		}
+		want := piece.N
+
+		s.deadline(time.Now().Add(s.idle))
+		m, readFailed, err := copyFrom(s.ResponseWriter, piece)
+		n += m
+		s.written += m
+		if isLimited {
+			limited.N -= m
+		}
+		if readFailed {
+			s.readErr = err
+			return n, err
+		}
+		s.err = err
+		if m < want {
+			break
+		}
+	}
+	return n, s.err
+}
+
+// deadline sets the write deadline when idle detection is on. Writers without
+// deadline support, like test recorders, are left alone.
+func (s *streamWriter) deadline(t time.Time) {
+	if s.idle > 0 {
+		s.rc.SetWriteDeadline(t)
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (s *streamWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// finish flushes the response under the deadline, then clears it for the
+// next request on the connection, and records how the response ended
+func (s *streamWriter) finish(r *http.Request, key string) {
+	if s.err == nil && s.readErr == nil && s.written > 0 {
+		s.deadline(time.Now().Add(s.idle))
+		if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+			s.err = err
+		}
+	}
+	s.deadline(time.Time{})
+
+	err, reason := s.err, abortClient
+	switch {
+	case err == nil && s.readErr != nil && r.Context().Err() == nil:
+		err, reason = s.readErr, abortStorage
+	case err == nil:
+		// A paced write gives up without reaching us when the client leaves,
+		// and a storage read is cancelled with the request
+		err = r.Context().Err()
+	}
+	if err == nil {
+		return
+	}
+	if reason == abortClient && errors.Is(err, os.ErrDeadlineExceeded) {
+		reason = abortStall
+	}
+	abortsMu.Lock()
+	aborts[reason]++
+	abortsMu.Unlock()
+
+	attrs := []any{"request_id", requestID(r.Context()), "key", key, "reason", reason,
+		"bytes", s.written, "client_ip", clientIP(r).String(), "error", err}
+	switch reason {
+	case abortStall:
+		logger.Warn("stream stalled", attrs...)
+	case abortStorage:
+		logger.Error("stream storage read failed", attrs...)
+	default:
+		// Players cancel requests on every seek, so this is routine
+		logger.Debug("stream aborted", attrs...)
+	}
+}
+
+// streamAborts returns the abort counters by reason
+func streamAborts() map[string]int64 {
+	abortsMu.Lock()
+	defer abortsMu.Unlock()
+	counts := make(map[string]int64, len(aborts))
+	for reason, n := range aborts {
+		counts[reason] = n
+	}
+	return counts
+}
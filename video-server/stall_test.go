@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStalledStreamsAreAborted(t *testing.T) {
+	setupStorage(t)
+	// Larger than the socket buffers, so a client that stops reading blocks writes
+	const size = 16 << 20
+	stream := filepath.Join(config.PublicBasePath, testUUID, "stream.mp4")
+	if err := os.WriteFile(stream, make([]byte, size), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config.WriteIdleTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { config.WriteIdleTimeout = 0 })
+
+	server := httptest.NewServer(newRouter())
+	defer server.Close()
+
+	request := func(t *testing.T) (net.Conn, *http.Response) {
+		t.Helper()
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Keep the kernel from buffering the whole file for the client
+		conn.(*net.TCPConn).SetReadBuffer(64 << 10)
+		fmt.Fprintf(conn, "GET /stream/%s HTTP/1.1\r\nHost: test\r\n\r\n", testUUID)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, resp
+	}
+
+	tests := []struct {
+		name   string
+		reason string
+		client func(net.Conn, *http.Response)
+	}{
+		// Stop reading; the connection stays open until the server gives up
+		{"stall", abortStall, func(conn net.Conn, resp *http.Response) {}},
+		{"client abort", abortClient, func(conn net.Conn, resp *http.Response) {
+			io.CopyN(io.Discard, resp.Body, 1<<20)
+			conn.Close()
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := streamAborts()
+			conn, resp := request(t)
+			defer conn.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status %d", resp.StatusCode)
+			}
+			tt.client(conn, resp)
+			waitFor(t, tt.reason, func() bool { return streamAborts()[tt.reason] == before[tt.reason]+1 })
+		})
+	}
+
+	// The stream before an abort is served in full
+	conn, resp := request(t)
+	defer conn.Close()
+	if n, err := io.Copy(io.Discard, resp.Body); err != nil || n != size {
+		t.Errorf("read %d bytes, %v", n, err)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Storage is a read-only view of one storage root: private videos, public
+// files or HLS renditions. Keys are slash-separated paths relative to the
+// root, e.g. "<uuid>/720p/playlist.m3u8". Missing keys report fs.ErrNotExist.
+type Storage interface {
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Open(ctx context.Context, key string) (Object, error)
+	List(ctx context.Context, prefix string) ([]ObjectInfo, error)
+}
+
+// ObjectInfo describes one stored file
+type ObjectInfo struct {
+	Key     string // relative to the storage root
+	Name    string // unique across backends, used in cache keys and logs
+	Size    int64
+	ModTime time.Time
+	ETag    string // strong validator
+}
+
+// Object is an open stored file. Reads past the end return io.EOF.
+type Object interface {
+	io.ReaderAt
+	io.Closer
+	Info() ObjectInfo
+}
+
+// Reads from remote objects smaller than this fetch this much and keep it, so
+// box and packet parsers issuing many small reads cost one request
+const remoteReadAhead = 256 * 1024
+
+// storedFile names a key in one of the stores
+type storedFile struct {
+	store Storage
+	key   string
+}
+
+// Split a key into path elements, rejecting empty, dot and dot-dot elements
+// so no backend can be walked outside its root
+func splitKey(key string) ([]string, error) {
+	elems := strings.Split(key, "/")
+	for _, e := range elems {
+		if !validPathElem(e) {
+			return nil, errInvalidPathParam
+		}
+	}
+	return elems, nil
+}
+
+// Build the three stores from the configured driver. Stores are opened once
+// at startup and kept across reloads.
+func openStores(c *Config) error {
+	var shield *ShieldCache
+	if c.StorageDriver == "origin" {
+		var err error
+		if shield, err = openShieldCache(c.ShieldCachePath, c.ShieldCacheSize, c.OriginRevalidate); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range []struct {
+		store *Storage
+		name  string // store name on an origin server
+		root  string
+	}{
+		{&c.VideoStore, "videos", c.VideoBasePath},
+		{&c.PublicStore, "public", c.PublicBasePath},
+		{&c.HLSStore, "hls", c.HLSBasePath},
+	} {
+		store, err := newStorage(c, s.name, s.root)
+		if err != nil {
+			return err
+		}
+		if shield != nil {
+			store = &shieldStorage{cache: shield, origin: store.(*originStorage)}
+		}
+		*s.store = store
+	}
+	shieldCache = shield
+	return nil
+}
+
+// Build the store for one root from the configured driver
+func newStorage(c *Config, name, root string) (Storage, error) {
+	switch c.StorageDriver {
+	case "local":
+		return &localStorage{root: root}, nil
+	case "s3":
+		client, err := newS3Client(c)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Storage{client: client, prefix: s3Prefix(root)}, nil
+	case "origin":
+		client, err := newOriginClient(c.OriginURL)
+		if err != nil {
+			return nil, err
+		}
+		return &originStorage{client: client, store: name}, nil
+	}
+	return nil, fmt.Errorf("unknown storage driver %q", c.StorageDriver)
+}
+
+// Stat each candidate in order and return the first that exists
+func findStoredFile(ctx context.Context, candidates []storedFile) (storedFile, bool) {
+	f, _, _, err := resolveStoredFile(ctx, candidates)
+	return f, err == nil
+}
+
+// resolveStoredFile is findStoredFile reporting the file's info and the Stat
+// calls made. The error is fs.ErrNotExist only if every candidate is missing,
+// otherwise the last other failure.
+func resolveStoredFile(ctx context.Context, candidates []storedFile) (storedFile, ObjectInfo, int, error) {
+	stats := 0
+	lastErr := fs.ErrNotExist
+	for _, f := range candidates {
+		if f.store == nil {
+			continue
+		}
+		stats++
+		info, err := f.store.Stat(ctx, f.key)
+		if err == nil {
+			return f, info, stats, nil
+		}
+		if !isNotExist(err) {
+			lastErr = err
+		}
+	}
+	return storedFile{}, ObjectInfo{}, stats, lastErr
+}
+
+// localStorage serves files from a directory, confined by resolvePath
+type localStorage struct {
+	root string
+}
+
+type localObject struct {
+	*os.File
+	info ObjectInfo
+}
+
+func (o *localObject) Info() ObjectInfo { return o.info }
+
+func (s *localStorage) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	elems, err := splitKey(key)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	path, stat, err := resolveFile(s.root, elems...)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return localInfo(key, path, stat), nil
+}
+
+func (s *localStorage) Open(ctx context.Context, key string) (Object, error) {
+	elems, err := splitKey(key)
+	if err != nil {
+		return nil, err
+	}
+	path, err := resolvePath(s.root, elems...)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Stat the open file so the info matches what is read
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !stat.Mode().IsRegular() {
+		file.Close()
+		return nil, fs.ErrNotExist
+	}
+	return &localObject{File: file, info: localInfo(key, path, stat)}, nil
+}
+
+// List the regular files under the directory prefix, recursively
+func (s *localStorage) List(ctx context.Context, prefix string) ([]ObjectInfo, error) {
+	dir := s.root
+	if prefix = strings.Trim(prefix, "/"); prefix != "" {
+		elems, err := splitKey(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if dir, err = resolvePath(s.root, elems...); err != nil {
+			return nil, err
+		}
+	}
+
+	var infos []ObjectInfo
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		key := filepath.ToSlash(rel)
+		if prefix != "" {
+			key = prefix + "/" + key
+		}
+		// Stat through the store so symlinks leaving the roots are skipped
+		if info, err := s.Stat(ctx, key); err == nil {
+			infos = append(infos, info)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
+func localInfo(key, path string, stat os.FileInfo) ObjectInfo {
+	return ObjectInfo{
+		Key:     key,
+		Name:    path,
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		ETag:    fileETag(stat),
+	}
+}
+
+// Report whether err means the key does not exist in its store
+func isNotExist(err error) bool {
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, errInvalidPathParam) || errors.Is(err, errOutsideRoot)
+}
+
+// rangedObject reads a remote object through range requests
+type rangedObject struct {
+	info  ObjectInfo
+	fetch func(off, length int64) (io.ReadCloser, error)
+
+	mu     sync.Mutex
+	window []byte // last read-ahead fetch
+	offset int64  // object offset of window
+}
+
+func (o *rangedObject) Info() ObjectInfo { return o.info }
+
+func (o *rangedObject) Close() error {
+	o.mu.Lock()
+	o.window = nil
+	o.mu.Unlock()
+	return nil
+}
+
+func (o *rangedObject) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= o.info.Size {
+		return 0, io.EOF
+	}
+	want := int64(len(p))
+	if off+want > o.info.Size {
+		want = o.info.Size - off
+	}
+
+	var n int
+	if want >= remoteReadAhead {
+		// Large reads go straight into p
+		body, err := o.fetch(off, want)
+		if err != nil {
+			return 0, err
+		}
+		n, err = io.ReadFull(body, p[:want])
+		body.Close()
+		if err != nil {
+			return n, err
+		}
+	} else {
+		o.mu.Lock()
+		if off < o.offset || off+want > o.offset+int64(len(o.window)) {
+			if err := o.readAhead(off); err != nil {
+				o.mu.Unlock()
+				return 0, err
+			}
+		}
+		n = copy(p, o.window[off-o.offset:off-o.offset+want])
+		o.mu.Unlock()
+	}
+
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Replace the window with remoteReadAhead bytes from off; callers hold o.mu
+func (o *rangedObject) readAhead(off int64) error {
+	length := int64(remoteReadAhead)
+	if off+length > o.info.Size {
+		length = o.info.Size - off
+	}
+	body, err := o.fetch(off, length)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	window := make([]byte, length)
+	if _, err := io.ReadFull(body, window); err != nil {
+		return err
+	}
+	o.window, o.offset = window, off
+	return nil
+}
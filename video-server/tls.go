@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// With tls-cert and tls-key set the server terminates TLS itself and offers
+// HTTP/2, so hls.js can fetch playlists and segments over one multiplexed
+// connection without a proxy in front. The key pair is read again when
+// either file changes on disk, as certificate renewal or a mounted secret
+// update does, and on SIGHUP. A pair that fails to load is logged and the
+// previous certificate stays in use.
+
+// How often the certificate files are checked for changes
+var certCheckInterval = 30 * time.Second
+
+// certReloader serves the current certificate to TLS handshakes
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu    sync.RWMutex
+	cert  *tls.Certificate
+	stamp string // size and mtime of both files at the last load
+
+	reloads  atomic.Int64
+	failures atomic.Int64
+	stop     chan struct{}
+	once     sync.Once
+}
+
+var certs *certReloader
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile, stop: make(chan struct{})}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+	go c.watch(certCheckInterval)
+	return c, nil
+}
+
+// fileStamp identifies the versions of the certificate and key files
+func (c *certReloader) fileStamp() string {
+	stamp := ""
+	for _, name := range []string{c.certFile, c.keyFile} {
+		if fi, err := os.Stat(name); err == nil {
+			stamp += fmt.Sprintf("%d:%d;", fi.Size(), fi.ModTime().UnixNano())
+		}
+	}
+	return stamp
+}
+
+func (c *certReloader) load() error {
+	stamp := c.fileStamp()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("tls certificate: %w", err)
+	}
+	if cert.Leaf == nil {
+		// Parsed by LoadX509KeyPair only from Go 1.23 on
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return fmt.Errorf("tls certificate: %w", err)
+		}
+	}
+
+	c.mu.Lock()
+	c.cert, c.stamp = &cert, stamp
+	c.mu.Unlock()
+	return nil
+}
+
+// Reload reads the key pair again, keeping the current one if that fails
+func (c *certReloader) Reload() {
+	if err := c.load(); err != nil {
+		c.failures.Add(1)
+		logger.Error("cannot reload tls certificate, keeping the current one", "cert", c.certFile, "error", err)
+		return
+	}
+	c.reloads.Add(1)
+	logger.Info("tls certificate loaded", "cert", c.certFile, "not_after", c.NotAfter())
+}
+
+// watch reloads the key pair when either file changes
+func (c *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+		}
+		c.mu.RLock()
+		stamp := c.stamp
+		c.mu.RUnlock()
+		if current := c.fileStamp(); current != stamp {
+			c.Reload()
+			// A half-written pair fails to load; try again only after the
+			// files change once more
+			c.mu.Lock()
+			c.stamp = current
+			c.mu.Unlock()
+		}
+	}
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert, nil
+}
+
+// NotAfter is the expiry of the certificate in use
+func (c *certReloader) NotAfter() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert.Leaf.NotAfter
+}
+
+func (c *certReloader) Close() {
+	c.once.Do(func() { close(c.stop) })
+}
+
+// Build the HTTP server for cfg. The certificate reloader is nil without TLS.
+func newServer(cfg *Config, handler http.Handler) (*http.Server, *certReloader, error) {
+	server := &http.Server{
+		Addr:              fmt.Sprintf(":%d", cfg.Port),
+		Handler:           handler,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      0, // Streams use per-write idle deadlines instead
+		IdleTimeout:       120 * time.Second,
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    1 << 20, // 1MB
+	}
+	if cfg.TLSCert == "" {
+		return server, nil, nil
+	}
+
+	reloader, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.GetCertificate,
+	}
+	if !cfg.HTTP2 {
+		// A non-nil empty map turns off the built-in HTTP/2 support
+		server.TLSNextProto = make(map[string]func(*http.Server, *tls.Conn, http.Handler))
+		return server, reloader, nil
+	}
+	err = http2.ConfigureServer(server, &http2.Server{
+		MaxConcurrentStreams: uint32(cfg.HTTP2MaxStreams),
+		IdleTimeout:          server.IdleTimeout,
+	})
+	if err != nil {
+		reloader.Close()
+		return nil, nil, err
+	}
+	return server, reloader, nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Write a self-signed certificate for 127.0.0.1 with the given serial to
+// certFile and keyFile, returning it
+func writeTestCert(t *testing.T, certFile, keyFile string, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "playtube test"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Key first, so a watcher never sees the new certificate with the old key
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert
+}
+
+// Start a server for cfg on a loopback port, returning its address
+func startTLSServer(t *testing.T, cfg *Config) (string, *certReloader) {
+	t.Helper()
+	server, reloader, err := newServer(cfg, newRouter())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.ServeTLS(ln, "", "")
+	t.Cleanup(func() {
+		server.Close()
+		reloader.Close()
+	})
+	return ln.Addr().String(), reloader
+}
+
+func TestTLSServer(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config
+	cfg.TLSCert, cfg.TLSKey = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cfg.HTTP2MaxStreams = 50
+	cert := writeTestCert(t, cfg.TLSCert, cfg.TLSKey, 1)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	for _, http2 := range []bool{true, false} {
+		cfg.HTTP2 = http2
+		addr, _ := startTLSServer(t, &cfg)
+		client := &http.Client{Transport: &http.Transport{
+			TLSClientConfig:   &tls.Config{RootCAs: roots},
+			ForceAttemptHTTP2: true,
+		}}
+		resp, err := client.Get("https://" + addr + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		wantProto := 1
+		if http2 {
+			wantProto = 2
+		}
+		if resp.StatusCode != http.StatusOK || resp.ProtoMajor != wantProto {
+			t.Errorf("http2=%v: status %d over HTTP/%d, want 200 over HTTP/%d", http2, resp.StatusCode, resp.ProtoMajor, wantProto)
+		}
+	}
+}
+
+func TestCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	cfg := config
+	cfg.TLSCert, cfg.TLSKey = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	cfg.HTTP2, cfg.HTTP2MaxStreams = true, 50
+	writeTestCert(t, cfg.TLSCert, cfg.TLSKey, 1)
+	certCheckInterval = 10 * time.Millisecond
+	t.Cleanup(func() { certCheckInterval = 30 * time.Second })
+	addr, reloader := startTLSServer(t, &cfg)
+
+	serial := func() int64 {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+	}
+	if got := serial(); got != 1 {
+		t.Fatalf("serial %d, want 1", got)
+	}
+
+	// Renewed on disk
+	writeTestCert(t, cfg.TLSCert, cfg.TLSKey, 2)
+	waitFor(t, "the renewed certificate", func() bool { return serial() == 2 })
+
+	// A broken file keeps the current certificate
+	if err := os.WriteFile(cfg.TLSCert, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the failed reload", func() bool { return reloader.failures.Load() > 0 })
+	if got := serial(); got != 2 {
+		t.Errorf("serial %d after a failed reload, want 2", got)
+	}
+
+	// SIGHUP reloads whether or not the files look changed
+	reloader.Close()
+	writeTestCert(t, cfg.TLSCert, cfg.TLSKey, 3)
+	reloader.Reload()
+	if got := serial(); got != 3 {
+		t.Errorf("serial %d after Reload, want 3", got)
+	}
+}
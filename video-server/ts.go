@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// Minimal MPEG-2 transport stream prober: enough of PAT/PMT, PES and the
+// codec bitstreams to describe an HLS .ts segment for the master playlist.
+
+const (
+	tsPacketSize = 188
+	tsProbeLimit = 4 << 20 // bytes of a segment to scan before giving up
+	tsMaxESBytes = 512 << 10
+	tsPTSSamples = 16
+)
+
+var errNotTransportStream = errors.New("ts: no sync byte")
+
+// tsStream describes one elementary stream of a transport stream
+type tsStream struct {
+	PID        uint16
+	StreamType byte
+	Codec      string // RFC 6381 codec string, e.g. avc1.64001f
+	Video      bool
+	Width      int
+	Height     int
+	FrameRate  float64 // 0 if unknown
+
+	es     []byte  // elementary stream bytes collected until parsed
+	parsed bool    // codec parameters found in es
+	pts    []int64 // presentation timestamps of the first PES packets
+}
+
+func (s *tsStream) probed() bool {
+	if s.Codec == "" {
+		return false
+	}
+	return !s.Video || (s.parsed && (s.FrameRate > 0 || len(s.pts) >= tsPTSSamples))
+}
+
+// Probe the elementary streams of a transport stream segment
+func probeTS(r io.ReaderAt, size int64) ([]*tsStream, error) {
+	if size > tsProbeLimit {
+		size = tsProbeLimit
+	}
+	data := make([]byte, size)
+	n, err := r.ReadAt(data, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	data = data[:n]
+
+	pmtPID := -1
+	var streams []*tsStream
+	byPID := make(map[uint16]*tsStream)
+
+	for off := 0; off+tsPacketSize <= len(data); off += tsPacketSize {
+		pkt := data[off : off+tsPacketSize]
+		if pkt[0] != 0x47 {
+			return nil, errNotTransportStream
+		}
+		pid := binary.BigEndian.Uint16(pkt[1:3]) & 0x1fff
+		start := pkt[1]&0x40 != 0
+		payload := tsPayload(pkt)
+		if payload == nil {
+			continue
+		}
+
+		switch {
+		case pid == 0 && start && pmtPID < 0:
+			pmtPID = parsePAT(payload)
+		case int(pid) == pmtPID && start && streams == nil:
+			streams = parsePMT(payload)
+			for _, s := range streams {
+				byPID[s.PID] = s
+			}
+		default:
+			s, ok := byPID[pid]
+			if !ok || s.probed() {
+				continue
+			}
+			if start {
+				// Look for parameters once per completed PES packet
+				if len(s.es) > 0 && !s.parsed {
+					probeElementaryStream(s)
+				}
+				var pts int64
+				payload, pts = parsePESHeader(payload)
+				if pts >= 0 && len(s.pts) < tsPTSSamples {
+					s.pts = append(s.pts, pts)
+				}
+			}
+			if !s.parsed && len(s.es)+len(payload) <= tsMaxESBytes {
+				s.es = append(s.es, payload...)
+			}
+		}
+
+		if streams != nil && allProbed(streams) {
+			break
+		}
+	}
+
+	if pmtPID < 0 || streams == nil {
+		return nil, errors.New("ts: no program map table")
+	}
+	for _, s := range streams {
+		if !s.parsed {
+			probeElementaryStream(s)
+		}
+		if s.Video && s.FrameRate == 0 {
+			s.FrameRate = frameRateFromPTS(s.pts)
+		}
+		s.es = nil
+	}
+	return streams, nil
+}
+
+func allProbed(streams []*tsStream) bool {
+	for _, s := range streams {
+		if !s.probed() {
+			return false
+		}
+	}
+	return true
+}
+
+// Return the payload of a TS packet, skipping any adaptation field
+func tsPayload(pkt []byte) []byte {
+	control := pkt[3] >> 4 & 0x3
+	if control&0x1 == 0 {
+		return nil
+	}
+	off := 4
+	if control&0x2 != 0 {
+		off += 1 + int(pkt[4])
+	}
+	if off >= len(pkt) {
+		return nil
+	}
+	return pkt[off:]
+}
+
+// Return the section following the pointer field of a PSI payload
+func psiSection(payload []byte, tableID byte) []byte {
+	if len(payload) < 1 || 1+int(payload[0])+3 > len(payload) {
+		return nil
+	}
+	section := payload[1+int(payload[0]):]
+	if section[0] != tableID {
+		return nil
+	}
+	length := int(binary.BigEndian.Uint16(section[1:3]) & 0x0fff)
+	if 3+length > len(section) || length < 9 {
+		return nil
+	}
+	// Drop the CRC
+	return section[:3+length-4]
+}
+
+// Return the PMT PID of the first program in a PAT
+func parsePAT(payload []byte) int {
+	section := psiSection(payload, 0x00)
+	for i := 8; i+4 <= len(section); i += 4 {
+		if program := binary.BigEndian.Uint16(section[i:]); program != 0 {
+			return int(binary.BigEndian.Uint16(section[i+2:]) & 0x1fff)
+		}
+	}
+	return -1
+}
+
+// Return the elementary streams listed in a PMT
+func parsePMT(payload []byte) []*tsStream {
+	section := psiSection(payload, 0x02)
+	if len(section) < 12 {
+		return nil
+	}
+	streams := []*tsStream{}
+	i := 12 + int(binary.BigEndian.Uint16(section[10:12])&0x0fff)
+	for i+5 <= len(section) {
+		s := &tsStream{
+			StreamType: section[i],
+			PID:        binary.BigEndian.Uint16(section[i+1:]) & 0x1fff,
+		}
+		i += 5 + int(binary.BigEndian.Uint16(section[i+3:])&0x0fff)
+
+		switch s.StreamType {
+		case 0x1b, 0x24:
+			s.Video = true
+		case 0x0f:
+		case 0x03, 0x04:
+			s.Codec = "mp4a.40.34"
+		case 0x81:
+			s.Codec = "ac-3"
+		case 0x87:
+			s.Codec = "ec-3"
+		default:
+			continue
+		}
+		streams = append(streams, s)
+	}
+	return streams
+}
+
+// Skip a PES header, returning the payload and the PTS (or -1)
+func parsePESHeader(p []byte) ([]byte, int64) {
+	if len(p) < 9 || p[0] != 0 || p[1] != 0 || p[2] != 1 {
+		return nil, -1
+	}
+	end := 9 + int(p[8])
+	if end > len(p) {
+		return nil, -1
+	}
+	pts := int64(-1)
+	if p[7]&0x80 != 0 && len(p) >= 14 {
+		pts = int64(p[9]>>1&0x07)<<30 | int64(p[10])<<22 | int64(p[11]>>1)<<15 |
+			int64(p[12])<<7 | int64(p[13]>>1)
+	}
+	return p[end:], pts
+}
+
+// Derive a frame rate from the smallest step between video PTS values
+func frameRateFromPTS(pts []int64) float64 {
+	if len(pts) < 2 {
+		return 0
+	}
+	sorted := append([]int64(nil), pts...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	step := int64(0)
+	for i := 1; i < len(sorted); i++ {
+		if d := sorted[i] - sorted[i-1]; d > 0 && (step == 0 || d < step) {
+			step = d
+		}
+	}
+	if step == 0 {
+		return 0
+	}
+	return 90000 / float64(step)
+}
+
+// Look for codec parameters in the bytes collected so far
+func probeElementaryStream(s *tsStream) {
+	switch s.StreamType {
+	case 0x1b:
+		if sps := findNAL(s.es, func(h []byte) bool { return h[0]&0x1f == 7 }); sps != nil {
+			parseH264SPS(unescapeRBSP(sps), s)
+			s.parsed = true
+		}
+	case 0x24:
+		if sps := findNAL(s.es, func(h []byte) bool { return len(h) > 1 && h[0]>>1&0x3f == 33 }); sps != nil {
+			parseHEVCSPS(unescapeRBSP(sps), s)
+			s.parsed = true
+		}
+	case 0x0f:
+		for i := 0; i+7 <= len(s.es); i++ {
+			if s.es[i] == 0xff && s.es[i+1]&0xf6 == 0xf0 {
+				s.Codec = fmt.Sprintf("mp4a.40.%d", s.es[i+2]>>6+1)
+				s.parsed = true
+				break
+			}
+		}
+	default:
+		s.parsed = true
+	}
+	if s.parsed {
+		s.es = nil
+	}
+}
+
+// Find the first complete NAL unit in an Annex B byte stream whose header
+// satisfies match. Returns nil until the following start code has arrived.
+func findNAL(es []byte, match func(header []byte) bool) []byte {
+	start := -1
+	for i := 0; i+3 <= len(es); i++ {
+		if es[i] != 0 || es[i+1] != 0 || es[i+2] != 1 {
+			continue
+		}
+		if start >= 0 {
+			end := i
+			if end > start && es[end-1] == 0 {
+				end--
+			}
+			return es[start:end]
+		}
+		if i+3 < len(es) && match(es[i+3:]) {
+			start = i + 3
+		}
+		i += 2
+	}
+	return nil
+}
+
+// Strip emulation prevention bytes (00 00 03) from a NAL unit
+func unescapeRBSP(nal []byte) []byte {
+	out := make([]byte, 0, len(nal))
+	zeros := 0
+	for _, b := range nal {
+		if zeros >= 2 && b == 3 {
+			zeros = 0
+			continue
+		}
+		if b == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		out = append(out, b)
+	}
+	return out
+}
+
+// bitReader reads the exp-Golomb coded fields of parameter sets. Reads past
+// the end return zeros and set err.
+type bitReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (b *bitReader) u(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		if b.pos >= len(b.data)*8 {
+			b.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		v = v<<1 | uint32(b.data[b.pos/8]>>(7-b.pos%8)&1)
+		b.pos++
+	}
+	return v
+}
+
+func (b *bitReader) flag() bool { return b.u(1) == 1 }
+
+func (b *bitReader) ue() uint32 {
+	zeros := 0
+	for !b.flag() {
+		if b.err != nil || zeros > 31 {
+			b.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + b.u(zeros)
+}
+
+func (b *bitReader) se() int32 {
+	v := b.ue()
+	if v&1 == 1 {
+		return int32(v+1) / 2
+	}
+	return -int32(v / 2)
+}
+
+// Parse an H.264 SPS (ITU-T H.264 7.3.2.1.1) for profile, level, coded size
+// and, when the VUI carries timing info, frame rate
+func parseH264SPS(sps []byte, s *tsStream) {
+	if len(sps) < 4 {
+		return
+	}
+	s.Codec = fmt.Sprintf("avc1.%02x%02x%02x", sps[1], sps[2], sps[3])
+
+	b := &bitReader{data: sps, pos: 32}
+	b.ue() // seq_parameter_set_id
+	chromaFormat := uint32(1)
+	separatePlanes := false
+	switch sps[1] {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		chromaFormat = b.ue()
+		if chromaFormat == 3 {
+			separatePlanes = b.flag()
+		}
+		b.ue() // bit_depth_luma_minus8
+		b.ue() // bit_depth_chroma_minus8
+		b.u(1) // qpprime_y_zero_transform_bypass_flag
+		if b.flag() {
+			lists := 8
+			if chromaFormat == 3 {
+				lists = 12
+			}
+			for i := 0; i < lists; i++ {
+				if !b.flag() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int32(8), int32(8)
+				for j := 0; j < size && next != 0; j++ {
+					next = (last + b.se() + 256) % 256
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	b.ue() // log2_max_frame_num_minus4
+	switch b.ue() {
+	case 0:
+		b.ue() // log2_max_pic_order_cnt_lsb_minus4
+	case 1:
+		b.u(1)
+		b.se()
+		b.se()
+		for n := b.ue(); n > 0 && b.err == nil; n-- {
+			b.se()
+		}
+	}
+	b.ue() // max_num_ref_frames
+	b.u(1) // gaps_in_frame_num_value_allowed_flag
+	widthMbs := b.ue() + 1
+	heightUnits := b.ue() + 1
+	frameMbsOnly := b.flag()
+	if !frameMbsOnly {
+		b.u(1) // mb_adaptive_frame_field_flag
+	}
+	b.u(1) // direct_8x8_inference_flag
+
+	var cropLeft, cropRight, cropTop, cropBottom uint32
+	if b.flag() {
+		cropLeft, cropRight, cropTop, cropBottom = b.ue(), b.ue(), b.ue(), b.ue()
+	}
+	if b.err != nil {
+		return
+	}
+
+	fieldFactor := uint32(2)
+	if frameMbsOnly {
+		fieldFactor = 1
+	}
+	cropX, cropY := uint32(1), fieldFactor
+	if chromaFormat != 0 && !separatePlanes {
+		subWidth, subHeight := uint32(2), uint32(2)
+		if chromaFormat == 2 {
+			subHeight = 1
+		} else if chromaFormat == 3 {
+			subWidth, subHeight = 1, 1
+		}
+		cropX, cropY = subWidth, subHeight*fieldFactor
+	}
+	s.Width = int(widthMbs*16 - cropX*(cropLeft+cropRight))
+	s.Height = int(fieldFactor*heightUnits*16 - cropY*(cropTop+cropBottom))
+
+	if !b.flag() { // vui_parameters_present_flag
+		return
+	}
+	if b.flag() { // aspect_ratio_info_present_flag
+		if b.u(8) == 255 {
+			b.u(32)
+		}
+	}
+	if b.flag() { // overscan_info_present_flag
+		b.u(1)
+	}
+	if b.flag() { // video_signal_type_present_flag
+		b.u(4)
+		if b.flag() {
+			b.u(24)
+		}
+	}
+	if b.flag() { // chroma_loc_info_present_flag
+		b.ue()
+		b.ue()
+	}
+	if b.flag() { // timing_info_present_flag
+		unitsInTick, timeScale := b.u(32), b.u(32)
+		if b.err == nil && unitsInTick > 0 {
+			s.FrameRate = float64(timeScale) / float64(2*unitsInTick)
+		}
+	}
+}
+
+// Parse an HEVC SPS (ITU-T H.265 7.3.2.2) for the codec string and picture
+// size. Frame rate is left to the PES timestamps.
+func parseHEVCSPS(sps []byte, s *tsStream) {
+	// 2 byte NAL header, 1 byte of VPS id/sub-layers/nesting, then the
+	// general profile_tier_level laid out exactly as in an hvcC record
+	if len(sps) < 15 {
+		return
+	}
+	s.Codec = hevcCodecString("hev1", append([]byte{1}, sps[3:15]...))
+
+	b := &bitReader{data: sps, pos: 15 * 8}
+	subLayers := int(sps[2] >> 1 & 0x7)
+	profilePresent := make([]bool, subLayers)
+	levelPresent := make([]bool, subLayers)
+	for i := 0; i < subLayers; i++ {
+		profilePresent[i], levelPresent[i] = b.flag(), b.flag()
+	}
+	if subLayers > 0 {
+		for i := subLayers; i < 8; i++ {
+			b.u(2)
+		}
+	}
+	for i := 0; i < subLayers; i++ {
+		if profilePresent[i] {
+			b.u(32)
+			b.u(32)
+			b.u(24)
+		}
+		if levelPresent[i] {
+			b.u(8)
+		}
+	}
+
+	b.ue() // sps_seq_parameter_set_id
+	chromaFormat := b.ue()
+	if chromaFormat == 3 && b.flag() {
+		chromaFormat = 0 // separate_colour_plane_flag
+	}
+	width, height := b.ue(), b.ue()
+	subWidth, subHeight := uint32(1), uint32(1)
+	switch chromaFormat {
+	case 1:
+		subWidth, subHeight = 2, 2
+	case 2:
+		subWidth = 2
+	}
+	if b.flag() { // conformance_window_flag
+		left, right, top, bottom := b.ue(), b.ue(), b.ue(), b.ue()
+		width -= subWidth * (left + right)
+		height -= subHeight * (top + bottom)
+	}
+	if b.err == nil {
+		s.Width, s.Height = int(width), int(height)
+	}
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// Describe HLS variants for EXT-X-STREAM-INF from their own media files:
+// codecs and resolution from the init segment (fMP4) or first segment (TS),
+// bitrates from segment sizes over #EXTINF durations.
+
+// hlsVariant is one rendition as advertised in the master playlist
+type hlsVariant struct {
+	Quality          string
+	Bandwidth        int64 // peak segment bitrate
+	AverageBandwidth int64
+	Codecs           string
+	Width            int
+	Height           int
+	FrameRate        float64
+}
+
+// Estimates used when a rendition cannot be probed
+var fallbackVariants = map[string]hlsVariant{
+	"144p":  {Bandwidth: 200000, Width: 256, Height: 144},
+	"240p":  {Bandwidth: 400000, Width: 426, Height: 240},
+	"360p":  {Bandwidth: 800000, Width: 640, Height: 360},
+	"480p":  {Bandwidth: 1400000, Width: 854, Height: 480},
+	"720p":  {Bandwidth: 2500000, Width: 1280, Height: 720},
+	"1080p": {Bandwidth: 5000000, Width: 1920, Height: 1080},
+	"1440p": {Bandwidth: 9000000, Width: 2560, Height: 1440},
+	"2160p": {Bandwidth: 16000000, Width: 3840, Height: 2160},
+}
+
+// Probed variants by uuid/quality, versioned by the playlist etag
+var variantProbes = newProbeCache[hlsVariant](4096)
+
+// Return the variant description of uuid/quality, probing on first use and
+// whenever its playlist changes. A rendition that cannot be probed is
+// described by estimates. ok is false if the rendition does not exist.
+func hlsVariantInfo(ctx context.Context, uuid, quality string) (variant hlsVariant, ok bool) {
+	dir := uuid + "/" + quality + "/"
+	info, err := config.HLSStore.Stat(ctx, dir+"playlist.m3u8")
+	if err != nil {
+		return hlsVariant{}, false
+	}
+
+	variant, err = variantProbes.Get(ctx, uuid+"/"+quality, info.ETag, func(ctx context.Context) (hlsVariant, error) {
+		v, err := probeVariant(ctx, dir, quality)
+		if err != nil {
+			return hlsVariant{}, err
+		}
+		return *v, nil
+	})
+	if err == nil {
+		return variant, true
+	}
+	if ctx.Err() == nil {
+		logger.Warn("HLS probe failed", "uuid", uuid, "quality", quality, "error", err)
+	}
+	variant = fallbackVariants[quality]
+	variant.Quality = quality
+	if variant.Bandwidth == 0 {
+		variant.Bandwidth = fallbackVariants["720p"].Bandwidth
+	}
+	return variant, true
+}
+
+// Probe a rendition's codecs, picture and bitrates from the files in dir
+func probeVariant(ctx context.Context, dir, quality string) (*hlsVariant, error) {
+	playlist, err := readHLSMediaPlaylist(ctx, dir+"playlist.m3u8")
+	if err != nil {
+		return nil, err
+	}
+	if len(playlist.Segments) == 0 {
+		return nil, errors.New("playlist has no segments")
+	}
+	for _, s := range playlist.Segments {
+		if !validSegment(s) {
+			return nil, fmt.Errorf("unsupported segment URI %q", s)
+		}
+	}
+
+	v := &hlsVariant{Quality: quality}
+
+	// One listing rather than a Stat per segment, which on S3 or an origin
+	// would be a request each
+	infos, err := config.HLSStore.List(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	sizes := make(map[string]int64, len(infos))
+	for _, info := range infos {
+		sizes[info.Key] = info.Size
+	}
+
+	var totalBytes int64
+	var totalDuration float64
+	for i, s := range playlist.Segments {
+		size, ok := sizes[dir+s]
+		if !ok {
+			return nil, fmt.Errorf("segment %s: %w", s, fs.ErrNotExist)
+		}
+		duration := playlist.Durations[i]
+		if duration <= 0 {
+			continue
+		}
+		totalBytes += size
+		totalDuration += duration
+		if peak := int64(float64(size*8) / duration); peak > v.Bandwidth {
+			v.Bandwidth = peak
+		}
+	}
+	if totalDuration == 0 {
+		return nil, errors.New("playlist has no segment durations")
+	}
+	v.AverageBandwidth = int64(float64(totalBytes*8) / totalDuration)
+
+	if playlist.Init != "" {
+		err = probeFMP4Variant(ctx, v, dir, playlist.Init, playlist.Segments[0])
+	} else {
+		err = probeTSVariant(ctx, v, dir+playlist.Segments[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Read codecs and picture size from the init segment, and frame rate from
+// the sample count of the first media segment
+func probeFMP4Variant(ctx context.Context, v *hlsVariant, dir, init, first string) error {
+	if !validSegment(init) {
+		return fmt.Errorf("unsupported init segment URI %q", init)
+	}
+	f, err := config.HLSStore.Open(ctx, dir+init)
+	if err != nil {
+		return err
+	}
+	info, err := probeMP4(f, f.Info().Size)
+	f.Close()
+	if err != nil {
+		return err
+	}
+	v.Codecs = info.Codecs()
+
+	video, ok := info.Track("vide")
+	if !ok {
+		return nil
+	}
+	v.Width, v.Height = video.Width, video.Height
+
+	seg, err := config.HLSStore.Open(ctx, dir+first)
+	if err != nil {
+		return err
+	}
+	defer seg.Close()
+	timing, err := probeFragment(seg, seg.Info().Size, video)
+	if err == nil && timing.Samples > 0 && timing.Duration > 0 {
+		timescale := timing.Timescale
+		if timescale == 0 {
+			timescale = video.Timescale
+		}
+		v.FrameRate = float64(timing.Samples) * float64(timescale) / float64(timing.Duration)
+	}
+	return nil
+}
+
+// Read codecs, picture size and frame rate from a transport stream segment
+func probeTSVariant(ctx context.Context, v *hlsVariant, key string) error {
+	f, err := config.HLSStore.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	streams, err := probeTS(f, f.Info().Size)
+	if err != nil {
+		return err
+	}
+
+	// First video and first audio stream, video first
+	var video, audio *tsStream
+	for _, s := range streams {
+		switch {
+		case s.Codec == "":
+		case s.Video && video == nil:
+			video = s
+		case !s.Video && audio == nil:
+			audio = s
+		}
+	}
+
+	var codecs []string
+	if video != nil {
+		codecs = append(codecs, video.Codec)
+		v.Width, v.Height, v.FrameRate = video.Width, video.Height, video.FrameRate
+	}
+	if audio != nil {
+		codecs = append(codecs, audio.Codec)
+	}
+	if len(codecs) == 0 {
+		return errors.New("no supported elementary streams")
+	}
+	v.Codecs = strings.Join(codecs, ",")
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// bitWriter builds exp-Golomb coded parameter sets
+type bitWriter struct {
+	buf  []byte
+	bits int
+}
+
+func (w *bitWriter) u(n int, v uint32) {
+	for i := n - 1; i >= 0; i-- {
+		if w.bits%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		w.buf[len(w.buf)-1] |= byte(v>>i&1) << (7 - w.bits%8)
+		w.bits++
+	}
+}
+
+func (w *bitWriter) ue(v uint32) {
+	n := 0
+	for (v+1)>>n > 1 {
+		n++
+	}
+	w.u(n, 0)
+	w.u(n+1, v+1)
+}
+
+// Build a baseline H.264 SPS NAL for 1280x720 at 30000/1001 fps
+func testH264SPS() []byte {
+	w := &bitWriter{}
+	w.u(8, 0x67)   // NAL header
+	w.u(8, 66)     // profile_idc
+	w.u(8, 0xc0)   // constraint flags
+	w.u(8, 31)     // level_idc
+	w.ue(0)        // seq_parameter_set_id
+	w.ue(0)        // log2_max_frame_num_minus4
+	w.ue(2)        // pic_order_cnt_type
+	w.ue(1)        // max_num_ref_frames
+	w.u(1, 0)      // gaps_in_frame_num_value_allowed_flag
+	w.ue(79)       // pic_width_in_mbs_minus1
+	w.ue(44)       // pic_height_in_map_units_minus1
+	w.u(1, 1)      // frame_mbs_only_flag
+	w.u(1, 1)      // direct_8x8_inference_flag
+	w.u(1, 0)      // frame_cropping_flag
+	w.u(1, 1)      // vui_parameters_present_flag
+	w.u(4, 0)      // aspect ratio, overscan, video signal, chroma loc
+	w.u(1, 1)      // timing_info_present_flag
+	w.u(32, 1001)  // num_units_in_tick
+	w.u(32, 60000) // time_scale
+	w.u(1, 1)      // fixed_frame_rate_flag
+	w.u(1, 1)      // rbsp_stop_one_bit
+	return w.buf
+}
+
+// Wrap payload in a TS packet, stuffing the adaptation field to 188 bytes
+func tsPacket(pid uint16, start bool, payload []byte) []byte {
+	pkt := []byte{0x47, byte(pid >> 8 & 0x1f), byte(pid), 0x10}
+	if start {
+		pkt[1] |= 0x40
+	}
+	if stuffing := 184 - len(payload); stuffing > 0 {
+		pkt[3] = 0x30
+		pkt = append(pkt, byte(stuffing-1))
+		if stuffing > 1 {
+			pkt = append(pkt, 0)
+			pkt = append(pkt, bytes.Repeat([]byte{0xff}, stuffing-2)...)
+		}
+	}
+	return append(pkt, payload...)
+}
+
+func pesPacket(streamID byte, pts int64, data []byte) []byte {
+	return append([]byte{
+		0, 0, 1, streamID, 0, 0, 0x80, 0x80, 5,
+		byte(0x21 | pts>>29&0x0e), byte(pts >> 22), byte(pts>>14 | 1), byte(pts >> 7), byte(pts<<1 | 1),
+	}, data...)
+}
+
+// Build a transport stream segment with an H.264 and an AAC-LC stream
+func testTSSegment() []byte {
+	pat := []byte{0, 0x00, 0xb0, 13, 0, 1, 0xc1, 0, 0, 0, 1, 0xf0, 0x00, 0, 0, 0, 0}
+	pmt := []byte{0, 0x02, 0xb0, 23, 0, 1, 0xc1, 0, 0, 0xe1, 0x00, 0xf0, 0x00,
+		0x1b, 0xe1, 0x00, 0xf0, 0x00,
+		0x0f, 0xe1, 0x01, 0xf0, 0x00,
+		0, 0, 0, 0}
+
+	var video []byte
+	video = append(video, 0, 0, 0, 1)
+	video = append(video, testH264SPS()...)
+	video = append(video, 0, 0, 0, 1, 0x68, 0xce, 0x38, 0x80) // PPS
+	video = append(video, 0, 0, 0, 1, 0x65, 0x88, 0x84)       // IDR slice
+	adts := []byte{0xff, 0xf1, 0x50, 0x80, 0x02, 0x1f, 0xfc}
+
+	return bytes.Join([][]byte{
+		tsPacket(0, true, pat),
+		tsPacket(0x1000, true, pmt),
+		tsPacket(0x100, true, pesPacket(0xe0, 0, video)),
+		tsPacket(0x101, true, pesPacket(0xc0, 0, adts)),
+	}, nil)
+}
+
+func TestProbeTS(t *testing.T) {
+	seg := testTSSegment()
+	streams, err := probeTS(bytes.NewReader(seg), int64(len(seg)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(streams) != 2 {
+		t.Fatalf("got %d streams, want 2", len(streams))
+	}
+
+	video, audio := streams[0], streams[1]
+	if video.Codec != "avc1.42c01f" || video.Width != 1280 || video.Height != 720 {
+		t.Errorf("video = %+v", video)
+	}
+	if fps := video.FrameRate; fps < 29.96 || fps > 29.98 {
+		t.Errorf("frame rate = %f, want 29.970", fps)
+	}
+	if audio.Codec != "mp4a.40.2" {
+		t.Errorf("audio codec = %q, want mp4a.40.2", audio.Codec)
+	}
+}
+
+func TestGenerateMasterPlaylist(t *testing.T) {
+	setupStorage(t)
+	hls := filepath.Join(config.HLSBasePath, testUUID)
+	files := map[string][]byte{
+		"720p/playlist.m3u8": []byte("#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n#EXTINF:2.0,\nseg_00001.m4s\n#EXTINF:1.0,\nseg_00002.m4s\n#EXT-X-ENDLIST\n"),
+		"720p/init.mp4":      testInitSegment(),
+		"720p/seg_00001.m4s": testMediaSegment(0, 60),
+		"720p/seg_00002.m4s": testMediaSegment(180000, 30),
+		"360p/playlist.m3u8": []byte("#EXTM3U\n#EXTINF:4.000,\nseg_00001.ts\n#EXT-X-ENDLIST\n"),
+		"360p/seg_00001.ts":  testTSSegment(),
+	}
+	for name, data := range files {
+		path := filepath.Join(hls, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	master := func() string {
+		rec := httptest.NewRecorder()
+		newRouter().ServeHTTP(rec, httptest.NewRequest("GET", "/hls/"+testUUID+"/master.m3u8", nil))
+		return rec.Body.String()
+	}
+	body := master()
+
+	// 360p: one 752 byte segment over 4s. 720p: 1348 bytes over 2s and
+	// 1228 bytes over 1s, so the second segment sets the peak.
+	want := []string{
+		`#EXT-X-STREAM-INF:BANDWIDTH=1504,AVERAGE-BANDWIDTH=1504,CODECS="avc1.42c01f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=29.970,NAME="360p"`,
+		`#EXT-X-STREAM-INF:BANDWIDTH=9824,AVERAGE-BANDWIDTH=6869,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=30.000,NAME="720p"`,
+	}
+	for _, line := range want {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("master playlist missing %q:\n%s", line, body)
+		}
+	}
+	if strings.Index(body, `NAME="360p"`) > strings.Index(body, `NAME="720p"`) {
+		t.Errorf("variants out of ladder order:\n%s", body)
+	}
+
+	// A rendition that cannot be probed yet is estimated, and probed again
+	// once the failure expires rather than only once its playlist changes
+	defer func(ttl time.Duration) { probeFailureTTL = ttl }(probeFailureTTL)
+	probeFailureTTL = 20 * time.Millisecond
+	if err := os.MkdirAll(filepath.Join(hls, "480p"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(hls, "480p", "playlist.m3u8"), files["360p/playlist.m3u8"], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if body := master(); !strings.Contains(body, `#EXT-X-STREAM-INF:BANDWIDTH=1400000,RESOLUTION=854x480,NAME="480p"`+"\n") {
+		t.Errorf("unprobed 480p not estimated:\n%s", body)
+	}
+	if err := os.WriteFile(filepath.Join(hls, "480p", "seg_00001.ts"), files["360p/seg_00001.ts"], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(2 * probeFailureTTL)
+	if body := master(); !strings.Contains(body, `#EXT-X-STREAM-INF:BANDWIDTH=1504,AVERAGE-BANDWIDTH=1504,CODECS="avc1.42c01f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=29.970,NAME="480p"`+"\n") {
+		t.Errorf("480p not probed once its segment exists:\n%s", body)
+	}
+}
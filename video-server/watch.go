@@ -0,0 +1,250 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Encoding jobs write renditions straight into the local storage roots, so
+// the server watches the roots and drops cached blocks, rewritten playlists,
+// probes and file lookups of every file that is created, replaced or
+// removed. inotify is used where available; when it is unsupported or runs
+// out of watches, the roots are polled for size and mtime changes instead.
+
+// watchBackend reports changed paths until it fails or is closed
+type watchBackend interface {
+	run(changed func(paths []string)) error // nil once closed
+	Close() error
+}
+
+// errInotifyUnsupported is returned by newInotifyBackend off Linux
+var errInotifyUnsupported = errors.New("inotify is not supported on this platform")
+
+// newInotify opens the inotify backend; replaced in tests
+var newInotify = newInotifyBackend
+
+// fsWatcher runs one backend at a time over the storage roots
+type fsWatcher struct {
+	roots []string // symlink-free, as used in cache names
+
+	mu      sync.Mutex
+	backend watchBackend
+	mode    string // inotify or poll
+	closed  bool
+	done    chan struct{}
+
+	invalidations atomic.Int64
+}
+
+var watcher *fsWatcher
+
+// Start watching the local storage roots in the given mode: auto, poll or
+// off. Roots that cannot be resolved are skipped.
+func startWatcher(c *Config) *fsWatcher {
+	if c.StorageDriver != "local" || c.WatchMode == "off" {
+		return nil
+	}
+	w := &fsWatcher{done: make(chan struct{})}
+	for _, root := range []string{c.VideoBasePath, c.PublicBasePath, c.HLSBasePath} {
+		real, err := resolveRoot(root)
+		if err != nil {
+			logger.Warn("not watching storage root", "path", root, "error", err)
+			continue
+		}
+		w.roots = append(w.roots, real)
+	}
+	go w.loop(c.WatchMode)
+	return w
+}
+
+func (w *fsWatcher) loop(mode string) {
+	defer close(w.done)
+	if mode == "auto" {
+		b, err := newInotify(w.roots)
+		if err == nil && w.use(b, "inotify") {
+			logger.Info("watching storage roots", "mode", "inotify", "roots", w.roots)
+			if err = b.run(w.invalidate); err == nil {
+				return
+			}
+			b.Close()
+		}
+		if w.isClosed() {
+			return
+		}
+		// Changes may have been missed while switching over
+		logger.Warn("inotify unavailable, polling storage roots instead", "error", err)
+		w.invalidate(w.roots)
+	}
+
+	p := newPollBackend(w.roots)
+	if !w.use(p, "poll") {
+		return
+	}
+	logger.Info("watching storage roots", "mode", "poll", "roots", w.roots)
+	p.run(w.invalidate)
+}
+
+// use installs a backend unless the watcher has been closed
+func (w *fsWatcher) use(b watchBackend, mode string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		b.Close()
+		return false
+	}
+	w.backend, w.mode = b, mode
+	return true
+}
+
+func (w *fsWatcher) isClosed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.closed
+}
+
+// Mode returns the running backend, or "" before one has started
+func (w *fsWatcher) Mode() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.mode
+}
+
+// Close stops the watcher and waits for it to finish
+func (w *fsWatcher) Close() {
+	w.mu.Lock()
+	w.closed = true
+	if w.backend != nil {
+		w.backend.Close()
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+// invalidate drops everything cached for the given files, or for everything
+// below them when they are directories
+func (w *fsWatcher) invalidate(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+	match := func(name string) bool {
+		for _, p := range paths {
+			if name == p || strings.HasPrefix(name, p+string(filepath.Separator)) {
+				return true
+			}
+		}
+		return false
+	}
+	blocks, _ := videoCache.Purge(match)
+	if diskCache != nil {
+		n, _ := diskCache.Purge(match)
+		blocks += n
+	}
+	playlists := rewrittenPlaylists.Purge(match)
+
+	// Generated master playlists and DASH manifests come from the probes;
+	// a new file may also change which file a lookup resolves to
+	probes, lookups := 0, 0
+	for uuid := range w.videos(paths) {
+		probes += purgeProbes(uuid)
+		lookups += videoLookups.Purge(uuid)
+	}
+	w.invalidations.Add(int64(len(paths)))
+	logger.Debug("storage changed", "paths", len(paths), "blocks", blocks, "playlists", playlists, "probes", probes, "lookups", lookups)
+}
+
+// videos returns the uuids the paths belong to; a root stands for every video
+func (w *fsWatcher) videos(paths []string) map[string]bool {
+	uuids := make(map[string]bool)
+	for _, p := range paths {
+		for _, root := range w.roots {
+			rel, err := filepath.Rel(root, p)
+			if err != nil || strings.HasPrefix(rel, "..") {
+				continue
+			}
+			if rel == "." {
+				uuids[""] = true
+				continue
+			}
+			elem, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+			if len(elem) >= 36 && validUUID(elem[:36]) {
+				uuids[elem[:36]] = true
+			}
+		}
+	}
+	if uuids[""] {
+		return map[string]bool{"": true}
+	}
+	return uuids
+}
+
+// pollBackend scans the roots every watch-poll-interval and reports files
+// whose size, mtime or inode changed, appeared or disappeared
+type pollBackend struct {
+	roots []string
+	files map[string]string // path -> validator
+	stop  chan struct{}
+	once  sync.Once
+}
+
+func newPollBackend(roots []string) *pollBackend {
+	p := &pollBackend{roots: roots, stop: make(chan struct{})}
+	p.files = p.scan()
+	return p
+}
+
+func (p *pollBackend) run(changed func(paths []string)) error {
+	for {
+		timer := time.NewTimer(currentConfig().WatchPollInterval)
+		select {
+		case <-p.stop:
+			timer.Stop()
+			return nil
+		case <-timer.C:
+		}
+		changed(p.poll())
+	}
+}
+
+func (p *pollBackend) Close() error {
+	p.once.Do(func() { close(p.stop) })
+	return nil
+}
+
+// poll rescans the roots and returns the paths that changed since last time
+func (p *pollBackend) poll() []string {
+	files := p.scan()
+	var paths []string
+	for path, v := range files {
+		if p.files[path] != v {
+			paths = append(paths, path)
+		}
+	}
+	for path := range p.files {
+		if _, ok := files[path]; !ok {
+			paths = append(paths, path)
+		}
+	}
+	p.files = files
+	return paths
+}
+
+func (p *pollBackend) scan() map[string]string {
+	files := make(map[string]string)
+	for _, root := range p.roots {
+		filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() {
+				return nil
+			}
+			if info, err := d.Info(); err == nil {
+				files[path] = fileETag(info)
+			}
+			return nil
+		})
+	}
+	return files
+}
@@ -0,0 +1,151 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Events that mean a file's content or existence changed. Writes are seen
+// once the writer closes the file, not on every write.
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_DELETE_SELF | syscall.IN_ONLYDIR
+
+// inotifyBackend watches every directory below the roots. inotify is not
+// recursive, so directories created later are added as they appear.
+type inotifyBackend struct {
+	file  *os.File // non-blocking, so Close interrupts a pending Read
+	fd    int
+	roots []string
+
+	mu    sync.Mutex
+	dirs  map[int32]string // watch descriptor -> directory
+	close sync.Once
+}
+
+func newInotifyBackend(roots []string) (watchBackend, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init1: %w", err)
+	}
+	b := &inotifyBackend{file: os.NewFile(uintptr(fd), "inotify"), fd: fd, roots: roots, dirs: make(map[int32]string)}
+	for _, root := range roots {
+		if err := b.addTree(root); err != nil {
+			b.Close()
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// addTree watches dir and every directory below it. Running out of watches
+// fails; directories that vanish while walking are skipped.
+func (b *inotifyBackend) addTree(dir string) error {
+	return filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		wd, err := syscall.InotifyAddWatch(b.fd, path, inotifyMask)
+		if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.ENOMEM) {
+			return fmt.Errorf("inotify watch on %s: %w (raise fs.inotify.max_user_watches)", path, err)
+		}
+		if err != nil {
+			return nil
+		}
+		b.mu.Lock()
+		b.dirs[int32(wd)] = path
+		b.mu.Unlock()
+		return nil
+	})
+}
+
+// forget drops the watches of dir and everything below it after it moved away
+func (b *inotifyBackend) forget(dir string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for wd, path := range b.dirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			syscall.InotifyRmWatch(b.fd, uint32(wd))
+			delete(b.dirs, wd)
+		}
+	}
+}
+
+func (b *inotifyBackend) run(changed func(paths []string)) error {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := b.file.Read(buf)
+		if errors.Is(err, os.ErrClosed) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("inotify read: %w", err)
+		}
+		paths, err := b.parse(buf[:n])
+		changed(paths)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// parse turns a buffer of events into changed paths, watching directories
+// that were created or moved in
+func (b *inotifyBackend) parse(buf []byte) ([]string, error) {
+	var paths []string
+	for len(buf) >= syscall.SizeofInotifyEvent {
+		wd := int32(binary.NativeEndian.Uint32(buf[0:]))
+		mask := binary.NativeEndian.Uint32(buf[4:])
+		nameLen := int(binary.NativeEndian.Uint32(buf[12:]))
+		if syscall.SizeofInotifyEvent+nameLen > len(buf) {
+			break
+		}
+		name := strings.TrimRight(string(buf[syscall.SizeofInotifyEvent:syscall.SizeofInotifyEvent+nameLen]), "\x00")
+		buf = buf[syscall.SizeofInotifyEvent+nameLen:]
+
+		if mask&syscall.IN_Q_OVERFLOW != 0 {
+			// Events were lost; anything may have changed
+			paths = append(paths, b.roots...)
+			continue
+		}
+		b.mu.Lock()
+		dir, ok := b.dirs[wd]
+		if mask&syscall.IN_IGNORED != 0 {
+			delete(b.dirs, wd)
+		}
+		b.mu.Unlock()
+		if !ok || name == "" {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		paths = append(paths, path)
+		if mask&syscall.IN_ISDIR == 0 {
+			continue
+		}
+		switch {
+		case mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0:
+			// Files written before the watch was added are covered by path
+			if err := b.addTree(path); err != nil {
+				return paths, err
+			}
+		case mask&syscall.IN_MOVED_FROM != 0:
+			b.forget(path)
+		}
+	}
+	return paths, nil
+}
+
+func (b *inotifyBackend) Close() error {
+	var err error
+	b.close.Do(func() { err = b.file.Close() })
+	return err
+}
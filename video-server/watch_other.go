@@ -0,0 +1,8 @@
+//go:build !linux
+
+package main
+
+// Only Linux has inotify; other platforms poll the storage roots
+func newInotifyBackend(roots []string) (watchBackend, error) {
+	return nil, errInotifyUnsupported
+}
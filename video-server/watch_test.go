@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestWatcherInvalidatesChangedFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		inotify  func([]string) (watchBackend, error)
+		wantMode string
+	}{
+		{"inotify", "auto", newInotifyBackend, "inotify"},
+		{"poll", "poll", newInotifyBackend, "poll"},
+		{"watch limit", "auto", func([]string) (watchBackend, error) {
+			return nil, errors.New("inotify watch: no space left on device")
+		}, "poll"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.wantMode == "inotify" && runtime.GOOS != "linux" {
+				t.Skip("inotify needs Linux")
+			}
+			setupStorage(t)
+			config.CacheEnabled = true
+			config.WatchMode = tt.mode
+			config.WatchPollInterval = 10 * time.Millisecond
+			newInotify = tt.inotify
+			t.Cleanup(func() { newInotify = newInotifyBackend })
+
+			w := startWatcher(&config)
+			defer w.Close()
+			waitFor(t, "the watcher to start", func() bool { return w.Mode() != "" })
+			if w.Mode() != tt.wantMode {
+				t.Fatalf("mode = %q, want %q", w.Mode(), tt.wantMode)
+			}
+
+			// Rewrite a cached file and a file in a directory created after start
+			const newUUID = "99999999-2222-3333-4444-555555555555"
+			newSeg := filepath.Join(config.HLSBasePath, newUUID, "720p", "seg_00001.ts")
+			os.MkdirAll(filepath.Dir(newSeg), 0o755)
+			os.WriteFile(newSeg, []byte("new segment"), 0o644)
+			// The poller only sees files that were there at its previous scan
+			time.Sleep(50 * time.Millisecond)
+
+			for _, key := range []string{testUUID + "/720p/seg_00001.ts", newUUID + "/720p/seg_00001.ts"} {
+				info, err := config.HLSStore.Stat(context.Background(), key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if _, err := warmStoredFile(context.Background(), config.HLSStore, key); err != nil {
+					t.Fatal(err)
+				}
+				variantProbes.Get(context.Background(), key[:36]+"/720p", info.ETag, func(context.Context) (hlsVariant, error) {
+					return hlsVariant{}, nil
+				})
+
+				block := cacheKey{path: info.Name, etag: info.ETag}
+				if !videoCache.Contains(block) {
+					t.Fatalf("%s not cached", key)
+				}
+				if err := os.WriteFile(info.Name, []byte("re-encoded segment"), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				waitFor(t, "invalidation of "+key, func() bool { return !videoCache.Contains(block) })
+				waitFor(t, "the probe of "+key+" to be dropped", func() bool {
+					variantProbes.mu.Lock()
+					defer variantProbes.mu.Unlock()
+					_, ok := variantProbes.entries[key[:36]+"/720p"]
+					return !ok
+				})
+			}
+		})
+	}
+}